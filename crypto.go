@@ -63,7 +63,9 @@ func (cs CipherSuite) String() string {
 	return "UnknownCipherSuite"
 }
 
-type cipherConstants struct {
+// SuiteConstants are the sizes and HPKE algorithms that a cipher suite fixes,
+// e.g., for callers building their own framing around the suite's AEAD
+type SuiteConstants struct {
 	KeySize    int
 	NonceSize  int
 	SecretSize int
@@ -72,10 +74,12 @@ type cipherConstants struct {
 	HPKEAEAD   hpke.AEADID
 }
 
-func (cs CipherSuite) Constants() cipherConstants {
+// Constants returns the suite's constants.  It panics for an unsupported
+// suite.
+func (cs CipherSuite) Constants() SuiteConstants {
 	switch cs {
 	case X25519_AES128GCM_SHA256_Ed25519:
-		return cipherConstants{
+		return SuiteConstants{
 			KeySize:    16,
 			NonceSize:  12,
 			SecretSize: 32,
@@ -84,7 +88,7 @@ func (cs CipherSuite) Constants() cipherConstants {
 			HPKEAEAD:   hpke.AEAD_AESGCM128,
 		}
 	case P256_AES128GCM_SHA256_P256:
-		return cipherConstants{
+		return SuiteConstants{
 			KeySize:    16,
 			NonceSize:  12,
 			SecretSize: 32,
@@ -93,7 +97,7 @@ func (cs CipherSuite) Constants() cipherConstants {
 			HPKEAEAD:   hpke.AEAD_AESGCM128,
 		}
 	case X25519_CHACHA20POLY1305_SHA256_Ed25519:
-		return cipherConstants{
+		return SuiteConstants{
 			KeySize:    32,
 			NonceSize:  12,
 			SecretSize: 32,
@@ -102,7 +106,7 @@ func (cs CipherSuite) Constants() cipherConstants {
 			HPKEAEAD:   hpke.AEAD_CHACHA20POLY1305,
 		}
 	case P521_AES256GCM_SHA512_P521:
-		return cipherConstants{
+		return SuiteConstants{
 			KeySize:    32,
 			NonceSize:  12,
 			SecretSize: 64,
@@ -153,6 +157,23 @@ func (cs CipherSuite) Digest(data []byte) []byte {
 	return d.Sum(nil)
 }
 
+// InitialTranscriptHash returns the transcript hash of a group that has just
+// been created, from which both the confirmed and interim transcript hashes of
+// later epochs are chained.  It is the empty string, whatever the suite.
+func InitialTranscriptHash() []byte {
+	return []byte{}
+}
+
+// TranscriptHash extends a transcript hash with the encoding of a commit (for
+// the confirmed transcript hash) or of its authentication data (for the
+// interim transcript hash).
+func TranscriptHash(suite CipherSuite, prev, data []byte) []byte {
+	digest := suite.newDigest()
+	digest.Write(prev)
+	digest.Write(data)
+	return digest.Sum(nil)
+}
+
 func (cs CipherSuite) NewHMAC(key []byte) hash.Hash {
 	return hmac.New(cs.newDigest, key)
 }
@@ -175,6 +196,40 @@ func (cs CipherSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
 	panic("Unsupported ciphersuite")
 }
 
+// Length of the reuse guard that senders XOR into the leading bytes of the
+// content nonce
+func (cs CipherSuite) ReuseGuardSize() int {
+	return 4
+}
+
+// AEAD encryption and decryption with the nonce length checked up front, so
+// that a mismatched nonce produces an error rather than a panic in the AEAD
+func (cs CipherSuite) seal(key, nonce, aad, pt []byte) ([]byte, error) {
+	aead, err := cs.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Incorrect nonce length %d != %d", len(nonce), aead.NonceSize())
+	}
+
+	return aead.Seal(nil, nonce, pt, aad), nil
+}
+
+func (cs CipherSuite) open(key, nonce, aad, ct []byte) ([]byte, error) {
+	aead, err := cs.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Incorrect nonce length %d != %d", len(nonce), aead.NonceSize())
+	}
+
+	return aead.Open(nil, nonce, ct, aad)
+}
+
 func (cs CipherSuite) hkdfExtract(salt, ikm []byte) []byte {
 	mac := cs.NewHMAC(salt)
 	mac.Write(ikm)
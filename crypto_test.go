@@ -49,6 +49,24 @@ func TestDigest(t *testing.T) {
 	}
 }
 
+func TestTranscriptHash(t *testing.T) {
+	commit := []byte("commit")
+	authData := []byte("auth data")
+
+	initial := InitialTranscriptHash()
+	require.Equal(t, initial, []byte{})
+
+	for _, suite := range supportedSuites {
+		// The first confirmed hash covers only the commit
+		confirmed := TranscriptHash(suite, initial, commit)
+		require.Equal(t, len(confirmed), suite.newDigest().Size())
+		require.Equal(t, confirmed, suite.Digest(commit))
+
+		interim := TranscriptHash(suite, confirmed, authData)
+		require.Equal(t, interim, suite.Digest(append(dup(confirmed), authData...)))
+	}
+}
+
 func TestEncryptDecrypt(t *testing.T) {
 	// AES-GCM
 	// https://tools.ietf.org/html/draft-mcgrew-gcm-test-01#section-4
@@ -126,6 +144,55 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 }
 
+func TestSealOpenNonceSize(t *testing.T) {
+	aad := []byte("aad")
+	pt := []byte("plaintext")
+
+	for _, suite := range supportedSuites {
+		key := randomBytes(suite.Constants().KeySize)
+		nonce := randomBytes(12)
+		require.Equal(t, suite.Constants().NonceSize, len(nonce))
+
+		ct, err := suite.seal(key, nonce, aad, pt)
+		require.Nil(t, err)
+
+		decrypted, err := suite.open(key, nonce, aad, ct)
+		require.Nil(t, err)
+		require.Equal(t, pt, decrypted)
+
+		badNonce := randomBytes(16)
+		_, err = suite.seal(key, badNonce, aad, pt)
+		require.Error(t, err)
+
+		_, err = suite.open(key, badNonce, aad, ct)
+		require.Error(t, err)
+	}
+}
+
+func TestSuiteConstants(t *testing.T) {
+	for _, suite := range supportedSuites {
+		require.True(t, suite.supported())
+
+		c := suite.Constants()
+		require.Equal(t, c.SecretSize, suite.newDigest().Size())
+		require.Equal(t, c.SecretSize, len(suite.zero()))
+		require.True(t, suite.ReuseGuardSize() <= c.NonceSize)
+		require.True(t, c.KeySize <= c.SecretSize)
+
+		aead, err := suite.NewAEAD(make([]byte, c.KeySize))
+		require.Nil(t, err)
+		require.Equal(t, c.NonceSize, aead.NonceSize())
+		_, err = suite.NewAEAD(make([]byte, c.KeySize-1))
+		require.Error(t, err)
+
+		// Changing the returned value doesn't change the suite
+		c.KeySize = 0
+		require.NotEqual(t, suite.Constants().KeySize, 0)
+	}
+
+	require.Panics(t, func() { X448_AES256GCM_SHA512_Ed448.Constants() })
+}
+
 func TestHPKE(t *testing.T) {
 	aad := []byte("doo-bee-doo")
 	original := []byte("Attack at dawn!")
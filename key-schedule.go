@@ -1,9 +1,27 @@
 package mls
 
 import (
+	"bytes"
+	"container/list"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cisco/go-tls-syntax"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 type keyAndNonce struct {
@@ -11,6 +29,27 @@ type keyAndNonce struct {
 	Nonce []byte `tls:"head=1"`
 }
 
+// The key and nonce are each encoded with a one-byte length.  This is enough
+// for every AEAD in use today; changing it would break compatibility with
+// stored state, so oversized values are rejected instead.
+const maxKeyAndNonceSize = 0xff
+
+// keyAndNonceData has the same layout as keyAndNonce, without its custom TLS
+// methods
+type keyAndNonceData keyAndNonce
+
+func (k keyAndNonce) MarshalTLS() ([]byte, error) {
+	if len(k.Key) > maxKeyAndNonceSize {
+		return nil, fmt.Errorf("Key too long to encode %d > %d", len(k.Key), maxKeyAndNonceSize)
+	}
+
+	if len(k.Nonce) > maxKeyAndNonceSize {
+		return nil, fmt.Errorf("Nonce too long to encode %d > %d", len(k.Nonce), maxKeyAndNonceSize)
+	}
+
+	return syntax.Marshal(keyAndNonceData(k))
+}
+
 func (k keyAndNonce) clone() keyAndNonce {
 	return keyAndNonce{
 		Key:   dup(k.Key),
@@ -18,341 +57,4105 @@ func (k keyAndNonce) clone() keyAndNonce {
 	}
 }
 
-func zeroize(data []byte) {
-	for i := range data {
-		data[i] = 0
+func zeroize(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// Whether a secret is empty or all zero, e.g., because it has been zeroized
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Sorted views of the maps held by the key schedule, so that anything that
+// walks them (dumps, serialization, tests) sees a stable order
+func sortedGenerations(cache map[uint32]keyAndNonce) []uint32 {
+	gens := make([]uint32, 0, len(cache))
+	for gen := range cache {
+		gens = append(gens, gen)
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i] < gens[j] })
+	return gens
+}
+
+func sortedNodes(secrets map[NodeIndex]Bytes1) []NodeIndex {
+	nodes := make([]NodeIndex, 0, len(secrets))
+	for node := range secrets {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+	return nodes
+}
+
+func sortedSenders(ratchets map[LeafIndex]*hashRatchet) []LeafIndex {
+	senders := make([]LeafIndex, 0, len(ratchets))
+	for sender := range ratchets {
+		senders = append(senders, sender)
+	}
+	sort.Slice(senders, func(i, j int) bool { return senders[i] < senders[j] })
+	return senders
+}
+
+///
+/// Configuration
+///
+
+// A KeyScheduleConfig holds the settings that govern how a key schedule runs,
+// as opposed to which keys it derives, so that independent groups in the
+// same process can be configured independently.  An epoch's config is shared
+// with its key sources and ratchets, and carried forward to each epoch
+// derived from it; it is not persisted.  A nil config, or a zero field, means
+// the default.  A config should not be modified once it is in use.
+type KeyScheduleConfig struct {
+	// Logger, if set, receives warnings about conditions that don't cause an
+	// operation to fail, but which probably indicate a bug in the caller.
+	Logger func(format string, args ...interface{})
+
+	// OnSecretAllocated and OnSecretZeroized, if set, are called each time an
+	// epoch allocates or zeroizes one of its named top-level secrets, e.g.,
+	// "epoch" or "init".  Only the name is passed, never the secret.  They
+	// are meant for auditing how long secrets stay in memory; for each name,
+	// an epoch that has been fully erased will have produced as many zeroize
+	// events as allocate events.
+	OnSecretAllocated func(kind string)
+	OnSecretZeroized  func(kind string)
+
+	// MaxGenerationSkip is the furthest a ratchet will advance past its next
+	// generation to serve a single request; see DefaultMaxGenerationSkip.
+	MaxGenerationSkip uint32
+
+	// MaxVectorSize is the largest length prefix accepted when decoding an
+	// epoch; see DefaultMaxKeyScheduleVectorSize.
+	MaxVectorSize int
+
+	// Now is the clock used for ratchet access times (see TrackAccess and
+	// EraseIdle), e.g., a fake clock in tests.  The default is time.Now.
+	Now func() time.Time
+}
+
+// DefaultMaxGenerationSkip is the default for MaxGenerationSkip.  Each skipped
+// generation is derived and cached, so this bounds the work and memory a
+// sender can cause a receiver to spend by claiming a large generation.
+const DefaultMaxGenerationSkip uint32 = 1 << 16
+
+// DefaultMaxKeyScheduleVectorSize is the default for MaxVectorSize, the
+// largest length prefix accepted for any vector or map when unmarshaling key
+// schedule state.  Persisted state may come from untrusted storage, so
+// oversized prefixes are rejected before anything is allocated for them.
+const DefaultMaxKeyScheduleVectorSize = 1 << 24
+
+func (c *KeyScheduleConfig) logf(format string, args ...interface{}) {
+	if c != nil && c.Logger != nil {
+		c.Logger(format, args...)
+	}
+}
+
+func (c *KeyScheduleConfig) secretAllocated(kind string) {
+	if c != nil && c.OnSecretAllocated != nil {
+		c.OnSecretAllocated(kind)
+	}
+}
+
+func (c *KeyScheduleConfig) secretZeroized(kind string) {
+	if c != nil && c.OnSecretZeroized != nil {
+		c.OnSecretZeroized(kind)
+	}
+}
+
+func (c *KeyScheduleConfig) maxGenerationSkip() uint32 {
+	if c == nil || c.MaxGenerationSkip == 0 {
+		return DefaultMaxGenerationSkip
+	}
+	return c.MaxGenerationSkip
+}
+
+func (c *KeyScheduleConfig) now() time.Time {
+	if c == nil || c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+func (c *KeyScheduleConfig) maxVectorSize() int {
+	if c == nil || c.MaxVectorSize == 0 {
+		return DefaultMaxKeyScheduleVectorSize
+	}
+	return c.MaxVectorSize
+}
+
+///
+/// Bounded deserialization
+///
+
+var bytes1Type = reflect.TypeOf(Bytes1{})
+
+// checkVectorBounds walks the TLS encoding of a value of type t at the start of
+// data, without decoding it, and returns the number of bytes it occupies.  It
+// fails if any length prefix exceeds max or runs past the end of the data.
+//
+// Types with custom TLS marshaling in this file keep the wire layout of their
+// struct definition, so the walk follows struct fields for them as well.
+func checkVectorBounds(data []byte, t reflect.Type, head int, optional bool, max int) (int, error) {
+	if t == bytes1Type {
+		return checkVectorBounds(data, reflect.TypeOf([]byte{}), 1, false, max)
+	}
+
+	switch t.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size := int(t.Size())
+		if len(data) < size {
+			return 0, fmt.Errorf("Truncated integer")
+		}
+		return size, nil
+
+	case reflect.Array:
+		read := 0
+		for i := 0; i < t.Len(); i += 1 {
+			n, err := checkVectorBounds(data[read:], t.Elem(), 0, false, max)
+			if err != nil {
+				return 0, err
+			}
+			read += n
+		}
+		return read, nil
+
+	case reflect.Slice, reflect.Map:
+		if head < 1 || head > 4 || len(data) < head {
+			return 0, fmt.Errorf("Invalid or truncated length prefix")
+		}
+
+		length := 0
+		for _, b := range data[:head] {
+			length = (length << 8) | int(b)
+		}
+
+		if length > max {
+			return 0, fmt.Errorf("Vector length %d exceeds maximum %d", length, max)
+		}
+		if length > len(data)-head {
+			return 0, fmt.Errorf("Vector length %d exceeds available data", length)
+		}
+
+		body := data[head : head+length]
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return head + length, nil
+		}
+
+		for read := 0; read < len(body); {
+			elemTypes := []reflect.Type{t.Elem()}
+			if t.Kind() == reflect.Map {
+				elemTypes = []reflect.Type{t.Key(), t.Elem()}
+			}
+
+			for _, et := range elemTypes {
+				n, err := checkVectorBounds(body[read:], et, 0, false, max)
+				if err != nil {
+					return 0, err
+				}
+				read += n
+			}
+		}
+		return head + length, nil
+
+	case reflect.Ptr:
+		if !optional {
+			return checkVectorBounds(data, t.Elem(), head, false, max)
+		}
+
+		if len(data) < 1 {
+			return 0, fmt.Errorf("Truncated optional value")
+		}
+		if data[0] == 0 {
+			return 1, nil
+		}
+
+		n, err := checkVectorBounds(data[1:], t.Elem(), 0, false, max)
+		return n + 1, err
+
+	case reflect.Struct:
+		read := 0
+		for i := 0; i < t.NumField(); i += 1 {
+			f := t.Field(i)
+			tag := f.Tag.Get("tls")
+			if tag == "omit" {
+				continue
+			}
+
+			fieldHead := 0
+			if strings.HasPrefix(tag, "head=") {
+				fieldHead, _ = strconv.Atoi(strings.TrimPrefix(tag, "head="))
+			}
+
+			n, err := checkVectorBounds(data[read:], f.Type, fieldHead, tag == "optional", max)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %v", f.Name, err)
+			}
+			read += n
+		}
+		return read, nil
+	}
+
+	return 0, fmt.Errorf("Unsupported type for bounds check: %v", t)
+}
+
+///
+/// Ratchets
+///
+
+// A Ratchet produces the sequence of keys used by one sender.  The hash
+// ratchet below is the default; others can be installed on a groupKeySource
+// with UseRatchets.
+type Ratchet interface {
+	Next() (uint32, keyAndNonce)
+	Get(generation uint32) (keyAndNonce, error)
+	Erase(generation uint32)
+}
+
+// A RatchetFactory builds the ratchet for a sender from its base secret
+type RatchetFactory func(suite CipherSuite, node NodeIndex, baseSecret []byte) Ratchet
+
+// A CacheStore holds the keys cached by a hash ratchet, e.g., in an HSM or a
+// secure enclave rather than on the Go heap.  Delete is responsible for wiping
+// the key it removes.
+type CacheStore interface {
+	Put(generation uint32, kn keyAndNonce)
+	Get(generation uint32) (keyAndNonce, bool)
+	Delete(generation uint32)
+}
+
+// An EventSink is told each time a hash ratchet advances, with the ratchet's
+// node and the generation just derived.  It never sees key material; a replica
+// holding the same base secrets can use the events to advance its own ratchets
+// in lockstep.
+type EventSink func(node NodeIndex, generation uint32)
+
+type hashRatchet struct {
+	Suite          CipherSuite
+	Node           NodeIndex
+	NextSecret     []byte `tls:"head=1"`
+	NextGeneration uint32
+	Cache          map[uint32]keyAndNonce `tls:"head=4"`
+	KeySize        uint32
+	NonceSize      uint32
+	SecretSize     uint32
+
+	// Labels for deriving each generation's key, nonce, and next secret
+	KeyLabel    []byte `tls:"head=1"`
+	NonceLabel  []byte `tls:"head=1"`
+	SecretLabel []byte `tls:"head=1"`
+
+	// Generations that were explicitly erased, so that a request for one of
+	// them can be told apart from a request for a key that was never cached.
+	// Every generation below ErasedBelow counts as erased; Erased holds the
+	// erased generations above it, in order.  In-order erasure just raises
+	// ErasedBelow, and at most maxErasedGenerations are held in Erased, so the
+	// record stays small however long the ratchet runs.
+	Erased      []uint32 `tls:"head=4"`
+	ErasedBelow uint32
+
+	// If DeriveNonce is false, no nonces are derived, and the Nonce of every
+	// keyAndNonce is empty.  This is for AEADs or transports that manage their
+	// own nonces; the caller is then responsible for supplying a nonce that is
+	// never reused with the same key.  The flag is encoded as a zero NonceSize.
+	DeriveNonce bool `tls:"omit"`
+
+	// If LazyNonce is set, the nonce for a generation is held back from the
+	// ratchet's cache until it is first requested with Get or Nonce.  The
+	// keyAndNonce returned by Next then has an empty Nonce, so a lazy ratchet
+	// is only suited to receiving.  The nonce is still derived in Next, since
+	// deriving it later would mean keeping the generation's chain secret, from
+	// which every later key could be derived; until it is requested, it is
+	// held in PendingNonces.  The flag is not persisted, but PendingNonces is,
+	// so a restored ratchet can still produce the nonces it owes.
+	LazyNonce     bool              `tls:"omit"`
+	PendingNonces map[uint32]Bytes1 `tls:"head=4"`
+
+	// If set, Events is notified on every call to Next.  It is not persisted.
+	Events EventSink `tls:"omit"`
+
+	// RewindTo is disabled unless AllowRewind is set, since it recreates keys
+	// that may already have been erased.  The setting is not persisted.
+	AllowRewind bool `tls:"omit"`
+
+	// Counters for Get, if enabled with EnableStats, and read with Stats.
+	// They are not persisted.
+	stats *RatchetStats `tls:"omit"`
+
+	// If Store is set, cached keys are kept there instead of in Cache, which
+	// then only records which generations are cached, with empty keys.  It
+	// must be set before any keys are cached.  A ratchet with a store can't be
+	// encoded, since its keys are not in hand.  Pending nonces (see LazyNonce)
+	// stay in PendingNonces.
+	Store CacheStore `tls:"omit"`
+
+	// When the ratchet was last used, if enabled with TrackAccess.  It is not
+	// persisted.
+	lastAccess *time.Time `tls:"omit"`
+
+	// The config of the key schedule the ratchet belongs to.  A ratchet
+	// decoded as part of an epoch gets the epoch's config when its key
+	// sources are enabled; cached generations discarded while decoding are
+	// held in discarded until then, so that the warning goes to its logger.
+	config    *KeyScheduleConfig `tls:"omit"`
+	discarded []uint32           `tls:"omit"`
+}
+
+// TrackAccess starts recording when the ratchet is used by Next or Get.
+// Like stats, this is off by default, so that ratchets in the same state
+// compare equal however long ago they were used.
+func (hr *hashRatchet) TrackAccess() {
+	if hr.lastAccess == nil {
+		now := hr.config.now()
+		hr.lastAccess = &now
+	}
+}
+
+// LastAccess returns when the ratchet was last used, and false if access
+// times are not being tracked
+func (hr *hashRatchet) LastAccess() (time.Time, bool) {
+	if hr.lastAccess == nil {
+		return time.Time{}, false
+	}
+
+	return *hr.lastAccess, true
+}
+
+func (hr *hashRatchet) touch() {
+	if hr.lastAccess != nil {
+		*hr.lastAccess = hr.config.now()
+	}
+}
+
+// Access to cached keys, wherever they are held
+func (hr *hashRatchet) cacheGet(generation uint32) (keyAndNonce, bool) {
+	if _, ok := hr.Cache[generation]; !ok {
+		return keyAndNonce{}, false
+	}
+
+	if hr.Store != nil {
+		return hr.Store.Get(generation)
+	}
+
+	return hr.Cache[generation], true
+}
+
+func (hr *hashRatchet) cachePut(generation uint32, kn keyAndNonce) {
+	if hr.Store != nil {
+		hr.Store.Put(generation, kn)
+		hr.Cache[generation] = keyAndNonce{}
+		return
+	}
+
+	hr.Cache[generation] = kn
+}
+
+func (hr *hashRatchet) cacheDelete(generation uint32) {
+	if _, ok := hr.Cache[generation]; !ok {
+		return
+	}
+
+	if hr.Store != nil {
+		hr.Store.Delete(generation)
+	} else {
+		zeroize(hr.Cache[generation].Key)
+		zeroize(hr.Cache[generation].Nonce)
+	}
+	delete(hr.Cache, generation)
+}
+
+// RatchetStats counts how requests for keys were served, to help with tuning
+// how far ahead and how long keys are cached.  A hit is a request answered
+// from the cache, and a miss is any other request, whether or not it
+// succeeded.  A fast-forward is a miss that advanced the ratchet over one or
+// more intermediate generations to reach the one requested.
+type RatchetStats struct {
+	CacheHits    uint64
+	CacheMisses  uint64
+	FastForwards uint64
+}
+
+func (rs *RatchetStats) add(other RatchetStats) {
+	rs.CacheHits += other.CacheHits
+	rs.CacheMisses += other.CacheMisses
+	rs.FastForwards += other.FastForwards
+}
+
+var (
+	// ErrExpiredKey is returned for a generation the ratchet has moved past
+	// and no longer holds a key for
+	ErrExpiredKey = fmt.Errorf("Request for expired key")
+
+	// ErrKeyErased is returned for a generation whose key was deleted with
+	// Erase, e.g., after a message was decrypted with it
+	ErrKeyErased = fmt.Errorf("Request for erased key")
+
+	// ErrKeyTooFar is returned for a generation more than the config's
+	// MaxGenerationSkip ahead of the ratchet
+	ErrKeyTooFar = fmt.Errorf("Request for key too far in the future")
+
+	// ErrKeyNotInStore is returned for a generation the ratchet has cached in
+	// its CacheStore, if the store no longer holds the key
+	ErrKeyNotInStore = fmt.Errorf("Cached key missing from store")
+
+	// ErrEpochErased is returned for a key requested from an epoch after
+	// EraseExceptInit, whose secrets are all zero
+	ErrEpochErased = fmt.Errorf("Request for key from erased epoch")
+)
+
+func newHashRatchet(suite CipherSuite, node NodeIndex, baseSecret []byte) *hashRatchet {
+	return newHashRatchetWithLabels(suite, node, baseSecret, "app")
+}
+
+// newHashRatchetWithLabels creates a hash ratchet whose derivations use the
+// labels "<prefix>-key", "<prefix>-nonce", and "<prefix>-secret", e.g., "hs"
+// for a handshake ratchet.  The default prefix is "app".
+func newHashRatchetWithLabels(suite CipherSuite, node NodeIndex, baseSecret []byte, prefix string) *hashRatchet {
+	return &hashRatchet{
+		Suite:          suite,
+		Node:           node,
+		NextSecret:     baseSecret,
+		NextGeneration: 0,
+		Cache:          map[uint32]keyAndNonce{},
+		KeySize:        uint32(suite.Constants().KeySize),
+		NonceSize:      uint32(suite.Constants().NonceSize),
+		SecretSize:     uint32(suite.Constants().SecretSize),
+		KeyLabel:       []byte(prefix + "-key"),
+		NonceLabel:     []byte(prefix + "-nonce"),
+		SecretLabel:    []byte(prefix + "-secret"),
+		Erased:         []uint32{},
+		DeriveNonce:    true,
+		PendingNonces:  map[uint32]Bytes1{},
+	}
+}
+
+// The key, nonce, and next secret of a generation are all expanded from the
+// same secret, and are kept apart by their labels.  If two labels were equal,
+// e.g., in a mis-defined or corrupted ratchet, only the output lengths would
+// separate them, and those coincide for some suites: with a 32-byte key and a
+// 32-byte secret, each key would be the ratchet's next secret.  All three
+// labels are therefore required to be distinct.
+func (hr hashRatchet) checkLabels() error {
+	labels := [][]byte{hr.KeyLabel, hr.NonceLabel, hr.SecretLabel}
+	for i, label := range labels {
+		for _, other := range labels[i+1:] {
+			if bytes.Equal(label, other) {
+				return fmt.Errorf("Ratchet labels are not distinct: %q", label)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hashRatchetData has the same layout as hashRatchet, without its custom TLS
+// methods
+type hashRatchetData hashRatchet
+
+// MarshalTLS encodes the cache in order of generation, so that the same
+// ratchet always has the same encoding
+func (hr hashRatchet) MarshalTLS() ([]byte, error) {
+	if hr.Store != nil {
+		return nil, fmt.Errorf("Cannot encode a ratchet whose keys are in an external store")
+	}
+
+	if !hr.DeriveNonce {
+		hr.NonceSize = 0
+	}
+
+	var buf bytes.Buffer
+	if err := streamStruct(&buf, reflect.ValueOf(hashRatchetData(hr))); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalTLS decodes a ratchet and discards any cached generation that the
+// ratchet could not have produced yet, i.e., any at or beyond NextGeneration.
+// Such entries can only come from corrupted or tampered state.
+func (hr *hashRatchet) UnmarshalTLS(data []byte) (int, error) {
+	read, err := syntax.Unmarshal(data, (*hashRatchetData)(hr))
+	if err != nil {
+		return 0, err
+	}
+
+	hr.DeriveNonce = hr.NonceSize != 0
+	if err := hr.checkLabels(); err != nil {
+		return 0, err
+	}
+
+	for _, generation := range sortedGenerations(hr.Cache) {
+		if generation >= hr.NextGeneration {
+			hr.discarded = append(hr.discarded, generation)
+			zeroize(hr.Cache[generation].Key)
+			zeroize(hr.Cache[generation].Nonce)
+			delete(hr.Cache, generation)
+		}
+	}
+	if hr.config != nil {
+		hr.setConfig(hr.config)
+	}
+
+	hr.compactErased()
+
+	for generation, nonce := range hr.PendingNonces {
+		if _, ok := hr.Cache[generation]; !ok {
+			zeroize(nonce)
+			delete(hr.PendingNonces, generation)
+			continue
+		}
+
+		if len(nonce) != int(hr.NonceSize) {
+			return 0, fmt.Errorf("Pending nonce for generation %d has size %d != %d", generation, len(nonce), hr.NonceSize)
+		}
+	}
+
+	return read, nil
+}
+
+// Attach the ratchet to a key schedule config, reporting any cached
+// generations that were discarded when it was decoded
+func (hr *hashRatchet) setConfig(config *KeyScheduleConfig) {
+	hr.config = config
+	for _, generation := range hr.discarded {
+		config.logf("mls.ks: discarding invalid cached generation %d >= %d for node %d", generation, hr.NextGeneration, hr.Node)
+	}
+	hr.discarded = nil
+}
+
+// MarshalEncrypted encodes the ratchet and seals the encoding under the given
+// AEAD, e.g., one keyed with a process key, so that the cached keys and the
+// next secret are protected when the ratchet is persisted.  The output is a
+// random nonce followed by the ciphertext.
+func (hr hashRatchet) MarshalEncrypted(aead cipher.AEAD) ([]byte, error) {
+	data, err := syntax.Marshal(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(data)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// UnmarshalEncrypted opens the output of MarshalEncrypted and decodes the
+// ratchet from it.  Ciphertext that has been modified, or that was sealed
+// under a different key, is rejected.
+func (hr *hashRatchet) UnmarshalEncrypted(aead cipher.AEAD, data []byte) error {
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return fmt.Errorf("Encrypted ratchet too short")
+	}
+
+	pt, err := aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt ratchet: %v", err)
+	}
+
+	read, err := syntax.Unmarshal(pt, hr)
+	if err != nil {
+		return err
+	}
+
+	if read != len(pt) {
+		return fmt.Errorf("Extra data after encrypted ratchet")
+	}
+
+	return nil
+}
+
+func (hr *hashRatchet) Next() (uint32, keyAndNonce) {
+	key := hr.Suite.deriveAppSecret(hr.NextSecret, string(hr.KeyLabel), hr.Node, hr.NextGeneration, int(hr.KeySize))
+	nonce := []byte{}
+	if hr.DeriveNonce {
+		nonce = hr.Suite.deriveAppSecret(hr.NextSecret, string(hr.NonceLabel), hr.Node, hr.NextGeneration, int(hr.NonceSize))
+	}
+	secret := hr.Suite.deriveAppSecret(hr.NextSecret, string(hr.SecretLabel), hr.Node, hr.NextGeneration, int(hr.SecretSize))
+
+	generation := hr.NextGeneration
+
+	hr.NextGeneration += 1
+	if hr.DeriveNonce && hr.LazyNonce {
+		hr.PendingNonces[generation] = nonce
+		nonce = []byte{}
+	}
+	zeroize(hr.NextSecret)
+	hr.NextSecret = secret
+
+	kn := keyAndNonce{key, nonce}
+	hr.cachePut(generation, kn)
+	hr.touch()
+	if hr.Events != nil {
+		hr.Events(hr.Node, generation)
+	}
+	return generation, kn.clone()
+}
+
+// TryNext is like Next, but first checks that the ratchet can advance: that it
+// has not run out of generations, and that its next secret has not been
+// erased.  If either check fails, the ratchet is left unchanged.
+func (hr *hashRatchet) TryNext() (uint32, keyAndNonce, error) {
+	if hr.NextGeneration == math.MaxUint32 {
+		return 0, keyAndNonce{}, fmt.Errorf("Ratchet generation overflow")
+	}
+
+	if isZero(hr.NextSecret) {
+		return 0, keyAndNonce{}, fmt.Errorf("Ratchet secret has been erased")
+	}
+
+	generation, kn := hr.Next()
+	return generation, kn, nil
+}
+
+// Whether Get would return a key for the generation, without deriving anything
+func (hr *hashRatchet) canGet(generation uint32) bool {
+	if _, ok := hr.Cache[generation]; ok {
+		return true
+	}
+
+	return generation >= hr.NextGeneration && generation-hr.NextGeneration <= hr.config.maxGenerationSkip()
+}
+
+// CostToGet returns how many generations Get would have to derive to return
+// the key for a generation, without deriving anything: zero if the key is
+// cached, and otherwise one for each generation up to and including the one
+// requested.  It returns the error Get would return if the key is unavailable.
+func (hr *hashRatchet) CostToGet(generation uint32) (int, error) {
+	if _, ok := hr.Cache[generation]; ok {
+		return 0, nil
+	}
+
+	if hr.NextGeneration > generation {
+		if hr.isErased(generation) {
+			return 0, ErrKeyErased
+		}
+		return 0, ErrExpiredKey
+	}
+
+	if generation-hr.NextGeneration > hr.config.maxGenerationSkip() {
+		return 0, ErrKeyTooFar
+	}
+
+	return int(generation-hr.NextGeneration) + 1, nil
+}
+
+// Advance the ratchet to the given generation without deriving or caching any
+// keys for the generations skipped
+func (hr *hashRatchet) skipTo(generation uint32) {
+	for hr.NextGeneration < generation {
+		secret := hr.Suite.deriveAppSecret(hr.NextSecret, string(hr.SecretLabel), hr.Node, hr.NextGeneration, int(hr.SecretSize))
+		zeroize(hr.NextSecret)
+		hr.NextSecret = secret
+		hr.NextGeneration += 1
+	}
+}
+
+// Derive the key and nonce for a generation at or beyond NextGeneration,
+// without advancing the ratchet or caching anything
+func (hr *hashRatchet) peek(generation uint32) keyAndNonce {
+	secret := dup(hr.NextSecret)
+	for gen := hr.NextGeneration; gen < generation; gen += 1 {
+		next := hr.Suite.deriveAppSecret(secret, string(hr.SecretLabel), hr.Node, gen, int(hr.SecretSize))
+		zeroize(secret)
+		secret = next
+	}
+
+	key := hr.Suite.deriveAppSecret(secret, string(hr.KeyLabel), hr.Node, generation, int(hr.KeySize))
+	nonce := []byte{}
+	if hr.DeriveNonce {
+		nonce = hr.Suite.deriveAppSecret(secret, string(hr.NonceLabel), hr.Node, generation, int(hr.NonceSize))
+	}
+
+	zeroize(secret)
+	return keyAndNonce{key, nonce}
+}
+
+// Nonce returns the nonce for a generation, deriving it first if the ratchet
+// is lazy and the nonce has not been needed yet
+func (hr *hashRatchet) Nonce(generation uint32) ([]byte, error) {
+	kn, err := hr.Get(generation)
+	if err != nil {
+		return nil, err
+	}
+
+	return kn.Nonce, nil
+}
+
+// Read a generation's cache entry, moving its pending nonce, if any, into it
+func (hr *hashRatchet) fillPendingNonce(generation uint32) (keyAndNonce, error) {
+	kn, ok := hr.cacheGet(generation)
+	if !ok {
+		return keyAndNonce{}, ErrKeyNotInStore
+	}
+
+	nonce, ok := hr.PendingNonces[generation]
+	if !ok {
+		return kn, nil
+	}
+
+	kn.Nonce = nonce
+	hr.cachePut(generation, kn)
+	delete(hr.PendingNonces, generation)
+	return kn, nil
+}
+
+// EnableStats starts counting how the ratchet's Get requests are served.
+// Counting is off by default, so that ratchets in the same state compare equal
+// however they were used.
+func (hr *hashRatchet) EnableStats() {
+	if hr.stats == nil {
+		hr.stats = &RatchetStats{}
+	}
+}
+
+// Stats returns the ratchet's counters, which are all zero unless EnableStats
+// has been called.  It is safe to call while another goroutine is using the
+// ratchet.
+func (hr *hashRatchet) Stats() RatchetStats {
+	if hr.stats == nil {
+		return RatchetStats{}
+	}
+
+	return RatchetStats{
+		CacheHits:    atomic.LoadUint64(&hr.stats.CacheHits),
+		CacheMisses:  atomic.LoadUint64(&hr.stats.CacheMisses),
+		FastForwards: atomic.LoadUint64(&hr.stats.FastForwards),
+	}
+}
+
+func (hr *hashRatchet) Get(generation uint32) (keyAndNonce, error) {
+	if _, ok := hr.Cache[generation]; ok {
+		hr.touch()
+		if hr.stats != nil {
+			atomic.AddUint64(&hr.stats.CacheHits, 1)
+		}
+		return hr.fillPendingNonce(generation)
+	}
+
+	if hr.stats != nil {
+		atomic.AddUint64(&hr.stats.CacheMisses, 1)
+	}
+
+	if hr.NextGeneration > generation {
+		if hr.isErased(generation) {
+			return keyAndNonce{}, ErrKeyErased
+		}
+		return keyAndNonce{}, ErrExpiredKey
+	}
+
+	if generation-hr.NextGeneration > hr.config.maxGenerationSkip() {
+		return keyAndNonce{}, ErrKeyTooFar
+	}
+
+	if hr.NextGeneration < generation && hr.stats != nil {
+		atomic.AddUint64(&hr.stats.FastForwards, 1)
+	}
+
+	for hr.NextGeneration < generation {
+		hr.Next()
+	}
+
+	hr.Next()
+	kn, err := hr.fillPendingNonce(generation)
+	if err != nil {
+		return keyAndNonce{}, err
+	}
+
+	return kn.clone(), nil
+}
+
+// RewindTo resets the ratchet to an earlier generation, re-deriving its next
+// secret from the ratchet's base secret, e.g., to replay a sequence of keys in
+// a test harness.  Cached keys for that generation and later are discarded,
+// and become available again.  This undoes the forward secrecy of those keys,
+// so it fails unless AllowRewind is set, and every rewind is logged.
+func (hr *hashRatchet) RewindTo(generation uint32, baseSecret []byte) error {
+	if !hr.AllowRewind {
+		return fmt.Errorf("Ratchet rewind is not enabled")
+	}
+
+	if generation > hr.NextGeneration {
+		return fmt.Errorf("Cannot rewind forward from %d to %d", hr.NextGeneration, generation)
+	}
+
+	if len(baseSecret) != int(hr.SecretSize) {
+		return fmt.Errorf("Incorrect base secret length %d != %d", len(baseSecret), hr.SecretSize)
+	}
+
+	hr.config.logf("mls.ks: rewinding ratchet for node %d from generation %d to %d", hr.Node, hr.NextGeneration, generation)
+
+	secret := dup(baseSecret)
+	for gen := uint32(0); gen < generation; gen += 1 {
+		next := hr.Suite.deriveAppSecret(secret, string(hr.SecretLabel), hr.Node, gen, int(hr.SecretSize))
+		zeroize(secret)
+		secret = next
+	}
+
+	zeroize(hr.NextSecret)
+	hr.NextSecret = secret
+	hr.NextGeneration = generation
+
+	for gen := range hr.Cache {
+		if gen >= generation {
+			hr.cacheDelete(gen)
+		}
+	}
+
+	for gen, nonce := range hr.PendingNonces {
+		if gen >= generation {
+			zeroize(nonce)
+			delete(hr.PendingNonces, gen)
+		}
+	}
+
+	erased := []uint32{}
+	for _, gen := range hr.Erased {
+		if gen < generation {
+			erased = append(erased, gen)
+		}
+	}
+	hr.Erased = erased
+	if hr.ErasedBelow > generation {
+		hr.ErasedBelow = generation
+	}
+
+	return nil
+}
+
+// Zeroize all of the ratchet's secret state
+func (hr *hashRatchet) eraseAll() {
+	zeroize(hr.NextSecret)
+	for gen := range hr.Cache {
+		hr.Erase(gen)
+	}
+}
+
+func (hr *hashRatchet) dump(w io.Writer) {
+	fmt.Fprintf(w, "  node=%x next=%d\n", hr.Node, hr.NextGeneration)
+	for _, gen := range sortedGenerations(hr.Cache) {
+		kn, _ := hr.cacheGet(gen)
+		fmt.Fprintf(w, "    %3d key=[%x] nonce=[%x]\n", gen, kn.Key, kn.Nonce)
+	}
+}
+
+// Zeroize and drop a cached key to save memory.  Unlike Erase, this does not
+// record the generation as erased, since the application did not ask for it.
+func (hr *hashRatchet) evict(generation uint32) {
+	if _, ok := hr.Cache[generation]; !ok {
+		return
+	}
+
+	hr.cacheDelete(generation)
+	if nonce, ok := hr.PendingNonces[generation]; ok {
+		zeroize(nonce)
+		delete(hr.PendingNonces, generation)
+	}
+}
+
+func (hr *hashRatchet) Erase(generation uint32) {
+	if _, ok := hr.Cache[generation]; !ok {
+		return
+	}
+
+	hr.cacheDelete(generation)
+	if nonce, ok := hr.PendingNonces[generation]; ok {
+		zeroize(nonce)
+		delete(hr.PendingNonces, generation)
+	}
+	hr.Erased = append(hr.Erased, generation)
+	hr.compactErased()
+}
+
+// The most erased generations held individually, above ErasedBelow.  Past
+// this, ErasedBelow is raised over the oldest of them, so that any expired
+// generations in between are reported as erased instead.
+const maxErasedGenerations = 256
+
+func (hr *hashRatchet) isErased(generation uint32) bool {
+	if generation < hr.ErasedBelow {
+		return true
+	}
+
+	i := sort.Search(len(hr.Erased), func(i int) bool { return hr.Erased[i] >= generation })
+	return i < len(hr.Erased) && hr.Erased[i] == generation
+}
+
+// Sort the erased generations, and fold any that continue on from ErasedBelow
+// into it
+func (hr *hashRatchet) compactErased() {
+	sort.Slice(hr.Erased, func(i, j int) bool { return hr.Erased[i] < hr.Erased[j] })
+
+	start := 0
+	for start < len(hr.Erased) {
+		gen := hr.Erased[start]
+		switch {
+		case gen < hr.ErasedBelow:
+		case gen == hr.ErasedBelow || len(hr.Erased)-start > maxErasedGenerations:
+			hr.ErasedBelow = gen + 1
+		default:
+			hr.Erased = append(hr.Erased[:0], hr.Erased[start:]...)
+			return
+		}
+		start += 1
+	}
+	hr.Erased = hr.Erased[:0]
+}
+
+///
+/// Base key sources
+///
+
+type baseKeySource interface {
+	Suite() CipherSuite
+	Get(sender LeafIndex) ([]byte, error)
+}
+
+type noFSBaseKeySource struct {
+	CipherSuite CipherSuite
+	RootSecret  []byte `tls:"head=1"`
+}
+
+func newNoFSBaseKeySource(suite CipherSuite, rootSecret []byte) *noFSBaseKeySource {
+	return &noFSBaseKeySource{suite, rootSecret}
+}
+
+func (nfbks *noFSBaseKeySource) Suite() CipherSuite {
+	return nfbks.CipherSuite
+}
+
+func (nfbks *noFSBaseKeySource) Get(sender LeafIndex) ([]byte, error) {
+	if LeafCount(sender) >= maxLeafCount {
+		return nil, fmt.Errorf("Leaf %d out of range", sender)
+	}
+
+	secretSize := nfbks.CipherSuite.Constants().SecretSize
+	return nfbks.CipherSuite.deriveAppSecret(nfbks.RootSecret, "hs-secret", toNodeIndex(sender), 0, secretSize), nil
+}
+
+// Reseed zeroizes the current root secret and replaces it with a new one, so
+// that base keys derived from here on are independent of those issued before.
+// The old root is erased in place; in an epoch, it is the same buffer as the
+// handshake secret.  Ratchets already built from the old base keys are not
+// affected, and should be discarded by the caller.
+func (nfbks *noFSBaseKeySource) Reseed(newRoot []byte) {
+	zeroize(nfbks.RootSecret)
+	nfbks.RootSecret = newRoot
+}
+
+func (nfbks *noFSBaseKeySource) eraseAll() {
+	zeroize(nfbks.RootSecret)
+}
+
+// A copy of the source with its own root secret buffer, so that erasing or
+// reseeding one does not affect the other
+func (nfbks *noFSBaseKeySource) clone() *noFSBaseKeySource {
+	return newNoFSBaseKeySource(nfbks.CipherSuite, dup(nfbks.RootSecret))
+}
+
+// Equal reports whether two sources have the same suite and root secret, and
+// so derive the same base keys.  The roots are compared in constant time.
+func (nfbks *noFSBaseKeySource) Equal(other *noFSBaseKeySource) bool {
+	if nfbks == nil || other == nil {
+		return nfbks == other
+	}
+
+	return nfbks.CipherSuite == other.CipherSuite &&
+		subtle.ConstantTimeCompare(nfbks.RootSecret, other.RootSecret) == 1
+}
+
+type Bytes1 []byte
+
+func (b Bytes1) MarshalTLS() ([]byte, error) {
+	return syntax.Marshal(struct {
+		Data []byte `tls:"head=1"`
+	}{b})
+}
+
+func (b *Bytes1) UnmarshalTLS(data []byte) (int, error) {
+	tmp := struct {
+		Data []byte `tls:"head=1"`
+	}{}
+	read, err := syntax.Unmarshal(data, &tmp)
+	if err != nil {
+		return read, err
+	}
+
+	*b = dup(tmp.Data)
+	return read, nil
+}
+
+type treeBaseKeySource struct {
+	CipherSuite CipherSuite
+	SecretSize  uint32
+	Root        NodeIndex
+	Size        LeafCount
+	Secrets     map[NodeIndex]Bytes1 `tls:"head=4"`
+
+	// By default, Get consumes the secrets it derives from, so that a leaf's
+	// base secret can only be derived once.  With KeepSecrets set, all derived
+	// secrets are retained, so that a member who leaves and rejoins at the same
+	// leaf can derive its base secret again.  This gives up forward secrecy
+	// within the epoch, and should only be used in controlled deployments.  The
+	// setting is not persisted.
+	KeepSecrets bool `tls:"omit"`
+
+	// ExportLeaf is disabled unless AllowLeafExport is set.  Like KeepSecrets,
+	// the setting is not persisted, so it has to be turned on again each time
+	// the key source is loaded.
+	AllowLeafExport bool `tls:"omit"`
+
+	// Leaves marked with MarkBlank, e.g., those of removed members.  This is
+	// not persisted, but a leaf's base secret is consumed when it is marked,
+	// so unless KeepSecrets is set, no key can be derived for it after the
+	// source is loaded either; only the distinct error is lost.
+	Blank map[LeafIndex]bool `tls:"omit"`
+
+	// The config of the key schedule the source belongs to
+	config *KeyScheduleConfig `tls:"omit"`
+}
+
+// ErrBlankLeaf is returned for a leaf that has been marked blank, which has
+// no member and so no base key
+var ErrBlankLeaf = fmt.Errorf("No base key for blank leaf")
+
+// MarkBlank records that a leaf is blank, and consumes its base secret if it
+// is still available, so that no keys can be derived for it from then on.
+// Other leaves are unaffected.
+func (tbks *treeBaseKeySource) MarkBlank(leaf LeafIndex) error {
+	if LeafCount(leaf) >= tbks.Size {
+		return fmt.Errorf("Leaf %d out of range for tree size %d", leaf, tbks.Size)
+	}
+
+	if tbks.Blank[leaf] {
+		return nil
+	}
+
+	if _, _, found := tbks.findSource(leaf); found {
+		secret, err := tbks.Get(leaf)
+		if err != nil {
+			return err
+		}
+		zeroize(secret)
+
+		if node := toNodeIndex(leaf); tbks.KeepSecrets {
+			zeroize(tbks.Secrets[node])
+			delete(tbks.Secrets, node)
+		}
+	}
+
+	if tbks.Blank == nil {
+		tbks.Blank = map[LeafIndex]bool{}
+	}
+	tbks.Blank[leaf] = true
+	return nil
+}
+
+// newTreeBaseKeySource creates a secret tree with the given number of leaves,
+// rooted at rootSecret.  The size must be between 1 and maxLeafCount: an empty
+// tree has no root, and beyond maxLeafCount, node indices would no longer fit
+// in a NodeIndex.
+func newTreeBaseKeySource(suite CipherSuite, size LeafCount, rootSecret []byte) (*treeBaseKeySource, error) {
+	if size == 0 {
+		return nil, fmt.Errorf("Empty tree")
+	}
+
+	if size > maxLeafCount {
+		return nil, fmt.Errorf("Unsupported tree size %d", size)
+	}
+
+	tbks := &treeBaseKeySource{
+		CipherSuite: suite,
+		SecretSize:  uint32(suite.Constants().SecretSize),
+		Root:        root(size),
+		Size:        size,
+		Secrets:     map[NodeIndex]Bytes1{},
+	}
+
+	tbks.Secrets[tbks.Root] = rootSecret
+	return tbks, nil
+}
+
+// treeBaseKeySourceData has the same layout as treeBaseKeySource, without its
+// custom TLS methods
+type treeBaseKeySourceData treeBaseKeySource
+
+// UnmarshalTLS decodes a key source and rejects it if it fails Validate
+func (tbks *treeBaseKeySource) UnmarshalTLS(data []byte) (int, error) {
+	read, err := syntax.Unmarshal(data, (*treeBaseKeySourceData)(tbks))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tbks.Validate(); err != nil {
+		return 0, err
+	}
+
+	return read, nil
+}
+
+// Validate checks that the tree's root and populated nodes are consistent with
+// its size, so that corrupted state can't lead to deriving along a bogus path.
+func (tbks *treeBaseKeySource) Validate() error {
+	if tbks.Size == 0 {
+		return fmt.Errorf("Empty tree")
+	}
+
+	if tbks.Size > maxLeafCount {
+		return fmt.Errorf("Unsupported tree size %d", tbks.Size)
+	}
+
+	if tbks.Root != root(tbks.Size) {
+		return fmt.Errorf("Root %d does not match tree size %d", tbks.Root, tbks.Size)
+	}
+
+	width := NodeIndex(nodeWidth(tbks.Size))
+	for _, node := range sortedNodes(tbks.Secrets) {
+		if node >= width {
+			return fmt.Errorf("Node %d out of range for tree size %d", node, tbks.Size)
+		}
+	}
+
+	return nil
+}
+
+// ConsistentWith checks that the secret tree has the layout of a ratchet tree
+// with the given number of leaves, so that a sender's leaf and direct path
+// name the same nodes in both.  Beyond the checks made by Validate, the sizes
+// must match, and every leaf's direct path must stay within the tree and end
+// at its root.
+func (tbks *treeBaseKeySource) ConsistentWith(size LeafCount) error {
+	if tbks.Size != size {
+		return fmt.Errorf("Secret tree size %d does not match tree size %d", tbks.Size, size)
+	}
+
+	if err := tbks.Validate(); err != nil {
+		return err
+	}
+
+	width := NodeIndex(nodeWidth(size))
+	for leaf := LeafIndex(0); LeafCount(leaf) < size; leaf += 1 {
+		d := dirpath(toNodeIndex(leaf), size)
+		for _, node := range d {
+			if node >= width {
+				return fmt.Errorf("Direct path of leaf %d leaves the tree at node %d", leaf, node)
+			}
+		}
+
+		if len(d) > 0 && d[len(d)-1] != tbks.Root {
+			return fmt.Errorf("Direct path of leaf %d does not end at root %d", leaf, tbks.Root)
+		}
+	}
+
+	return nil
+}
+
+// newTreeBaseKeySourceFromGroupInfo sets up a joiner's view of the secret tree
+// from the root secret shared in a GroupInfo, along with ratchets for the
+// given senders, each advanced to the generation that sender will use next.
+// The returned ratchets are meant to serve as the ratchet map of the
+// corresponding group key source.
+func newTreeBaseKeySourceFromGroupInfo(suite CipherSuite, size LeafCount, rootSecret []byte, startGenerations map[LeafIndex]uint32) (*treeBaseKeySource, map[LeafIndex]*hashRatchet, error) {
+	tbks, err := newTreeBaseKeySource(suite, size, rootSecret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	senders := make([]LeafIndex, 0, len(startGenerations))
+	for sender := range startGenerations {
+		senders = append(senders, sender)
+	}
+	sort.Slice(senders, func(i, j int) bool { return senders[i] < senders[j] })
+
+	ratchets := map[LeafIndex]*hashRatchet{}
+	for _, sender := range senders {
+		if sender >= LeafIndex(size) {
+			return nil, nil, fmt.Errorf("Sender %d out of range for tree size %d", sender, size)
+		}
+
+		baseSecret, err := tbks.Get(sender)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		hr := newHashRatchet(suite, toNodeIndex(sender), baseSecret)
+		hr.skipTo(startGenerations[sender])
+		ratchets[sender] = hr
+	}
+
+	return tbks, ratchets, nil
+}
+
+func (tbks *treeBaseKeySource) Suite() CipherSuite {
+	return tbks.CipherSuite
+}
+
+// Find the lowest populated node on the path from the sender's leaf to the
+// root.  Returns the path and the position of that node in it.
+func (tbks *treeBaseKeySource) findSource(sender LeafIndex) ([]NodeIndex, int, bool) {
+	if LeafCount(sender) >= tbks.Size {
+		return nil, 0, false
+	}
+
+	senderNode := toNodeIndex(sender)
+	d := dirpath(senderNode, tbks.Size)
+	d = append([]NodeIndex{senderNode}, d...)
+	for i, node := range d {
+		if _, ok := tbks.Secrets[node]; ok {
+			return d, i, true
+		}
+	}
+
+	return d, 0, false
+}
+
+func (tbks *treeBaseKeySource) Get(sender LeafIndex) ([]byte, error) {
+	if tbks.Blank[sender] {
+		return nil, ErrBlankLeaf
+	}
+
+	if LeafCount(sender) >= tbks.Size {
+		return nil, fmt.Errorf("Leaf %d out of range for tree size %d", sender, tbks.Size)
+	}
+
+	// Find an ancestor that is populated
+	senderNode := toNodeIndex(sender)
+	d, curr, found := tbks.findSource(sender)
+	if !found {
+		// The direct path should always reach the root; if it doesn't, the
+		// tree math is broken, rather than the key having been consumed
+		if !DirpathIncludesRoot(sender, tbks.Size) {
+			return nil, fmt.Errorf("Direct path of leaf %d does not reach the root for tree size %d", sender, tbks.Size)
+		}
+		return nil, fmt.Errorf("Unable to find source for base key")
+	}
+
+	// Derive down
+	for ; curr > 0; curr -= 1 {
+		node := d[curr]
+		L := left(node)
+		R := right(node, tbks.Size)
+
+		secret := tbks.Secrets[node]
+		tbks.Secrets[L] = tbks.CipherSuite.deriveAppSecret(secret, "tree", L, 0, int(tbks.SecretSize))
+		tbks.Secrets[R] = tbks.CipherSuite.deriveAppSecret(secret, "tree", R, 0, int(tbks.SecretSize))
+		if !tbks.KeepSecrets {
+			zeroize(tbks.Secrets[node])
+			delete(tbks.Secrets, node)
+		}
+	}
+
+	// Copy and return the leaf
+	out := dup(tbks.Secrets[senderNode])
+	if !tbks.KeepSecrets {
+		zeroize(tbks.Secrets[senderNode])
+		delete(tbks.Secrets, senderNode)
+	}
+	return out, nil
+}
+
+// ExportLeaf returns the base secret for a leaf without consuming any of the
+// stored secrets, for deployments that escrow members' application secrets.
+// It fails unless AllowLeafExport is set, and every export is logged.
+func (tbks *treeBaseKeySource) ExportLeaf(sender LeafIndex) ([]byte, error) {
+	if !tbks.AllowLeafExport {
+		return nil, fmt.Errorf("Leaf export is not enabled")
+	}
+
+	out, err := tbks.peekLeaf(sender)
+	if err != nil {
+		return nil, err
+	}
+
+	tbks.config.logf("mls.ks: exported base secret for leaf %d", sender)
+	return out, nil
+}
+
+// Derive the base secret for a leaf down the leaf's path only, leaving the
+// stored secrets untouched
+func (tbks *treeBaseKeySource) peekLeaf(sender LeafIndex) ([]byte, error) {
+	if tbks.Blank[sender] {
+		return nil, ErrBlankLeaf
+	}
+
+	d, curr, found := tbks.findSource(sender)
+	if !found {
+		return nil, fmt.Errorf("Unable to find source for base key")
+	}
+
+	out := dup(tbks.Secrets[d[curr]])
+	for ; curr > 0; curr -= 1 {
+		next := tbks.CipherSuite.deriveAppSecret(out, "tree", d[curr-1], 0, int(tbks.SecretSize))
+		zeroize(out)
+		out = next
+	}
+
+	return out, nil
+}
+
+// LeafCommitments returns a hash of the base secret of each leaf whose base
+// secret is still available, for auditing that members hold consistent secret
+// trees without learning any keys.  Leaves whose base secrets have already
+// been consumed are omitted.  No stored secrets are consumed.
+func (tbks *treeBaseKeySource) LeafCommitments(suite CipherSuite) map[LeafIndex][]byte {
+	commitments := map[LeafIndex][]byte{}
+	for leaf := LeafIndex(0); LeafCount(leaf) < tbks.Size; leaf += 1 {
+		secret, err := tbks.peekLeaf(leaf)
+		if err != nil {
+			continue
+		}
+
+		commitments[leaf] = suite.Digest(secret)
+		zeroize(secret)
+	}
+	return commitments
+}
+
+// Fingerprint summarizes which nodes of the tree are populated, and with what,
+// without revealing any secrets.  It is a hash over the populated nodes in
+// order, each represented by its index and a hash of its secret.  Two members
+// whose key sources are in the same state will compute the same fingerprint.
+func (tbks *treeBaseKeySource) Fingerprint(suite CipherSuite) []byte {
+	d := suite.newDigest()
+	for _, node := range sortedNodes(tbks.Secrets) {
+		d.Write([]byte{byte(node >> 24), byte(node >> 16), byte(node >> 8), byte(node)})
+		d.Write(suite.Digest(tbks.Secrets[node]))
+	}
+	return d.Sum(nil)
+}
+
+// Diff lists, in order, the nodes at which two key sources disagree: nodes
+// populated in one but not the other, and nodes whose secrets differ.
+// Secrets are compared by their hashes, so no secret values are exposed.
+func (tbks *treeBaseKeySource) Diff(other *treeBaseKeySource) []NodeIndex {
+	union := map[NodeIndex]Bytes1{}
+	for node, secret := range tbks.Secrets {
+		union[node] = secret
+	}
+	for node, secret := range other.Secrets {
+		union[node] = secret
+	}
+
+	diff := []NodeIndex{}
+	for _, node := range sortedNodes(union) {
+		a, inA := tbks.Secrets[node]
+		b, inB := other.Secrets[node]
+		if inA != inB || !bytes.Equal(tbks.CipherSuite.Digest(a), other.CipherSuite.Digest(b)) {
+			diff = append(diff, node)
+		}
+	}
+	return diff
+}
+
+// A point-in-time copy of a tree key source's state, from Snapshot
+type treeBaseKeySnapshot struct {
+	Root    NodeIndex
+	Size    LeafCount
+	Secrets map[NodeIndex]Bytes1
+}
+
+func copySecrets(secrets map[NodeIndex]Bytes1) map[NodeIndex]Bytes1 {
+	out := make(map[NodeIndex]Bytes1, len(secrets))
+	for node, secret := range secrets {
+		out[node] = dup(secret)
+	}
+	return out
+}
+
+// Snapshot captures the current state of the tree, so that it can be put back
+// with Restore after a destructive operation such as Get.  The snapshot holds
+// its own copies of the secrets, and should be erased with the rest of the
+// epoch's secrets once it's no longer needed.
+func (tbks *treeBaseKeySource) Snapshot() treeBaseKeySnapshot {
+	return treeBaseKeySnapshot{
+		Root:    tbks.Root,
+		Size:    tbks.Size,
+		Secrets: copySecrets(tbks.Secrets),
+	}
+}
+
+// Restore replaces the tree's state with a copy of the snapshot, erasing the
+// secrets it currently holds.  The snapshot can be restored again later.
+func (tbks *treeBaseKeySource) Restore(snap treeBaseKeySnapshot) {
+	tbks.eraseAll()
+	tbks.Root = snap.Root
+	tbks.Size = snap.Size
+	tbks.Secrets = copySecrets(snap.Secrets)
+}
+
+func (tbks *treeBaseKeySource) eraseAll() {
+	for node, secret := range tbks.Secrets {
+		zeroize(secret)
+		delete(tbks.Secrets, node)
+	}
+}
+
+func (tbks *treeBaseKeySource) dump() {
+	tbks.dumpTo(os.Stdout)
+}
+
+func (tbks *treeBaseKeySource) dumpTo(out io.Writer) {
+	w := nodeWidth(tbks.Size)
+	fmt.Fprintln(out, "=== tbks ===")
+	for i := NodeIndex(0); i < NodeIndex(w); i += 1 {
+		s, ok := tbks.Secrets[i]
+		if ok {
+			fmt.Fprintf(out, "  %3x [%x]\n", i, s)
+		} else {
+			fmt.Fprintf(out, "  %3x _\n", i)
+		}
+	}
+}
+
+///
+/// Group key source
+///
+
+type groupKeySource struct {
+	Base     baseKeySource
+	Ratchets map[LeafIndex]*hashRatchet
+
+	// The epoch the keys belong to, for tagging keys returned by NextKey
+	Epoch Epoch
+
+	// If NewRatchet is set, it is used instead of the hash ratchet, and the
+	// resulting ratchets are held in Custom.  Custom ratchets are not persisted
+	// with the epoch.
+	NewRatchet RatchetFactory
+	Custom     map[LeafIndex]Ratchet
+
+	// Keys for senders outside the tree, which are identified by an index of
+	// their own rather than by a leaf.  Only set for handshake keys.
+	External         baseKeySource
+	ExternalRatchets map[uint32]*hashRatchet
+
+	// The base secret for MembershipSender.  Only set for application keys.
+	Membership []byte
+
+	// Whether EnableStats has been called
+	CollectStats bool
+
+	// Whether EnableIdleTracking has been called
+	TrackIdle bool
+
+	// If MaxRatchets is positive, no ratchet is created for a new sender once
+	// the source holds that many, so that messages claiming to be from many
+	// different senders can't make it allocate without bound.  External
+	// senders are counted separately, against the same limit.  Existing
+	// ratchets are unaffected.
+	MaxRatchets int
+
+	// If MaxCachedKeys is positive, the keys cached by all of the source's
+	// hash ratchets together are kept within that many, by evicting the least
+	// recently used ones.  Evicted keys are zeroized, and later requests for
+	// them fail as for expired keys.  Custom and external sender ratchets are
+	// not counted.
+	MaxCachedKeys int
+	cacheOrder    *keyCacheLRU
+
+	// If set, every method that reads or modifies the source's ratchets holds
+	// this lock, so that the source can be used from several goroutines at
+	// once.  It is set for the key sources of an epoch.
+	mu *sync.Mutex
+
+	// Senders whose ratchets have been moved into a SenderDecryptor.  No
+	// ratchet is created for them again, since it would start over at the
+	// same keys and nonces as the decryptor's.
+	Split map[LeafIndex]bool
+
+	// Whether the epoch the keys belong to has been erased, after which no
+	// keys are returned; see keyScheduleEpoch.Usable
+	Erased bool
+
+	// The config of the key schedule the source belongs to, which is passed
+	// on to the hash ratchets it creates
+	config *KeyScheduleConfig
+}
+
+// ErrSenderSplit is returned for keys of a sender whose ratchets have been
+// moved out of the epoch with SenderDecryptor
+var ErrSenderSplit = fmt.Errorf("Sender's ratchets have been split off")
+
+// A key cached by one of a groupKeySource's ratchets
+type cachedKeyID struct {
+	Sender     LeafIndex
+	Generation uint32
+}
+
+// The order in which cached keys were last used, oldest first
+type keyCacheLRU struct {
+	order   *list.List
+	entries map[cachedKeyID]*list.Element
+}
+
+func newKeyCacheLRU() *keyCacheLRU {
+	return &keyCacheLRU{order: list.New(), entries: map[cachedKeyID]*list.Element{}}
+}
+
+func (lru *keyCacheLRU) touch(id cachedKeyID) {
+	if elem, ok := lru.entries[id]; ok {
+		lru.order.MoveToBack(elem)
+		return
+	}
+
+	lru.entries[id] = lru.order.PushBack(id)
+}
+
+func (lru *keyCacheLRU) remove(id cachedKeyID) {
+	if elem, ok := lru.entries[id]; ok {
+		lru.order.Remove(elem)
+		delete(lru.entries, id)
+	}
+}
+
+func (lru *keyCacheLRU) popOldest() (cachedKeyID, bool) {
+	elem := lru.order.Front()
+	if elem == nil {
+		return cachedKeyID{}, false
+	}
+
+	id := elem.Value.(cachedKeyID)
+	lru.remove(id)
+	return id, true
+}
+
+func (gks groupKeySource) lock() {
+	if gks.mu != nil {
+		gks.mu.Lock()
+	}
+}
+
+func (gks groupKeySource) unlock() {
+	if gks.mu != nil {
+		gks.mu.Unlock()
+	}
+}
+
+// UseRatchets switches the source to build sender ratchets with the given
+// factory.  It should be called before any keys are requested.
+func (gks *groupKeySource) UseRatchets(factory RatchetFactory) {
+	gks.lock()
+	defer gks.unlock()
+
+	gks.NewRatchet = factory
+	gks.Custom = map[LeafIndex]Ratchet{}
+}
+
+// MembershipSender is a reserved sender for content authenticated by the
+// group as a whole.  Its ratchet is seeded from the epoch's membership key
+// instead of the secret tree, so its keys are independent of every member's.
+const MembershipSender LeafIndex = math.MaxUint32
+
+// The node that the membership ratchet is bound to.  A tree of maxLeafCount
+// leaves has nodes 0 through 2^32 - 2, so this is not the node of any leaf.
+const membershipNode NodeIndex = math.MaxUint32
+
+// The node that a sender's ratchet and keys are bound to
+func senderNode(sender LeafIndex) NodeIndex {
+	if sender == MembershipSender {
+		return membershipNode
+	}
+	return toNodeIndex(sender)
+}
+
+// The base secret of a sender's ratchet
+func (gks groupKeySource) baseSecret(sender LeafIndex) ([]byte, error) {
+	if sender != MembershipSender {
+		return gks.Base.Get(sender)
+	}
+
+	if gks.Membership == nil {
+		return nil, fmt.Errorf("No keys for membership content")
+	}
+
+	secretSize := gks.Base.Suite().Constants().SecretSize
+	return gks.Base.Suite().hkdfExpandLabel(gks.Membership, "membership ratchet", []byte{}, secretSize), nil
+}
+
+func (gks groupKeySource) ratchet(sender LeafIndex) (Ratchet, error) {
+	if gks.Erased {
+		return nil, ErrEpochErased
+	}
+
+	if gks.Split[sender] {
+		return nil, ErrSenderSplit
+	}
+
+	if gks.NewRatchet != nil {
+		if r, ok := gks.Custom[sender]; ok {
+			return r, nil
+		}
+
+		if gks.MaxRatchets > 0 && len(gks.Custom) >= gks.MaxRatchets {
+			return nil, fmt.Errorf("Too many ratchets (%d)", len(gks.Custom))
+		}
+
+		baseSecret, err := gks.baseSecret(sender)
+		if err != nil {
+			return nil, err
+		}
+
+		gks.Custom[sender] = gks.NewRatchet(gks.Base.Suite(), senderNode(sender), baseSecret)
+		return gks.Custom[sender], nil
+	}
+
+	if r, ok := gks.Ratchets[sender]; ok {
+		return r, nil
+	}
+
+	if gks.MaxRatchets > 0 && len(gks.Ratchets) >= gks.MaxRatchets {
+		return nil, fmt.Errorf("Too many ratchets (%d)", len(gks.Ratchets))
+	}
+
+	baseSecret, err := gks.baseSecret(sender)
+	if err != nil {
+		return nil, err
+	}
+
+	gks.Ratchets[sender] = newHashRatchet(gks.Base.Suite(), senderNode(sender), baseSecret)
+	gks.configure(gks.Ratchets[sender])
+	return gks.Ratchets[sender], nil
+}
+
+// Apply the source's settings to a hash ratchet it has just created
+func (gks groupKeySource) configure(hr *hashRatchet) {
+	hr.setConfig(gks.config)
+	if gks.CollectStats {
+		hr.EnableStats()
+	}
+	if gks.TrackIdle {
+		hr.TrackAccess()
+	}
+}
+
+func (gks groupKeySource) dump(w io.Writer) {
+	for _, sender := range sortedSenders(gks.Ratchets) {
+		fmt.Fprintf(w, "  sender %d\n", sender)
+		gks.Ratchets[sender].dump(w)
+	}
+}
+
+func (gks *groupKeySource) Next(sender LeafIndex) (uint32, keyAndNonce, error) {
+	gks.lock()
+	defer gks.unlock()
+
+	r, err := gks.ratchet(sender)
+	if err != nil {
+		return 0, keyAndNonce{}, err
+	}
+
+	generation, kn := r.Next()
+	gks.trackCache(sender, generation, generation)
+	return generation, kn, nil
+}
+
+// Get returns the sender's key and nonce for a generation, deriving and
+// caching them if needed.  For the key sources of an epoch, Get may be called
+// from several goroutines at once, and concurrently with the source's other
+// methods: calls are serialized, so that a generation which is not yet cached
+// is derived only once, and later Gets for it are served from the cache.
+func (gks *groupKeySource) Get(sender LeafIndex, generation uint32) (keyAndNonce, error) {
+	gks.lock()
+	defer gks.unlock()
+
+	return gks.get(sender, generation)
+}
+
+func (gks *groupKeySource) get(sender LeafIndex, generation uint32) (keyAndNonce, error) {
+	r, err := gks.ratchet(sender)
+	if err != nil {
+		return keyAndNonce{}, err
+	}
+
+	from := generation
+	if hr, ok := r.(*hashRatchet); ok && hr.NextGeneration < generation {
+		from = hr.NextGeneration
+	}
+
+	kn, err := r.Get(generation)
+	if err != nil {
+		return keyAndNonce{}, err
+	}
+
+	gks.trackCache(sender, from, generation)
+	return kn, nil
+}
+
+// Record that the sender's key for a generation was used, after its ratchet
+// may have cached keys for the generations from `from` up to it, and evict the
+// least recently used keys while the source is over MaxCachedKeys
+func (gks *groupKeySource) trackCache(sender LeafIndex, from, generation uint32) {
+	if gks.MaxCachedKeys <= 0 || gks.NewRatchet != nil {
+		return
+	}
+
+	hr, ok := gks.Ratchets[sender]
+	if !ok {
+		return
+	}
+
+	// Keys cached before the budget was set are taken to be the oldest
+	if gks.cacheOrder == nil {
+		gks.cacheOrder = newKeyCacheLRU()
+		for _, s := range sortedSenders(gks.Ratchets) {
+			for _, gen := range sortedGenerations(gks.Ratchets[s].Cache) {
+				gks.cacheOrder.touch(cachedKeyID{s, gen})
+			}
+		}
+	}
+
+	for gen := from; ; gen += 1 {
+		if _, cached := hr.Cache[gen]; cached {
+			gks.cacheOrder.touch(cachedKeyID{sender, gen})
+		}
+
+		if gen == generation {
+			break
+		}
+	}
+
+	total := 0
+	for _, r := range gks.Ratchets {
+		total += len(r.Cache)
+	}
+
+	for total > gks.MaxCachedKeys {
+		id, ok := gks.cacheOrder.popOldest()
+		if !ok {
+			break
+		}
+
+		// Entries for keys that have since been erased are dropped
+		if r, ok := gks.Ratchets[id.Sender]; ok {
+			if _, cached := r.Cache[id.Generation]; cached {
+				r.evict(id.Generation)
+				total -= 1
+			}
+		}
+	}
+}
+
+// Erase deletes the key for a generation from the sender's ratchet.  If the
+// sender has no ratchet, there is nothing to erase, and no ratchet is created.
+func (gks groupKeySource) Erase(sender LeafIndex, generation uint32) error {
+	gks.lock()
+	defer gks.unlock()
+
+	return gks.erase(sender, generation)
+}
+
+func (gks groupKeySource) erase(sender LeafIndex, generation uint32) error {
+	var r Ratchet
+	var ok bool
+	if gks.NewRatchet != nil {
+		r, ok = gks.Custom[sender]
+	} else {
+		r, ok = gks.Ratchets[sender]
+	}
+
+	if !ok {
+		return nil
+	}
+
+	r.Erase(generation)
+	if gks.cacheOrder != nil {
+		gks.cacheOrder.remove(cachedKeyID{sender, generation})
+	}
+	return nil
+}
+
+// A RatchetSeed is the base secret of a sender's ratchet, together with the
+// generation the sender will use next
+type RatchetSeed struct {
+	Secret     []byte
+	Generation uint32
+}
+
+// Restore installs hash ratchets for a batch of senders at once, e.g., for a
+// joiner or a recovering server that has received the senders' base secrets.
+// Each ratchet is advanced to its seed's generation without caching any keys
+// for the generations skipped.  Any existing ratchet for one of the senders is
+// erased and replaced.  If any seed is invalid, no ratchets are installed.
+func (gks groupKeySource) Restore(seeds map[LeafIndex]RatchetSeed) error {
+	if gks.NewRatchet != nil {
+		return fmt.Errorf("Cannot restore hash ratchets into a source with custom ratchets")
+	}
+
+	gks.lock()
+	defer gks.unlock()
+
+	suite := gks.Base.Suite()
+	secretSize := suite.Constants().SecretSize
+	ratchets := map[LeafIndex]*hashRatchet{}
+	for sender, seed := range seeds {
+		if gks.Split[sender] {
+			return ErrSenderSplit
+		}
+
+		if sender != MembershipSender && LeafCount(sender) >= maxLeafCount {
+			return fmt.Errorf("Sender %d out of range", sender)
+		}
+
+		if tbks, isTree := gks.Base.(*treeBaseKeySource); isTree && sender >= LeafIndex(tbks.Size) {
+			return fmt.Errorf("Sender %d out of range for tree size %d", sender, tbks.Size)
+		}
+
+		if len(seed.Secret) != secretSize {
+			return fmt.Errorf("Incorrect base secret length %d != %d for sender %d", len(seed.Secret), secretSize, sender)
+		}
+
+		hr := newHashRatchet(suite, senderNode(sender), dup(seed.Secret))
+		hr.skipTo(seed.Generation)
+		gks.configure(hr)
+		ratchets[sender] = hr
+	}
+
+	for sender, hr := range ratchets {
+		if old, ok := gks.Ratchets[sender]; ok {
+			old.eraseAll()
+		}
+		gks.Ratchets[sender] = hr
+	}
+
+	return nil
+}
+
+// MessageKey is a key and nonce along with the epoch and generation it was
+// derived for, so that callers don't have to track them separately
+type MessageKey struct {
+	Epoch      Epoch
+	Generation uint32
+	KN         keyAndNonce
+}
+
+// NextKey is like Next, but returns the key tagged with its epoch and
+// generation
+func (gks *groupKeySource) NextKey(sender LeafIndex) (MessageKey, error) {
+	generation, kn, err := gks.Next(sender)
+	if err != nil {
+		return MessageKey{}, err
+	}
+
+	return MessageKey{Epoch: gks.Epoch, Generation: generation, KN: kn}, nil
+}
+
+// The number of generations past the next expected one that OpenNext also
+// tries, to tolerate that many lost or reordered messages
+const OpenNextGap = 4
+
+// OpenNext decrypts a message from the sender without being told its
+// generation.  It tries the sender's next expected generation first, and then
+// up to OpenNextGap generations beyond it, and returns the plaintext and the
+// generation whose key opened the ciphertext.  The key's nonce is used as is.
+// The ratchet is only advanced, and the key used erased, once decryption has
+// succeeded; if no key opens the ciphertext, the ratchet is left unchanged.
+func (gks *groupKeySource) OpenNext(sender LeafIndex, aad, ciphertext []byte) ([]byte, uint32, error) {
+	gks.lock()
+	defer gks.unlock()
+
+	r, err := gks.ratchet(sender)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hr, ok := r.(*hashRatchet)
+	if !ok {
+		return nil, 0, fmt.Errorf("OpenNext requires a hash ratchet")
+	}
+
+	for gap := uint32(0); gap <= OpenNextGap; gap += 1 {
+		generation := hr.NextGeneration + gap
+		if generation < hr.NextGeneration {
+			break
+		}
+
+		kn := hr.peek(generation)
+		pt, err := hr.Suite.open(kn.Key, kn.Nonce, aad, ciphertext)
+		zeroize(kn.Key)
+		zeroize(kn.Nonce)
+		if err != nil {
+			continue
+		}
+
+		if _, err := gks.get(sender, generation); err != nil {
+			return nil, 0, err
+		}
+
+		if err := gks.erase(sender, generation); err != nil {
+			return nil, 0, err
+		}
+
+		return pt, generation, nil
+	}
+
+	return nil, 0, fmt.Errorf("Unable to decrypt with generations %d through %d", hr.NextGeneration, hr.NextGeneration+OpenNextGap)
+}
+
+// Stream returns an iterator over the sender's keys in generation order, for
+// a receiver that processes the sender's messages strictly in order.  Each
+// call returns the key for the next generation, advancing the ratchet as
+// needed, and erases the key returned by the previous call, so that a key is
+// forgotten as soon as the next message is taken up.  Iteration starts at the
+// ratchet's next generation, or at zero if the sender has no hash ratchet yet.
+func (gks *groupKeySource) Stream(sender LeafIndex) (func() (uint32, keyAndNonce, error), error) {
+	gks.lock()
+	r, err := gks.ratchet(sender)
+	if err != nil {
+		gks.unlock()
+		return nil, err
+	}
+
+	next := uint32(0)
+	if hr, ok := r.(*hashRatchet); ok {
+		next = hr.NextGeneration
+	}
+	gks.unlock()
+
+	started := false
+	return func() (uint32, keyAndNonce, error) {
+		if started && next == 0 {
+			return 0, keyAndNonce{}, fmt.Errorf("Ratchet generation overflow")
+		}
+
+		gks.lock()
+		defer gks.unlock()
+
+		if started {
+			if err := gks.erase(sender, next-1); err != nil {
+				return 0, keyAndNonce{}, err
+			}
+		}
+
+		kn, err := gks.get(sender, next)
+		if err != nil {
+			return 0, keyAndNonce{}, err
+		}
+
+		generation := next
+		started = true
+		next += 1
+		return generation, kn.clone(), nil
+	}, nil
+}
+
+// Prefetch derives the sender's next count generations into its ratchet's
+// cache ahead of use, e.g., for a reliable transport with a known window of
+// messages in flight, so that receiving them later costs no ratchet steps.
+// The prefetched keys are ordinary cached keys: they are used with Get, and
+// should be erased with EraseThrough as their messages are acknowledged.
+func (gks *groupKeySource) Prefetch(sender LeafIndex, count int) error {
+	if count <= 0 {
+		return nil
+	}
+
+	gks.lock()
+	defer gks.unlock()
+
+	r, err := gks.ratchet(sender)
+	if err != nil {
+		return err
+	}
+
+	hr, ok := r.(*hashRatchet)
+	if !ok {
+		return fmt.Errorf("Prefetch requires a hash ratchet")
+	}
+
+	if uint64(count-1) > uint64(gks.config.maxGenerationSkip()) {
+		return ErrKeyTooFar
+	}
+
+	last := hr.NextGeneration + uint32(count-1)
+	if last < hr.NextGeneration {
+		return fmt.Errorf("Ratchet generation overflow")
+	}
+
+	_, err = gks.get(sender, last)
+	return err
+}
+
+// EraseThrough erases the sender's cached keys for every generation up to and
+// including the given one, e.g., once the messages for a window of keys
+// fetched with Prefetch have been acknowledged.
+func (gks *groupKeySource) EraseThrough(sender LeafIndex, generation uint32) error {
+	gks.lock()
+	defer gks.unlock()
+
+	for _, gen := range gks.cachedGenerations(sender) {
+		if gen > generation {
+			break
+		}
+
+		if err := gks.erase(sender, gen); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExternalRatchet returns the ratchet for an external sender, creating it if
+// necessary.  External sender keys are derived from their own secret, so they
+// never coincide with the keys of the member at the same index.
+func (gks groupKeySource) ExternalRatchet(senderID uint32) (*hashRatchet, error) {
+	if gks.External == nil || gks.ExternalRatchets == nil {
+		return nil, fmt.Errorf("No keys for external senders")
+	}
+
+	gks.lock()
+	defer gks.unlock()
+
+	if r, ok := gks.ExternalRatchets[senderID]; ok {
+		return r, nil
+	}
+
+	if gks.MaxRatchets > 0 && len(gks.ExternalRatchets) >= gks.MaxRatchets {
+		return nil, fmt.Errorf("Too many external ratchets (%d)", len(gks.ExternalRatchets))
+	}
+
+	baseSecret, err := gks.External.Get(LeafIndex(senderID))
+	if err != nil {
+		return nil, err
+	}
+
+	gks.ExternalRatchets[senderID] = newHashRatchet(gks.External.Suite(), toNodeIndex(LeafIndex(senderID)), baseSecret)
+	gks.configure(gks.ExternalRatchets[senderID])
+	return gks.ExternalRatchets[senderID], nil
+}
+
+// CanGet reports whether Get would succeed for the sender and generation,
+// without deriving any keys or creating a ratchet.  A key is available if it
+// is cached, or if the sender's ratchet can reach it within the config's
+// MaxGenerationSkip.  Ratchets other than the hash ratchet can't be inspected;
+// for those, CanGet only reports whether the ratchet exists.
+func (gks groupKeySource) CanGet(sender LeafIndex, generation uint32) bool {
+	gks.lock()
+	defer gks.unlock()
+
+	var r Ratchet
+	var ok bool
+	if gks.NewRatchet != nil {
+		r, ok = gks.Custom[sender]
+	} else {
+		r, ok = gks.Ratchets[sender]
+	}
+
+	if ok {
+		if hr, isHash := r.(*hashRatchet); isHash {
+			return hr.canGet(generation)
+		}
+		return true
+	}
+
+	// A new ratchet would start at generation zero, if its base key is
+	// still available
+	if generation > gks.config.maxGenerationSkip() {
+		return false
+	}
+
+	if sender == MembershipSender {
+		return gks.Membership != nil
+	}
+
+	if tbks, isTree := gks.Base.(*treeBaseKeySource); isTree {
+		_, _, found := tbks.findSource(sender)
+		return found && !tbks.Blank[sender]
+	}
+	return LeafCount(sender) < maxLeafCount
+}
+
+// EnableStats turns on counting for the source's hash ratchets, both those
+// that already exist and those created from now on.  Custom ratchets that are
+// hash ratchets must be enabled by their factory.
+func (gks *groupKeySource) EnableStats() {
+	gks.lock()
+	defer gks.unlock()
+
+	gks.CollectStats = true
+	for _, r := range gks.Ratchets {
+		r.EnableStats()
+	}
+	for _, r := range gks.ExternalRatchets {
+		r.EnableStats()
+	}
+}
+
+// Stats sums the counters of all of the source's hash ratchets, including
+// those of external senders
+func (gks groupKeySource) Stats() RatchetStats {
+	gks.lock()
+	defer gks.unlock()
+
+	total := RatchetStats{}
+	for _, r := range gks.Ratchets {
+		total.add(r.Stats())
+	}
+	for _, r := range gks.Custom {
+		if hr, ok := r.(*hashRatchet); ok {
+			total.add(hr.Stats())
+		}
+	}
+	for _, r := range gks.ExternalRatchets {
+		total.add(r.Stats())
+	}
+	return total
+}
+
+// EnableIdleTracking starts recording when each of the source's hash ratchets
+// is used, so that EraseIdle can find those that have gone unused.  Ratchets
+// that already exist count as used now.
+func (gks *groupKeySource) EnableIdleTracking() {
+	gks.lock()
+	defer gks.unlock()
+
+	gks.TrackIdle = true
+	for _, r := range gks.Ratchets {
+		r.TrackAccess()
+	}
+	for _, r := range gks.ExternalRatchets {
+		r.TrackAccess()
+	}
+}
+
+// EraseIdle erases and removes the hash ratchets, including those of external
+// senders, that have not been used for longer than the given duration, e.g.,
+// for senders who have gone quiet in a long-lived epoch.  Only ratchets whose
+// access times are tracked are considered; see EnableIdleTracking.  Times are
+// read from the clock of the epoch's config.  It returns the number of
+// ratchets removed.
+func (gks groupKeySource) EraseIdle(olderThan time.Duration) int {
+	gks.lock()
+	defer gks.unlock()
+
+	cutoff := gks.config.now().Add(-olderThan)
+	idle := func(hr *hashRatchet) bool {
+		last, ok := hr.LastAccess()
+		return ok && last.Before(cutoff)
+	}
+
+	removed := 0
+	for sender, r := range gks.Ratchets {
+		if !idle(r) {
+			continue
+		}
+
+		if gks.cacheOrder != nil {
+			for gen := range r.Cache {
+				gks.cacheOrder.remove(cachedKeyID{sender, gen})
+			}
+		}
+		r.eraseAll()
+		delete(gks.Ratchets, sender)
+		removed += 1
+	}
+
+	for senderID, r := range gks.ExternalRatchets {
+		if idle(r) {
+			r.eraseAll()
+			delete(gks.ExternalRatchets, senderID)
+			removed += 1
+		}
+	}
+
+	return removed
+}
+
+// CachedGenerations lists, in order, the generations for which the sender's
+// ratchet currently holds keys.  It returns nil if the sender has no hash
+// ratchet yet; no ratchet is created.
+func (gks groupKeySource) CachedGenerations(sender LeafIndex) []uint32 {
+	gks.lock()
+	defer gks.unlock()
+
+	return gks.cachedGenerations(sender)
+}
+
+func (gks groupKeySource) cachedGenerations(sender LeafIndex) []uint32 {
+	hr, ok := gks.Ratchets[sender]
+	if gks.NewRatchet != nil {
+		hr, ok = gks.Custom[sender].(*hashRatchet)
+	}
+
+	if !ok {
+		return nil
+	}
+
+	return sortedGenerations(hr.Cache)
+}
+
+// FSFloor returns the lowest generation for which the sender's ratchet still
+// holds a key, i.e., how far back the sender's messages can still be
+// decrypted, and whether it holds any keys at all.  Keys for generations at
+// or beyond the ratchet's next generation can always be derived, and are not
+// counted.
+func (gks groupKeySource) FSFloor(sender LeafIndex) (uint32, bool) {
+	generations := gks.CachedGenerations(sender)
+	if len(generations) == 0 {
+		return 0, false
+	}
+
+	return generations[0], true
+}
+
+// EraseRange erases and removes the ratchets for all senders in [from, to),
+// e.g., after those members have been removed from the group.  Senders that
+// have no ratchet are skipped.
+func (gks groupKeySource) EraseRange(from, to LeafIndex) {
+	gks.lock()
+	defer gks.unlock()
+
+	for sender := from; sender < to; sender += 1 {
+		if r, ok := gks.Ratchets[sender]; ok {
+			if gks.cacheOrder != nil {
+				for gen := range r.Cache {
+					gks.cacheOrder.remove(cachedKeyID{sender, gen})
+				}
+			}
+			r.eraseAll()
+			delete(gks.Ratchets, sender)
+		}
+
+		if r, ok := gks.Custom[sender]; ok {
+			if hr, ok := r.(*hashRatchet); ok {
+				hr.eraseAll()
+			}
+			delete(gks.Custom, sender)
+		}
+	}
+}
+
+///
+/// GroupInfo keys
+///
+
+// The key and nonce that protect a GroupInfo.  The context is mixed into the
+// group info secret, so that groups which happen to share an epoch secret
+// still get different keys if the context tells them apart.  It must be
+// something the joiner knows before decrypting; a Welcome uses the hashes of
+// the KeyPackages it is addressed to (see Welcome.groupInfoContext), since the
+// joiner only learns the group context from the GroupInfo itself.
+func groupInfoKeyAndNonce(suite CipherSuite, epochSecret, context []byte) keyAndNonce {
+	secretSize := suite.Constants().SecretSize
+	keySize := suite.Constants().KeySize
+	nonceSize := suite.Constants().NonceSize
+
+	groupInfoSecret := suite.hkdfExpandLabel(epochSecret, "group info", context, secretSize)
+	groupInfoKey := suite.hkdfExpandLabel(groupInfoSecret, "key", []byte{}, keySize)
+	groupInfoNonce := suite.hkdfExpandLabel(groupInfoSecret, "nonce", []byte{}, nonceSize)
+
+	return keyAndNonce{
+		Key:   groupInfoKey,
+		Nonce: groupInfoNonce,
+	}
+}
+
+// welcomeNonceForRecipient varies a nonce per recipient, for when the same key
+// seals a Welcome to several recipients.  The big-endian recipient index is
+// XORed into the last four bytes of the base nonce, so recipient 0 uses the
+// base nonce itself, and distinct indices always yield distinct nonces.
+func welcomeNonceForRecipient(baseNonce []byte, recipientIndex int) ([]byte, error) {
+	if recipientIndex < 0 || uint64(recipientIndex) > math.MaxUint32 {
+		return nil, fmt.Errorf("Invalid recipient index %d", recipientIndex)
+	}
+
+	if len(baseNonce) < 4 {
+		return nil, fmt.Errorf("Nonce too short for recipient index %d", len(baseNonce))
+	}
+
+	index := uint32(recipientIndex)
+	nonce := dup(baseNonce)
+	n := len(nonce)
+	nonce[n-4] ^= byte(index >> 24)
+	nonce[n-3] ^= byte(index >> 16)
+	nonce[n-2] ^= byte(index >> 8)
+	nonce[n-1] ^= byte(index)
+	return nonce, nil
+}
+
+///
+/// Commit secret
+///
+
+// CommitSecret accumulates the path secrets along an update path into the
+// commit secret that is fed into the key schedule.  Each path secret is
+// extracted into the running value, so the result depends on both the set of
+// secrets and the order in which they are added.
+type CommitSecret struct {
+	suite CipherSuite
+	acc   []byte
+}
+
+// AddPathSecret extracts a path secret into the commit secret.  Every secret
+// must be for the same cipher suite as the first; a secret for another suite
+// is rejected, and leaves the commit secret unchanged.
+func (c *CommitSecret) AddPathSecret(suite CipherSuite, secret []byte) error {
+	if c.acc == nil {
+		c.suite = suite
+		c.acc = suite.zero()
+	} else if c.suite != suite {
+		return fmt.Errorf("Path secret suite mismatch %v != %v", suite, c.suite)
+	}
+
+	next := c.suite.hkdfExtract(c.acc, secret)
+	zeroize(c.acc)
+	c.acc = next
+	return nil
+}
+
+// Finalize returns the commit secret for the path secrets added so far, or nil
+// if none have been added.
+func (c CommitSecret) Finalize() []byte {
+	if c.acc == nil {
+		return nil
+	}
+
+	secretSize := c.suite.Constants().SecretSize
+	return c.suite.hkdfExpandLabel(c.acc, "commit", []byte{}, secretSize)
+}
+
+///
+/// Epoch secret reuse detection
+///
+
+// An epochSecretRegistry remembers a one-way fingerprint of each of the most
+// recent epoch secrets seen in this process.  Seeing the same secret twice
+// means that two epochs share their keys: either two groups collide, which
+// destroys the security of both, or the same epoch was derived twice, which
+// hands out its per-sender ratchets twice.  Only the last
+// epochSecretReuseWindow fingerprints are kept, so the registry stays the same
+// size however long the process runs.
+type epochSecretRegistry struct {
+	seen  map[string]bool
+	order []string
+	next  int
+}
+
+const epochSecretReuseWindow = 4096
+
+var (
+	epochSecretReuseLock sync.Mutex
+	epochSecretReuse     *epochSecretRegistry
+)
+
+// DetectEpochSecretReuse turns process-wide detection of reused epoch secrets
+// on or off.  It is off by default.  When on, each new epoch records a
+// fingerprint of its secret (never the secret itself) and a warning is sent to
+// the Logger of the new epoch's config if the same secret is seen again.
+func DetectEpochSecretReuse(enable bool) {
+	epochSecretReuseLock.Lock()
+	defer epochSecretReuseLock.Unlock()
+
+	if !enable {
+		epochSecretReuse = nil
+		return
+	}
+
+	epochSecretReuse = &epochSecretRegistry{
+		seen:  map[string]bool{},
+		order: make([]string, epochSecretReuseWindow),
+	}
+}
+
+func checkEpochSecretReuse(suite CipherSuite, epochSecret []byte, config *KeyScheduleConfig) {
+	epochSecretReuseLock.Lock()
+	defer epochSecretReuseLock.Unlock()
+
+	r := epochSecretReuse
+	if r == nil {
+		return
+	}
+
+	fingerprint := suite.hkdfExpandLabel(epochSecret, "reuse fingerprint", []byte{}, 16)
+	key := string(fingerprint)
+	if r.seen[key] {
+		config.logf("mls.ks: epoch secret reused [%x]", fingerprint)
+		return
+	}
+
+	// Forget the oldest fingerprint to make room for this one
+	if oldest := r.order[r.next]; oldest != "" {
+		delete(r.seen, oldest)
+	}
+	r.order[r.next] = key
+	r.next = (r.next + 1) % len(r.order)
+	r.seen[key] = true
+}
+
+///
+/// Key schedule epoch
+///
+
+// KeyScheduleOption is a set of flags that alter how an epoch's keys are
+// derived.  Options are carried forward from each epoch to the next.
+type KeyScheduleOption uint16
+
+const (
+	// KeyScheduleApplicationNoFS derives application keys the same way as
+	// handshake keys, directly from the application secret, instead of from
+	// the secret tree.  This lets a receiver derive a sender's application
+	// keys more than once, e.g., to decrypt late or duplicated media frames,
+	// at the cost of forward secrecy within the epoch: anyone who compromises
+	// a member's state can recover every application key for the rest of the
+	// epoch, including keys for messages that were already received and
+	// deleted.  Only use this where that tradeoff is acceptable.
+	KeyScheduleApplicationNoFS KeyScheduleOption = 1 << iota
+
+	// KeyScheduleHandshakeFS derives handshake keys from a secret tree over
+	// the handshake secret, the same way as application keys, so that they
+	// have forward secrecy within the epoch.  Each sender's handshake base key
+	// can then only be derived once, and deriving it costs a walk down the
+	// tree rather than a single derivation.  The resulting keys differ from
+	// the default ones, so all members of a group must agree on this option.
+	KeyScheduleHandshakeFS
+
+	// KeyScheduleSenderDataPerSender derives a separate sender data key for
+	// each sender, bound to the sender's node index, instead of using one key
+	// for the whole epoch.  Since the sender is only known once the sender
+	// data has been decrypted, a receiver has to try each member's key in
+	// turn, so decryption cost grows with the size of the group.
+	KeyScheduleSenderDataPerSender
+)
+
+type keyScheduleEpoch struct {
+	Suite        CipherSuite
+	Options      KeyScheduleOption
+	Epoch        Epoch
+	GroupContext []byte `tls:"head=1"`
+
+	EpochSecret       []byte `tls:"head=1"`
+	SenderDataSecret  []byte `tls:"head=1"`
+	SenderDataKey     []byte `tls:"head=1"`
+	SenderDataVersion uint32
+
+	// If set, sender data keys are derived for, and sender data is protected
+	// with, this suite instead of Suite; see UseSenderDataSuite.  It is not
+	// persisted, and must be set again after decoding.
+	SenderDataSuite CipherSuite `tls:"omit"`
+
+	HandshakeSecret   []byte `tls:"head=1"`
+	ApplicationSecret []byte `tls:"head=1"`
+	ExporterSecret    []byte `tls:"head=1"`
+	ConfirmationKey   []byte `tls:"head=1"`
+	InitSecret        []byte `tls:"head=1"`
+
+	// Root of the keys for external senders, i.e., senders outside the tree
+	ExternalSenderSecret []byte `tls:"head=1"`
+
+	// Root of the keys for content authenticated by the group as a whole,
+	// rather than by one member (see MembershipSender).  It is not encoded,
+	// but derived again from the epoch secret when the epoch is decoded.
+	MembershipKey []byte `tls:"omit"`
+
+	HandshakeBaseKeys   *noFSBaseKeySource
+	ApplicationBaseKeys *treeBaseKeySource
+
+	// Only present with KeyScheduleHandshakeFS, in which case
+	// HandshakeBaseKeys is left without a root secret
+	HandshakeTreeBaseKeys *treeBaseKeySource `tls:"optional"`
+
+	HandshakeRatchets   map[LeafIndex]*hashRatchet `tls:"head=4"`
+	ApplicationRatchets map[LeafIndex]*hashRatchet `tls:"head=4"`
+	ExternalRatchets    map[uint32]*hashRatchet    `tls:"head=4"`
+
+	ApplicationKeys *groupKeySource `tls:"omit"`
+	HandshakeKeys   *groupKeySource `tls:"omit"`
+
+	// Settings for the epoch and those derived from it; see SetConfig.  A
+	// config set before decoding an epoch applies to the decoding itself.
+	Config *KeyScheduleConfig `tls:"omit"`
+
+	// Set by EraseExceptInit; see Usable.  It is not encoded, but set again
+	// when an epoch whose epoch secret was erased is decoded.
+	erased bool `tls:"omit"`
+
+	// The joiner and welcome secrets of an epoch derived with NextWithPSK,
+	// kept only for ToTestVector.  They are not encoded.
+	joinerSecret  []byte `tls:"omit"`
+	welcomeSecret []byte `tls:"omit"`
+}
+
+// keyScheduleEpochData has the same layout as keyScheduleEpoch, without its
+// custom TLS methods, so that it can be handed to the syntax package directly
+type keyScheduleEpochData keyScheduleEpoch
+
+// An encoded epoch starts with the version of its format, so that persisted
+// epochs can be migrated when the format changes.  Epochs persisted before the
+// version was added have no version, and start directly with the cipher
+// suite; these are read as version 1.  Versions are numbered from 0xff00 so
+// that they can't be mistaken for a cipher suite.
+const (
+	keyScheduleVersionMask uint16 = 0xff00
+	keyScheduleVersion2    uint16 = 0xff02
+
+	keyScheduleVersion = keyScheduleVersion2
+)
+
+func keyScheduleVersionHeader() []byte {
+	version := keyScheduleVersion
+	return []byte{byte(version >> 8), byte(version)}
+}
+
+// An epoch whose senders have been split off can't be encoded: the decoded
+// epoch would not know about the split, and would derive the split senders'
+// keys over again
+func (kse *keyScheduleEpoch) checkEncodable() error {
+	for _, keys := range []*groupKeySource{kse.HandshakeKeys, kse.ApplicationKeys} {
+		if keys != nil && len(keys.Split) > 0 {
+			return fmt.Errorf("mls.ks: cannot encode an epoch with split-off senders")
+		}
+	}
+	return nil
+}
+
+func (kse keyScheduleEpoch) MarshalTLS() ([]byte, error) {
+	if err := kse.checkEncodable(); err != nil {
+		return nil, err
+	}
+
+	data, err := syntax.Marshal(keyScheduleEpochData(kse))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(keyScheduleVersionHeader(), data...), nil
+}
+
+// The layout of an epoch before encodings were versioned (version 1).  It has
+// none of the fields that have been added to keyScheduleEpoch since, and its
+// ratchets none of those added to hashRatchet.
+type keyScheduleEpochV1 struct {
+	Suite        CipherSuite
+	GroupContext []byte `tls:"head=1"`
+
+	EpochSecret       []byte `tls:"head=1"`
+	SenderDataSecret  []byte `tls:"head=1"`
+	SenderDataKey     []byte `tls:"head=1"`
+	HandshakeSecret   []byte `tls:"head=1"`
+	ApplicationSecret []byte `tls:"head=1"`
+	ExporterSecret    []byte `tls:"head=1"`
+	ConfirmationKey   []byte `tls:"head=1"`
+	InitSecret        []byte `tls:"head=1"`
+
+	HandshakeBaseKeys   *noFSBaseKeySource
+	ApplicationBaseKeys *treeBaseKeySource
+
+	HandshakeRatchets   map[LeafIndex]*hashRatchetV1 `tls:"head=4"`
+	ApplicationRatchets map[LeafIndex]*hashRatchetV1 `tls:"head=4"`
+}
+
+type hashRatchetV1 struct {
+	Suite          CipherSuite
+	Node           NodeIndex
+	NextSecret     []byte `tls:"head=1"`
+	NextGeneration uint32
+	Cache          map[uint32]keyAndNonce `tls:"head=4"`
+	KeySize        uint32
+	NonceSize      uint32
+	SecretSize     uint32
+}
+
+// Version 1 ratchets all used the default labels, and had no other state
+func migrateRatchetsV1(v1 map[LeafIndex]*hashRatchetV1) map[LeafIndex]*hashRatchet {
+	ratchets := map[LeafIndex]*hashRatchet{}
+	for sender, old := range v1 {
+		hr := newHashRatchet(old.Suite, old.Node, old.NextSecret)
+		hr.NextGeneration = old.NextGeneration
+		hr.Cache = old.Cache
+		hr.KeySize = old.KeySize
+		hr.NonceSize = old.NonceSize
+		hr.SecretSize = old.SecretSize
+		ratchets[sender] = hr
+	}
+	return ratchets
+}
+
+// Decode a version 1 epoch.  The secrets added since are derived from the
+// epoch secret, unless it has been erased; options and the sender data key
+// version take their defaults.  The epoch number was not recorded, and is left
+// at zero for the caller to set.
+func (kse *keyScheduleEpoch) unmarshalV1(data []byte) (int, error) {
+	_, err := checkVectorBounds(data, reflect.TypeOf(keyScheduleEpochV1{}), 0, false, kse.Config.maxVectorSize())
+	if err != nil {
+		return 0, fmt.Errorf("mls.ks: invalid key schedule encoding: %v", err)
+	}
+
+	var v1 keyScheduleEpochV1
+	read, err := syntax.Unmarshal(data, &v1)
+	if err != nil {
+		return 0, err
+	}
+
+	*kse = keyScheduleEpoch{
+		Suite:        v1.Suite,
+		GroupContext: v1.GroupContext,
+		Config:       kse.Config,
+
+		EpochSecret:       v1.EpochSecret,
+		SenderDataSecret:  v1.SenderDataSecret,
+		SenderDataKey:     v1.SenderDataKey,
+		HandshakeSecret:   v1.HandshakeSecret,
+		ApplicationSecret: v1.ApplicationSecret,
+		ExporterSecret:    v1.ExporterSecret,
+		ConfirmationKey:   v1.ConfirmationKey,
+		InitSecret:        v1.InitSecret,
+
+		HandshakeBaseKeys:   v1.HandshakeBaseKeys,
+		ApplicationBaseKeys: v1.ApplicationBaseKeys,
+
+		HandshakeRatchets:   migrateRatchetsV1(v1.HandshakeRatchets),
+		ApplicationRatchets: migrateRatchetsV1(v1.ApplicationRatchets),
+		ExternalRatchets:    map[uint32]*hashRatchet{},
+	}
+
+	if isZero(kse.EpochSecret) {
+		kse.ExternalSenderSecret = make([]byte, len(kse.EpochSecret))
+	} else {
+		kse.ExternalSenderSecret = kse.Suite.deriveSecret(kse.EpochSecret, "external sender", kse.GroupContext)
+	}
+
+	return read, nil
+}
+
+// UnmarshalTLS checks the format version, then bounds-checks every length
+// prefix in the encoded epoch against the config's MaxVectorSize before
+// decoding it.  Unversioned (version 1) encodings are decoded with their own layout and
+// migrated; see unmarshalV1.
+func (kse *keyScheduleEpoch) UnmarshalTLS(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, fmt.Errorf("mls.ks: invalid key schedule encoding: too short")
+	}
+
+	var read int
+	var err error
+	version := uint16(data[0])<<8 | uint16(data[1])
+	switch {
+	case version == keyScheduleVersion:
+		read, err = kse.unmarshalV2(data[2:])
+		read += 2
+	case version&keyScheduleVersionMask == keyScheduleVersionMask:
+		return 0, fmt.Errorf("mls.ks: unsupported key schedule version %04x", version)
+	default:
+		kse.Config.logf("mls.ks: migrating unversioned key schedule encoding")
+		read, err = kse.unmarshalV1(data)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if isZero(kse.EpochSecret) {
+		kse.MembershipKey = make([]byte, len(kse.EpochSecret))
+		kse.erased = true
+	} else {
+		kse.MembershipKey = kse.Suite.deriveSecret(kse.EpochSecret, "membership", kse.GroupContext)
+	}
+
+	return read, nil
+}
+
+func (kse *keyScheduleEpoch) unmarshalV2(data []byte) (int, error) {
+	_, err := checkVectorBounds(data, reflect.TypeOf(keyScheduleEpochData{}), 0, false, kse.Config.maxVectorSize())
+	if err != nil {
+		return 0, fmt.Errorf("mls.ks: invalid key schedule encoding: %v", err)
+	}
+
+	return syntax.Unmarshal(data, (*keyScheduleEpochData)(kse))
+}
+
+// MarshalTo writes the same encoding as syntax.Marshal, one field at a time, so
+// that the whole epoch is never held in memory at once.  Ratchet maps are
+// streamed one entry at a time, in encoded key order; their length prefix is
+// computed in a first pass that discards each encoded entry.
+func (kse *keyScheduleEpoch) MarshalTo(w io.Writer) error {
+	if err := kse.checkEncodable(); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(keyScheduleVersionHeader()); err != nil {
+		return fmt.Errorf("mls.ks: failed to stream version: %v", err)
+	}
+
+	return streamStruct(w, reflect.ValueOf((*keyScheduleEpochData)(kse)).Elem())
+}
+
+// Encode a struct one field at a time, with the entries of any map field in
+// encoded key order
+func streamStruct(w io.Writer, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i += 1 {
+		f := t.Field(i)
+		tag := f.Tag.Get("tls")
+		if tag == "omit" {
+			continue
+		}
+
+		if err := streamStructField(w, v, i); err != nil {
+			return fmt.Errorf("mls.ks: failed to stream %s: %v", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func streamStructField(w io.Writer, v reflect.Value, i int) error {
+	f := v.Type().Field(i)
+	if f.Type.Kind() == reflect.Map {
+		head, _ := strconv.Atoi(strings.TrimPrefix(f.Tag.Get("tls"), "head="))
+		return streamMap(w, v.Field(i), head)
+	}
+
+	return streamField(w, v.Field(i), f.Tag)
+}
+
+// Encode a single struct field by wrapping it in a one-field struct with the
+// same TLS tag
+func streamField(w io.Writer, v reflect.Value, tag reflect.StructTag) error {
+	wrapperType := reflect.StructOf([]reflect.StructField{{Name: "Value", Type: v.Type(), Tag: tag}})
+	wrapper := reflect.New(wrapperType).Elem()
+	wrapper.Field(0).Set(v)
+
+	data, err := syntax.Marshal(wrapper.Interface())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+func streamMap(w io.Writer, m reflect.Value, head int) error {
+	if head < 1 || head > 4 {
+		return fmt.Errorf("Invalid length prefix size %d", head)
+	}
+
+	type encodedKey struct {
+		key  reflect.Value
+		data []byte
+	}
+
+	keys := make([]encodedKey, 0, m.Len())
+	for _, key := range m.MapKeys() {
+		data, err := syntax.Marshal(key.Interface())
+		if err != nil {
+			return err
+		}
+		keys = append(keys, encodedKey{key, data})
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i].data, keys[j].data) < 0 })
+
+	length := 0
+	for _, k := range keys {
+		data, err := syntax.Marshal(m.MapIndex(k.key).Interface())
+		if err != nil {
+			return err
+		}
+		length += len(k.data) + len(data)
+	}
+
+	if length >= 1<<(8*uint(head)) {
+		return fmt.Errorf("Map too long for length prefix %d", length)
+	}
+
+	prefix := make([]byte, head)
+	for i := head - 1; i >= 0; i -= 1 {
+		prefix[i] = byte(length)
+		length >>= 8
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		data, err := syntax.Marshal(m.MapIndex(k.key).Interface())
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(k.data); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// An epoch diff records what is needed to derive an epoch from its epoch
+// secret, together with the encoded fields of the epoch that differ from
+// those of a freshly derived one, e.g., ratchets that have been advanced.
+// Fields that are the same as in the base epoch that the diff was computed
+// from are only listed, and taken from the base when the diff is applied; a
+// digest of their encodings in the base is checked then, as are the base's
+// cipher suite, options and epoch.
+type epochDiffField struct {
+	Index uint16
+	Value []byte `tls:"head=4"`
+}
+
+type epochDiff struct {
+	Suite     CipherSuite
+	Options   KeyScheduleOption
+	BaseEpoch Epoch
+
+	Epoch        Epoch
+	Size         LeafCount
+	EpochSecret  []byte           `tls:"head=1"`
+	GroupContext []byte           `tls:"head=1"`
+	FromBase     []uint16         `tls:"head=4"`
+	BaseDigest   []byte           `tls:"head=1"`
+	Fields       []epochDiffField `tls:"head=4"`
+}
+
+// Digest of the encodings of the base epoch's fields that a diff takes as
+// they are
+func epochDiffBaseDigest(suite CipherSuite, base map[int][]byte, indices []uint16) []byte {
+	h := suite.newDigest()
+	for _, i := range indices {
+		h.Write(base[int(i)])
+	}
+	return h.Sum(nil)
+}
+
+// Encode each persisted field of an epoch on its own, keyed by its index in
+// keyScheduleEpochData
+func (kse *keyScheduleEpoch) encodedFields() (map[int][]byte, error) {
+	if err := kse.checkEncodable(); err != nil {
+		return nil, err
+	}
+
+	v := reflect.ValueOf((*keyScheduleEpochData)(kse)).Elem()
+	t := v.Type()
+	fields := map[int][]byte{}
+	for i := 0; i < t.NumField(); i += 1 {
+		if t.Field(i).Tag.Get("tls") == "omit" {
+			continue
+		}
+
+		buf := bytes.NewBuffer(nil)
+		if err := streamStructField(buf, v, i); err != nil {
+			return nil, fmt.Errorf("mls.ks: failed to encode %s: %v", t.Field(i).Name, err)
+		}
+		fields[i] = buf.Bytes()
+	}
+
+	return fields, nil
+}
+
+// Encoded fields of the epoch that a diff describes, before any of the
+// diff's own fields are applied.  The epoch is derived only for this, so it
+// is not recorded in the reuse registry, and its secrets are not reported to
+// any config.
+func (d epochDiff) freshFields() (map[int][]byte, error) {
+	fresh, err := deriveKeyScheduleEpoch(d.Suite, d.Size, dup(d.EpochSecret), d.GroupContext, d.Options, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fresh.setEpoch(d.Epoch)
+	defer fresh.EraseInit()
+	defer fresh.EraseExceptInit()
+
+	return fresh.encodedFields()
+}
+
+// DiffFrom encodes this epoch relative to prev, e.g., an earlier persisted
+// state of the same epoch, or the epoch it was derived from, for incremental
+// persistence.  Rather than every secret and ratchet, the diff holds the epoch
+// secret and group context, from which the rest of the epoch is derived
+// again, plus only those fields that have changed since, such as ratchets
+// that have been used.  Of those, the ones that are the same as in prev are
+// not repeated.  The cipher suite and options are taken from prev, and must
+// be the same in both epochs.  prev.ApplyDiff rebuilds this epoch from the
+// diff, as long as prev is still in the state the diff was computed from.
+func (kse *keyScheduleEpoch) DiffFrom(prev *keyScheduleEpoch) ([]byte, error) {
+	if kse.Suite != prev.Suite || kse.Options != prev.Options {
+		return nil, fmt.Errorf("mls.ks: cannot diff epochs with different suites or options")
+	}
+
+	if isZero(kse.EpochSecret) {
+		return nil, fmt.Errorf("mls.ks: cannot diff an erased epoch")
+	}
+
+	diff := epochDiff{
+		Suite:        prev.Suite,
+		Options:      prev.Options,
+		BaseEpoch:    prev.Epoch,
+		Epoch:        kse.Epoch,
+		Size:         kse.ApplicationBaseKeys.Size,
+		EpochSecret:  kse.EpochSecret,
+		GroupContext: kse.GroupContext,
+		Fields:       []epochDiffField{},
+	}
+
+	fields, err := kse.encodedFields()
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := prev.encodedFields()
+	if err != nil {
+		return nil, err
+	}
+
+	fresh, err := diff.freshFields()
+	if err != nil {
+		return nil, err
+	}
+
+	diff.FromBase = []uint16{}
+	for i := 0; i < reflect.TypeOf(keyScheduleEpochData{}).NumField(); i += 1 {
+		data, ok := fields[i]
+		switch {
+		case !ok || bytes.Equal(data, fresh[i]):
+			continue
+		case bytes.Equal(data, base[i]):
+			diff.FromBase = append(diff.FromBase, uint16(i))
+		default:
+			diff.Fields = append(diff.Fields, epochDiffField{Index: uint16(i), Value: data})
+		}
+	}
+	diff.BaseDigest = epochDiffBaseDigest(prev.Suite, base, diff.FromBase)
+
+	data, err := syntax.Marshal(diff)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(keyScheduleVersionHeader(), data...), nil
+}
+
+// ApplyDiff rebuilds the epoch that produced diff by calling DiffFrom with
+// this epoch.  It fails if the diff was written in another format version, or
+// was computed from an epoch with another cipher suite, options or epoch
+// number, or if the fields taken from this epoch have changed since.  The
+// result is decoded like any persisted epoch, so fields that are not
+// persisted must be set again.
+func (kse *keyScheduleEpoch) ApplyDiff(diff []byte) (*keyScheduleEpoch, error) {
+	if len(diff) < 2 {
+		return nil, fmt.Errorf("mls.ks: invalid epoch diff: too short")
+	}
+
+	version := uint16(diff[0])<<8 | uint16(diff[1])
+	if version != keyScheduleVersion {
+		return nil, fmt.Errorf("mls.ks: unsupported epoch diff version %04x", version)
+	}
+
+	var d epochDiff
+	read, err := syntax.Unmarshal(diff[2:], &d)
+	if err != nil {
+		return nil, fmt.Errorf("mls.ks: invalid epoch diff: %v", err)
+	}
+	if 2+read != len(diff) {
+		return nil, fmt.Errorf("mls.ks: invalid epoch diff: trailing data")
+	}
+
+	if d.Suite != kse.Suite || d.Options != kse.Options || d.BaseEpoch != kse.Epoch {
+		return nil, fmt.Errorf("mls.ks: epoch diff does not apply to this epoch")
+	}
+
+	fields, err := d.freshFields()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(d.FromBase) > 0 {
+		base, err := kse.encodedFields()
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(epochDiffBaseDigest(kse.Suite, base, d.FromBase), d.BaseDigest) {
+			return nil, fmt.Errorf("mls.ks: epoch diff does not apply to this epoch: base has changed")
+		}
+
+		for _, i := range d.FromBase {
+			if _, ok := fields[int(i)]; !ok {
+				return nil, fmt.Errorf("mls.ks: invalid epoch diff: unknown field %d", i)
+			}
+			fields[int(i)] = base[int(i)]
+		}
+	}
+
+	for _, f := range d.Fields {
+		if _, ok := fields[int(f.Index)]; !ok {
+			return nil, fmt.Errorf("mls.ks: invalid epoch diff: unknown field %d", f.Index)
+		}
+		fields[int(f.Index)] = f.Value
+	}
+
+	data := keyScheduleVersionHeader()
+	for i := 0; i < reflect.TypeOf(keyScheduleEpochData{}).NumField(); i += 1 {
+		data = append(data, fields[i]...)
+	}
+
+	next := new(keyScheduleEpoch)
+	read, err = next.UnmarshalTLS(data)
+	if err != nil {
+		return nil, fmt.Errorf("mls.ks: failed to apply epoch diff: %v", err)
+	}
+	if read != len(data) {
+		return nil, fmt.Errorf("mls.ks: failed to apply epoch diff: trailing data")
+	}
+
+	return next, nil
+}
+
+func newKeyScheduleEpoch(suite CipherSuite, size LeafCount, epochSecret, context []byte) (keyScheduleEpoch, error) {
+	return newKeyScheduleEpochWithOptions(suite, size, epochSecret, context, 0, nil)
+}
+
+// RebuildEpoch recreates an epoch from its epoch secret, group size, and group
+// context, for recovery when only those have been persisted.  All of the
+// epoch's secrets are derived again exactly as they were originally, and its
+// ratchets start out fresh.  The epoch number and options are not part of the
+// inputs, and must be restored separately if they were in use.
+func RebuildEpoch(suite CipherSuite, size LeafCount, epochSecret, context []byte) (keyScheduleEpoch, error) {
+	return newKeyScheduleEpoch(suite, size, epochSecret, context)
+}
+
+// Iteration count for BaseSecretFromPassword
+const passwordIterations = 100000
+
+// BaseSecretFromPassword derives a root secret from a password and salt with
+// PBKDF2 over the suite's hash, e.g., to seed an epoch with RebuildEpoch, so
+// that two parties can bootstrap the same key schedule from a passphrase.
+// This is only meant for demos and tests: a passphrase has far less entropy
+// than the secrets the key schedule is designed for, and MUST NOT be used to
+// protect real traffic.
+func BaseSecretFromPassword(suite CipherSuite, password, salt []byte) []byte {
+	return pbkdf2.Key(password, salt, passwordIterations, suite.Constants().SecretSize, suite.newDigest)
+}
+
+// newKeyScheduleEpochWithExternalPSK creates the first epoch of a group from
+// an external PSK, rather than from a supplied epoch secret, so that only
+// holders of the PSK arrive at the same keys.  This is the epoch-0 special
+// case of Next, with an all-zero init secret and commit secret.
+func newKeyScheduleEpochWithExternalPSK(suite CipherSuite, size LeafCount, psk, context []byte) (keyScheduleEpoch, error) {
+	earlySecret := suite.hkdfExtract(psk, suite.zero())
+	preEpochSecret := suite.deriveSecret(earlySecret, "derived", context)
+	epochSecret := suite.hkdfExtract(suite.zero(), preEpochSecret)
+	return newKeyScheduleEpoch(suite, size, epochSecret, context)
+}
+
+// newKeyScheduleEpochWithOptions derives an epoch from its epoch secret.  It
+// fails if the group is too large for a secret tree, e.g., because the size
+// came from a malformed message.
+func newKeyScheduleEpochWithOptions(suite CipherSuite, size LeafCount, epochSecret, context []byte, options KeyScheduleOption, config *KeyScheduleConfig) (keyScheduleEpoch, error) {
+	checkEpochSecretReuse(suite, epochSecret, config)
+
+	kse, err := deriveKeyScheduleEpoch(suite, size, epochSecret, context, options, config)
+	if err != nil {
+		return keyScheduleEpoch{}, err
+	}
+
+	kse.reportAllocated()
+	return kse, nil
+}
+
+// Report the allocation of each of the epoch's secrets to its config
+func (kse keyScheduleEpoch) reportAllocated() {
+	for _, secret := range kse.namedSecrets() {
+		kse.Config.secretAllocated(secret.Kind)
+	}
+	kse.Config.secretAllocated("init")
+}
+
+// deriveKeyScheduleEpoch does the work of newKeyScheduleEpochWithOptions
+// without recording the epoch anywhere: its secret is not checked against the
+// reuse registry, and its allocation is not reported.  This is for epochs
+// that are derived only to be compared against and discarded.
+func deriveKeyScheduleEpoch(suite CipherSuite, size LeafCount, epochSecret, context []byte, options KeyScheduleOption, config *KeyScheduleConfig) (keyScheduleEpoch, error) {
+	kse := keyScheduleEpoch{
+		Suite:        suite,
+		Options:      options,
+		Config:       config,
+		GroupContext: context,
+		EpochSecret:  epochSecret,
+
+		HandshakeRatchets:   map[LeafIndex]*hashRatchet{},
+		ApplicationRatchets: map[LeafIndex]*hashRatchet{},
+		ExternalRatchets:    map[uint32]*hashRatchet{},
+	}
+	kse.deriveAllEpochSecrets()
+
+	kse.SenderDataKey = suite.hkdfExpandLabel(kse.SenderDataSecret, "sd key", []byte{}, suite.Constants().KeySize)
+	kse.HandshakeBaseKeys = newNoFSBaseKeySource(suite, kse.HandshakeSecret)
+	var err error
+	kse.ApplicationBaseKeys, err = newTreeBaseKeySource(suite, size, kse.ApplicationSecret)
+	if err == nil && options&KeyScheduleHandshakeFS != 0 {
+		kse.HandshakeBaseKeys = newNoFSBaseKeySource(suite, []byte{})
+		kse.HandshakeTreeBaseKeys, err = newTreeBaseKeySource(suite, size, kse.HandshakeSecret)
+	}
+	if err != nil {
+		for _, secret := range kse.namedSecrets() {
+			zeroize(secret.Secret)
+		}
+		return keyScheduleEpoch{}, fmt.Errorf("mls.ks: %v", err)
+	}
+
+	kse.enableKeySources()
+	return kse, nil
+}
+
+// The secrets derived directly from the epoch secret and group context, by
+// the name of the keyScheduleEpoch field that holds each one, and the label it
+// is derived with.  A new labeled secret only needs a field and an entry here.
+var epochSecretLabels = []struct {
+	Field string
+	Label string
+}{
+	{"SenderDataSecret", "sender data"},
+	{"HandshakeSecret", "handshake"},
+	{"ApplicationSecret", "app"},
+	{"ExporterSecret", "exporter"},
+	{"ConfirmationKey", "confirm"},
+	{"InitSecret", "init"},
+	{"ExternalSenderSecret", "external sender"},
+	{"MembershipKey", "membership"},
+}
+
+// Fill in every secret in epochSecretLabels from the epoch secret
+func (kse *keyScheduleEpoch) deriveAllEpochSecrets() {
+	v := reflect.ValueOf(kse).Elem()
+	for _, entry := range epochSecretLabels {
+		secret := kse.Suite.deriveSecret(kse.EpochSecret, entry.Label, kse.GroupContext)
+		v.FieldByName(entry.Field).SetBytes(secret)
+	}
+}
+
+type namedSecret struct {
+	Kind   string
+	Secret []byte
+}
+
+// The epoch's top-level secrets other than the init secret, with the names
+// reported to the config's OnSecretAllocated and OnSecretZeroized
+func (kse *keyScheduleEpoch) namedSecrets() []namedSecret {
+	return []namedSecret{
+		{"epoch", kse.EpochSecret},
+		{"sender data", kse.SenderDataSecret},
+		{"sender data key", kse.SenderDataKey},
+		{"handshake", kse.HandshakeSecret},
+		{"app", kse.ApplicationSecret},
+		{"exporter", kse.ExporterSecret},
+		{"confirm", kse.ConfirmationKey},
+		{"external sender", kse.ExternalSenderSecret},
+		{"membership", kse.MembershipKey},
+	}
+}
+
+// Whether two maps are the same map, rather than equal ones
+func sameMap(a, b interface{}) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// Wire up the key sources as logic on top of data owned by the epoch.  This
+// must be called whenever the epoch's ratchet maps are replaced, e.g., after
+// decoding.  If the sources already wrap the epoch's current maps, they are
+// left as they are, since they carry settings and state of their own, such as
+// limits, stats, and custom ratchets, that rebuilding them would discard.
+// Either way, the epoch's config is passed on to the sources and ratchets.
+func (kse *keyScheduleEpoch) enableKeySources() {
+	if kse.HandshakeKeys == nil || kse.ApplicationKeys == nil ||
+		!sameMap(kse.HandshakeKeys.Ratchets, kse.HandshakeRatchets) ||
+		!sameMap(kse.HandshakeKeys.ExternalRatchets, kse.ExternalRatchets) ||
+		!sameMap(kse.ApplicationKeys.Ratchets, kse.ApplicationRatchets) {
+		kse.buildKeySources()
+	}
+
+	for _, tbks := range []*treeBaseKeySource{kse.ApplicationBaseKeys, kse.HandshakeTreeBaseKeys} {
+		if tbks != nil {
+			tbks.config = kse.Config
+		}
+	}
+
+	for _, keys := range []*groupKeySource{kse.HandshakeKeys, kse.ApplicationKeys} {
+		keys.lock()
+		keys.config = kse.Config
+		for _, r := range keys.Ratchets {
+			r.setConfig(kse.Config)
+		}
+		for _, r := range keys.ExternalRatchets {
+			r.setConfig(kse.Config)
+		}
+		keys.unlock()
+	}
+}
+
+// SetConfig replaces the epoch's config, for the epoch, its key sources and
+// ratchets, and the epochs derived from it from now on.  The secrets that the
+// epoch allocated before the call were reported to the config it had then.
+func (kse *keyScheduleEpoch) SetConfig(config *KeyScheduleConfig) {
+	kse.Config = config
+	kse.enableKeySources()
+}
+
+func (kse *keyScheduleEpoch) buildKeySources() {
+	kse.HandshakeKeys = &groupKeySource{Base: kse.HandshakeBaseKeys, Ratchets: kse.HandshakeRatchets, Epoch: kse.Epoch, mu: &sync.Mutex{}}
+	kse.ApplicationKeys = &groupKeySource{Base: kse.ApplicationBaseKeys, Ratchets: kse.ApplicationRatchets, Epoch: kse.Epoch, mu: &sync.Mutex{}}
+
+	// External senders only send handshake messages
+	kse.HandshakeKeys.External = newNoFSBaseKeySource(kse.Suite, kse.ExternalSenderSecret)
+	kse.HandshakeKeys.ExternalRatchets = kse.ExternalRatchets
+
+	// Group-authenticated content is application content
+	kse.ApplicationKeys.Membership = kse.MembershipKey
+
+	kse.HandshakeKeys.Erased = kse.erased
+	kse.ApplicationKeys.Erased = kse.erased
+
+	if kse.Options&KeyScheduleHandshakeFS != 0 && kse.HandshakeTreeBaseKeys != nil {
+		kse.HandshakeKeys.Base = kse.HandshakeTreeBaseKeys
+	}
+
+	if kse.Options&KeyScheduleApplicationNoFS != 0 {
+		kse.ApplicationKeys.Base = newNoFSBaseKeySource(kse.Suite, kse.ApplicationSecret)
+	}
+}
+
+// EraseExceptInit zeroizes every secret held by the epoch, including all
+// ratchet state, except the init secret.  It is intended to be called as soon
+// as an epoch is no longer used for messages, leaving only what is needed to
+// derive the next epoch.  Once the next epoch has been derived, EraseInit
+// removes the remainder.
+func (kse *keyScheduleEpoch) EraseExceptInit() {
+	for _, secret := range kse.namedSecrets() {
+		zeroize(secret.Secret)
+		kse.Config.secretZeroized(secret.Kind)
+	}
+
+	if kse.HandshakeBaseKeys != nil {
+		kse.HandshakeBaseKeys.eraseAll()
+	}
+	if kse.ApplicationBaseKeys != nil {
+		kse.ApplicationBaseKeys.eraseAll()
+	}
+	if kse.HandshakeTreeBaseKeys != nil {
+		kse.HandshakeTreeBaseKeys.eraseAll()
+	}
+
+	for _, r := range kse.HandshakeRatchets {
+		r.eraseAll()
+	}
+	for _, r := range kse.ApplicationRatchets {
+		r.eraseAll()
+	}
+	for _, r := range kse.ExternalRatchets {
+		r.eraseAll()
+	}
+
+	zeroize(kse.joinerSecret)
+	zeroize(kse.welcomeSecret)
+
+	kse.erased = true
+	for _, keys := range []*groupKeySource{kse.HandshakeKeys, kse.ApplicationKeys} {
+		if keys != nil {
+			keys.Erased = true
+		}
+	}
+}
+
+// Usable reports whether keys can still be derived from the epoch, i.e.,
+// whether EraseExceptInit has not been called on it.  Once it has, the
+// methods that derive keys for messages or exports fail with ErrEpochErased
+// rather than derive them from zeroized secrets.  An erased epoch can still
+// derive its successor with Next, until EraseInit.
+func (kse *keyScheduleEpoch) Usable() bool {
+	return !kse.erased
+}
+
+// EraseInit zeroizes the init secret, after which the epoch can no longer be
+// used to derive its successor.
+func (kse *keyScheduleEpoch) EraseInit() {
+	zeroize(kse.InitSecret)
+	kse.Config.secretZeroized("init")
+}
+
+// The epoch secret of the epoch that Next would derive
+func (kse *keyScheduleEpoch) nextEpochSecret(pskIn, commitSecret, context []byte) []byte {
+	psk := pskIn
+	if len(psk) == 0 {
+		psk = kse.Suite.zero()
+	}
+
+	earlySecret := kse.Suite.hkdfExtract(psk, kse.InitSecret)
+	preEpochSecret := kse.Suite.deriveSecret(earlySecret, "derived", context)
+	return kse.Suite.hkdfExtract(commitSecret, preEpochSecret)
+}
+
+// Next derives the epoch that follows this one.  The receiver is only read:
+// the new epoch shares no secrets, ratchets, or key sources with it, so Next
+// may be called from several goroutines at once, e.g., to try out competing
+// commits, as long as nothing else modifies the receiver meanwhile.  It fails
+// if the new epoch can't be derived for a group of the given size.
+func (kse *keyScheduleEpoch) Next(size LeafCount, pskIn, commitSecret, context []byte) (keyScheduleEpoch, error) {
+	epochSecret := kse.nextEpochSecret(pskIn, commitSecret, context)
+
+	next, err := newKeyScheduleEpochWithOptions(kse.Suite, size, epochSecret, context, kse.Options, kse.Config)
+	if err != nil {
+		return keyScheduleEpoch{}, err
+	}
+
+	next.setEpoch(kse.Epoch + 1)
+	return next, nil
+}
+
+// PreviewInitSecret computes the init secret of the epoch that Next would
+// derive without a PSK, i.e., what that epoch would chain to its own
+// successor, without deriving the rest of the epoch.  This is cheaper than
+// Next for a speculative check of a commit, since no secret tree or ratchets
+// are built.  It fails with ErrEpochErased once the epoch has been erased.
+func (kse *keyScheduleEpoch) PreviewInitSecret(updateSecret, context []byte) ([]byte, error) {
+	if !kse.Usable() {
+		return nil, ErrEpochErased
+	}
+
+	epochSecret := kse.nextEpochSecret(nil, updateSecret, context)
+	initSecret := kse.Suite.deriveSecret(epochSecret, "init", context)
+	zeroize(epochSecret)
+	return initSecret, nil
+}
+
+// NextForSuite is like Next, but takes the cipher suite that the caller
+// computed its inputs under, and refuses to advance if it is not the epoch's
+// suite.  Otherwise, secrets from one suite could be silently combined with an
+// epoch of another, and the result would not match any other member's.
+func (kse *keyScheduleEpoch) NextForSuite(suite CipherSuite, size LeafCount, psk, commitSecret, context []byte) (keyScheduleEpoch, error) {
+	if suite != kse.Suite {
+		return keyScheduleEpoch{}, fmt.Errorf("Cipher suite mismatch %v != %v", suite, kse.Suite)
+	}
+
+	return kse.Next(size, psk, commitSecret, context)
+}
+
+// DeriveJoinerSecret computes the joiner secret for the epoch following one
+// with the given init secret.  This is the secret that a Welcome conveys to
+// new members, so it covers the init and commit secrets but not any PSK,
+// which the new members mix in themselves.
+func (cs CipherSuite) DeriveJoinerSecret(initSecret, commitSecret []byte) []byte {
+	return cs.hkdfExtract(initSecret, commitSecret)
+}
+
+// NextWithPSK derives the next epoch in the order given by the specification:
+// the joiner secret is derived from the init and commit secrets first, and the
+// PSK is only mixed in after that, so that members joining via Welcome and
+// existing members arrive at the same epoch secret.  Next mixes the PSK in
+// before the commit secret, and is kept as-is for compatibility with existing
+// groups; the two do not produce the same epochs.
+func (kse *keyScheduleEpoch) NextWithPSK(size LeafCount, pskIn, commitSecret, context []byte) (keyScheduleEpoch, error) {
+	psk := pskIn
+	if len(psk) == 0 {
+		psk = kse.Suite.zero()
+	}
+
+	joinerSecret := kse.Suite.DeriveJoinerSecret(kse.InitSecret, commitSecret)
+	memberSecret := kse.Suite.hkdfExtract(joinerSecret, psk)
+	epochSecret := kse.Suite.deriveSecret(memberSecret, "epoch", context)
+
+	next, err := newKeyScheduleEpochWithOptions(kse.Suite, size, epochSecret, context, kse.Options, kse.Config)
+	if err != nil {
+		return keyScheduleEpoch{}, err
+	}
+
+	next.joinerSecret = joinerSecret
+	next.welcomeSecret = kse.Suite.deriveSecret(memberSecret, "welcome", context)
+	zeroize(memberSecret)
+	next.setEpoch(kse.Epoch + 1)
+	return next, nil
+}
+
+// Set the epoch number, including on the key sources
+func (kse *keyScheduleEpoch) setEpoch(epoch Epoch) {
+	kse.Epoch = epoch
+	if kse.HandshakeKeys != nil {
+		kse.HandshakeKeys.Epoch = epoch
+	}
+	if kse.ApplicationKeys != nil {
+		kse.ApplicationKeys.Epoch = epoch
+	}
+}
+
+// ZeroSecret returns the commit secret for a commit without an update path
+// (e.g., one that only adds members), which is an all-zero string the size of
+// the suite's hash output.  NextChecked rejects it unless allowZeroCommit is
+// set.
+func ZeroSecret(suite CipherSuite) []byte {
+	return suite.zero()
+}
+
+// NextChecked is like Next, but first rejects inputs that are all zero, which
+// almost always means that a secret was never set or has already been erased:
+// an all-zero init secret (e.g., after EraseInit), and an all-zero commit
+// secret.  The protocol does use an all-zero commit secret for a commit
+// without a path (see ZeroSecret); pass allowZeroCommit in that case.  Both
+// secrets must also be the size of the suite's hash output, as HKDF-Extract
+// expects.
+func (kse *keyScheduleEpoch) NextChecked(size LeafCount, psk, commitSecret, context []byte, allowZeroCommit bool) (keyScheduleEpoch, error) {
+	secretSize := len(kse.Suite.zero())
+	if len(kse.InitSecret) != secretSize {
+		return keyScheduleEpoch{}, fmt.Errorf("Incorrect init secret length %d != %d", len(kse.InitSecret), secretSize)
+	}
+
+	if len(commitSecret) != secretSize {
+		return keyScheduleEpoch{}, fmt.Errorf("Incorrect commit secret length %d != %d", len(commitSecret), secretSize)
+	}
+
+	if isZero(kse.InitSecret) {
+		return keyScheduleEpoch{}, fmt.Errorf("All-zero init secret")
+	}
+
+	if isZero(commitSecret) && !allowZeroCommit {
+		return keyScheduleEpoch{}, fmt.Errorf("All-zero commit secret")
+	}
+
+	return kse.Next(size, psk, commitSecret, context)
+}
+
+// NextHandshakeKey returns this member's next handshake key, e.g., for a
+// Commit that it is about to broadcast
+func (kse *keyScheduleEpoch) NextHandshakeKey(self LeafIndex) (uint32, keyAndNonce, error) {
+	if !kse.Usable() {
+		return 0, keyAndNonce{}, ErrEpochErased
+	}
+
+	return kse.HandshakeKeys.Next(self)
+}
+
+// NextApplicationKey returns this member's next application key
+func (kse *keyScheduleEpoch) NextApplicationKey(self LeafIndex) (uint32, keyAndNonce, error) {
+	if !kse.Usable() {
+		return 0, keyAndNonce{}, ErrEpochErased
+	}
+
+	return kse.ApplicationKeys.Next(self)
+}
+
+// A SenderDecryptor holds one sender's handshake and application ratchets,
+// taken out of an epoch so that a worker can derive that sender's keys
+// without sharing any state with workers for other senders.
+type SenderDecryptor struct {
+	Sender      LeafIndex
+	Epoch       Epoch
+	Handshake   *hashRatchet
+	Application *hashRatchet
+}
+
+// HandshakeKey returns the sender's handshake key for a generation
+func (sd *SenderDecryptor) HandshakeKey(generation uint32) (keyAndNonce, error) {
+	return sd.Handshake.Get(generation)
+}
+
+// ApplicationKey returns the sender's application key for a generation
+func (sd *SenderDecryptor) ApplicationKey(generation uint32) (keyAndNonce, error) {
+	return sd.Application.Get(generation)
+}
+
+// SenderDecryptor moves the sender's ratchets out of the epoch and into a
+// decryptor of their own, creating them first if need be.  Afterwards, keys
+// for the sender must be obtained from the decryptor, which is not safe for
+// concurrent use itself, but can be used concurrently with the epoch and with
+// decryptors for other senders.  The epoch refuses to derive the sender's
+// keys from then on, with ErrSenderSplit, and can no longer be encoded.
+// Decryptors for all senders of interest should be split off before any of
+// them are handed to workers, since this method modifies the epoch.  Custom
+// ratchets can't be split off.
+func (kse *keyScheduleEpoch) SenderDecryptor(sender LeafIndex) (*SenderDecryptor, error) {
+	kse.HandshakeKeys.lock()
+	defer kse.HandshakeKeys.unlock()
+	kse.ApplicationKeys.lock()
+	defer kse.ApplicationKeys.unlock()
+
+	hs, err := kse.HandshakeKeys.ratchet(sender)
+	if err != nil {
+		return nil, err
+	}
+
+	app, err := kse.ApplicationKeys.ratchet(sender)
+	if err != nil {
+		return nil, err
+	}
+
+	hsHash, hsOK := hs.(*hashRatchet)
+	appHash, appOK := app.(*hashRatchet)
+	if !hsOK || !appOK {
+		return nil, fmt.Errorf("Cannot split off custom ratchets for sender %d", sender)
 	}
+
+	delete(kse.HandshakeRatchets, sender)
+	delete(kse.ApplicationRatchets, sender)
+	for _, keys := range []*groupKeySource{kse.HandshakeKeys, kse.ApplicationKeys} {
+		if keys.Split == nil {
+			keys.Split = map[LeafIndex]bool{}
+		}
+		keys.Split[sender] = true
+	}
+
+	return &SenderDecryptor{
+		Sender:      sender,
+		Epoch:       kse.Epoch,
+		Handshake:   hsHash,
+		Application: appHash,
+	}, nil
 }
 
-///
-/// Hash ratchet
-///
+// SenderDataKeyFor returns the key that protects sender data from the given
+// sender.  This is the epoch's SenderDataKey unless
+// KeyScheduleSenderDataPerSender is set.  It fails with ErrEpochErased once
+// the epoch has been erased.
+func (kse keyScheduleEpoch) SenderDataKeyFor(sender LeafIndex) ([]byte, error) {
+	if !kse.Usable() {
+		return nil, ErrEpochErased
+	}
 
-type hashRatchet struct {
-	Suite          CipherSuite
-	Node           NodeIndex
-	NextSecret     []byte `tls:"head=1"`
-	NextGeneration uint32
-	Cache          map[uint32]keyAndNonce `tls:"head=4"`
-	KeySize        uint32
-	NonceSize      uint32
-	SecretSize     uint32
+	if kse.Options&KeyScheduleSenderDataPerSender == 0 {
+		return kse.SenderDataKey, nil
+	}
+
+	if sender != MembershipSender && LeafCount(sender) >= maxLeafCount {
+		return nil, fmt.Errorf("Leaf %d out of range", sender)
+	}
+
+	suite := kse.senderDataSuite()
+	node := senderNode(sender)
+	nodeBytes := []byte{byte(node >> 24), byte(node >> 16), byte(node >> 8), byte(node)}
+	return suite.hkdfExpandLabel(kse.SenderDataSecret, "sd key", nodeBytes, suite.Constants().KeySize), nil
 }
 
-func newHashRatchet(suite CipherSuite, node NodeIndex, baseSecret []byte) *hashRatchet {
-	return &hashRatchet{
-		Suite:          suite,
-		Node:           node,
-		NextSecret:     baseSecret,
-		NextGeneration: 0,
-		Cache:          map[uint32]keyAndNonce{},
-		KeySize:        uint32(suite.Constants().KeySize),
-		NonceSize:      uint32(suite.Constants().NonceSize),
-		SecretSize:     uint32(suite.Constants().SecretSize),
+// The suite that sender data is protected with
+func (kse keyScheduleEpoch) senderDataSuite() CipherSuite {
+	if kse.SenderDataSuite == 0 {
+		return kse.Suite
 	}
+	return kse.SenderDataSuite
 }
 
-func (hr *hashRatchet) Next() (uint32, keyAndNonce) {
-	key := hr.Suite.deriveAppSecret(hr.NextSecret, "app-key", hr.Node, hr.NextGeneration, int(hr.KeySize))
-	nonce := hr.Suite.deriveAppSecret(hr.NextSecret, "app-nonce", hr.Node, hr.NextGeneration, int(hr.NonceSize))
-	secret := hr.Suite.deriveAppSecret(hr.NextSecret, "app-secret", hr.Node, hr.NextGeneration, int(hr.SecretSize))
+// UseSenderDataSuite switches the epoch to protecting sender data with a
+// different suite from its content, e.g., a lighter one, and derives the
+// sender data key again for that suite.  The sender data secret is still
+// derived with the epoch's own suite.  This is experimental, and all members
+// must make the same choice.
+func (kse *keyScheduleEpoch) UseSenderDataSuite(suite CipherSuite) error {
+	if !suite.supported() {
+		return fmt.Errorf("Unsupported sender data suite %v", suite)
+	}
 
-	generation := hr.NextGeneration
+	zeroize(kse.SenderDataKey)
+	kse.Config.secretZeroized("sender data key")
+	kse.SenderDataSuite = suite
+	kse.SenderDataKey = suite.hkdfExpandLabel(kse.SenderDataSecret, "sd key", []byte{}, suite.Constants().KeySize)
+	kse.Config.secretAllocated("sender data key")
+	return nil
+}
 
-	hr.NextGeneration += 1
-	zeroize(hr.NextSecret)
-	hr.NextSecret = secret
+// RotateSenderDataKey ratchets the sender data secret forward and derives a
+// new sender data key from it, without changing epochs.  This allows a group
+// with very high message volume to avoid exhausting the sender data nonce
+// space.  The previous secret and key are erased.  The returned version counts
+// rotations within the epoch; members must rotate to the same version to
+// agree on the key.  Rotation fails with ErrEpochErased once the epoch has been
+// erased.
+func (kse *keyScheduleEpoch) RotateSenderDataKey() (uint32, error) {
+	if !kse.Usable() {
+		return 0, ErrEpochErased
+	}
 
-	kn := keyAndNonce{key, nonce}
-	hr.Cache[generation] = kn
-	return generation, kn.clone()
+	secretSize := kse.Suite.Constants().SecretSize
+	keySuite := kse.senderDataSuite()
+	keySize := keySuite.Constants().KeySize
+
+	nextSecret := kse.Suite.hkdfExpandLabel(kse.SenderDataSecret, "sd rotate", []byte{}, secretSize)
+	zeroize(kse.SenderDataSecret)
+	zeroize(kse.SenderDataKey)
+	kse.Config.secretZeroized("sender data")
+	kse.Config.secretZeroized("sender data key")
+
+	kse.SenderDataSecret = nextSecret
+	kse.SenderDataKey = keySuite.hkdfExpandLabel(nextSecret, "sd key", []byte{}, keySize)
+	kse.Config.secretAllocated("sender data")
+	kse.Config.secretAllocated("sender data key")
+	kse.SenderDataVersion += 1
+	return kse.SenderDataVersion, nil
 }
 
-func (hr *hashRatchet) Get(generation uint32) (keyAndNonce, error) {
-	if kn, ok := hr.Cache[generation]; ok {
-		return kn, nil
+// SenderDataKeyForVersion derives the sender data key for a later version
+// than the epoch's own, for decrypting a message from a sender who has
+// already rotated that far, without rotating the epoch itself.  Earlier
+// versions can't be derived, since their secrets are erased on rotation, and
+// versions more than the config's MaxGenerationSkip ahead are refused, as for
+// ratchets.
+func (kse keyScheduleEpoch) SenderDataKeyForVersion(version uint32) ([]byte, error) {
+	if !kse.Usable() {
+		return nil, ErrEpochErased
 	}
 
-	if hr.NextGeneration > generation {
-		return keyAndNonce{}, fmt.Errorf("Request for expired key")
+	if version < kse.SenderDataVersion {
+		return nil, fmt.Errorf("Sender data key version %d has been erased (current %d)", version, kse.SenderDataVersion)
 	}
 
-	for hr.NextGeneration < generation {
-		hr.Next()
+	if version-kse.SenderDataVersion > kse.Config.maxGenerationSkip() {
+		return nil, fmt.Errorf("Sender data key version %d too far ahead of %d", version, kse.SenderDataVersion)
 	}
 
-	_, kn := hr.Next()
-	return kn, nil
+	if version == kse.SenderDataVersion {
+		return dup(kse.SenderDataKey), nil
+	}
+
+	secretSize := kse.Suite.Constants().SecretSize
+	secret := dup(kse.SenderDataSecret)
+	for v := kse.SenderDataVersion; v < version; v += 1 {
+		next := kse.Suite.hkdfExpandLabel(secret, "sd rotate", []byte{}, secretSize)
+		zeroize(secret)
+		secret = next
+	}
+
+	keySuite := kse.senderDataSuite()
+	key := keySuite.hkdfExpandLabel(secret, "sd key", []byte{}, keySuite.Constants().KeySize)
+	zeroize(secret)
+	return key, nil
 }
 
-func (hr *hashRatchet) Erase(generation uint32) {
-	if _, ok := hr.Cache[generation]; !ok {
-		return
+// PreviewNext derives the epoch that would follow this one, without modifying
+// the receiver, so that the result can be checked (e.g., against a
+// confirmation tag) before it is adopted.  Calling the returned function
+// installs the previewed epoch in place of the receiver.  To roll back, drop
+// the preview without calling it.  Until it is applied, the preview is not
+// checked for epoch secret reuse and its secrets are not reported to the
+// config's hooks, so a preview that is dropped leaves no trace there.
+func (kse *keyScheduleEpoch) PreviewNext(size LeafCount, updateSecret, context []byte) (keyScheduleEpoch, func(), error) {
+	epochSecret := kse.nextEpochSecret(nil, updateSecret, context)
+	next, err := deriveKeyScheduleEpoch(kse.Suite, size, epochSecret, context, kse.Options, kse.Config)
+	if err != nil {
+		return keyScheduleEpoch{}, nil, err
 	}
+	next.setEpoch(kse.Epoch + 1)
 
-	zeroize(hr.Cache[generation].Key)
-	zeroize(hr.Cache[generation].Nonce)
-	delete(hr.Cache, generation)
+	apply := func() {
+		checkEpochSecretReuse(next.Suite, next.EpochSecret, next.Config)
+		next.reportAllocated()
+		*kse = next
+	}
+	return next, apply, nil
 }
 
-///
-/// Base key sources
-///
+// CurrentEpoch returns the number of the epoch these keys belong to.  Epochs
+// created directly from an epoch secret start at zero unless the caller sets
+// the epoch explicitly, and each call to Next increments it.
+func (kse keyScheduleEpoch) CurrentEpoch() Epoch {
+	return kse.Epoch
+}
 
-type baseKeySource interface {
-	Suite() CipherSuite
-	Get(sender LeafIndex) []byte
+// Write a human-readable view of the epoch's ratchet state.  Maps are walked in
+// sorted order, so the same state always produces the same output.
+func (kse *keyScheduleEpoch) dump(w io.Writer) {
+	fmt.Fprintf(w, "=== epoch %v ===\n", kse.Suite)
+	kse.ApplicationBaseKeys.dumpTo(w)
+	fmt.Fprintln(w, "=== handshake ratchets ===")
+	kse.HandshakeKeys.dump(w)
+	fmt.Fprintln(w, "=== application ratchets ===")
+	kse.ApplicationKeys.dump(w)
 }
 
-type noFSBaseKeySource struct {
-	CipherSuite CipherSuite
-	RootSecret  []byte `tls:"head=1"`
+// Non-secret metadata about an epoch, for diagnostics export.  This is separate
+// from the TLS encoding, and must never carry secret values.
+type ratchetDiagnostics struct {
+	Sender         LeafIndex `json:"sender"`
+	NextGeneration uint32    `json:"next_generation"`
+	CachedKeys     int       `json:"cached_keys"`
 }
 
-func newNoFSBaseKeySource(suite CipherSuite, rootSecret []byte) *noFSBaseKeySource {
-	return &noFSBaseKeySource{suite, rootSecret}
+type epochDiagnostics struct {
+	CipherSuite         string               `json:"cipher_suite"`
+	TreeSize            LeafCount            `json:"tree_size"`
+	TreeSecrets         int                  `json:"tree_secrets"`
+	HandshakeRatchets   []ratchetDiagnostics `json:"handshake_ratchets"`
+	ApplicationRatchets []ratchetDiagnostics `json:"application_ratchets"`
 }
 
-func (nfbks *noFSBaseKeySource) Suite() CipherSuite {
-	return nfbks.CipherSuite
+func ratchetDiagnosticsFor(ratchets map[LeafIndex]*hashRatchet) []ratchetDiagnostics {
+	out := []ratchetDiagnostics{}
+	for _, sender := range sortedSenders(ratchets) {
+		r := ratchets[sender]
+		out = append(out, ratchetDiagnostics{
+			Sender:         sender,
+			NextGeneration: r.NextGeneration,
+			CachedKeys:     len(r.Cache),
+		})
+	}
+	return out
 }
 
-func (nfbks *noFSBaseKeySource) Get(sender LeafIndex) []byte {
-	secretSize := nfbks.CipherSuite.Constants().SecretSize
-	return nfbks.CipherSuite.deriveAppSecret(nfbks.RootSecret, "hs-secret", toNodeIndex(sender), 0, secretSize)
+func (kse keyScheduleEpoch) MarshalJSON() ([]byte, error) {
+	diag := epochDiagnostics{
+		CipherSuite:         kse.Suite.String(),
+		HandshakeRatchets:   ratchetDiagnosticsFor(kse.HandshakeRatchets),
+		ApplicationRatchets: ratchetDiagnosticsFor(kse.ApplicationRatchets),
+	}
+
+	if kse.ApplicationBaseKeys != nil {
+		diag.TreeSize = kse.ApplicationBaseKeys.Size
+		diag.TreeSecrets = len(kse.ApplicationBaseKeys.Secrets)
+	}
+
+	return json.Marshal(diag)
 }
 
-type Bytes1 []byte
+// The secrets of an epoch, as hex strings under the names this draft gives
+// them.  Unlike epochDiagnostics, this is meant to carry secrets.  It only
+// holds the secrets the draft derives, so it is not the RFC test-vector
+// schema; the joiner and welcome secrets are left out when they are unknown.
+type epochTestVector struct {
+	CipherSuite  CipherSuite `json:"cipher_suite"`
+	Epoch        Epoch       `json:"epoch"`
+	GroupContext string      `json:"group_context"`
+	EpochSecret  string      `json:"epoch_secret"`
 
-func (b Bytes1) MarshalTLS() ([]byte, error) {
-	return syntax.Marshal(struct {
-		Data []byte `tls:"head=1"`
-	}{b})
+	JoinerSecret         string `json:"joiner_secret,omitempty"`
+	WelcomeSecret        string `json:"welcome_secret,omitempty"`
+	InitSecret           string `json:"init_secret"`
+	SenderDataSecret     string `json:"sender_data_secret"`
+	HandshakeSecret      string `json:"handshake_secret"`
+	ApplicationSecret    string `json:"application_secret"`
+	ExporterSecret       string `json:"exporter_secret"`
+	ConfirmationKey      string `json:"confirmation_key"`
+	MembershipKey        string `json:"membership_key"`
+	ExternalSenderSecret string `json:"external_sender_secret"`
 }
 
-func (b *Bytes1) UnmarshalTLS(data []byte) (int, error) {
-	tmp := struct {
-		Data []byte `tls:"head=1"`
-	}{}
-	read, err := syntax.Unmarshal(data, &tmp)
-	if err != nil {
-		return read, err
+// ToTestVector renders the epoch's secrets as a JSON test vector, for
+// comparison against other implementations of this draft.  The output
+// contains every secret of the epoch in the clear, so it must only be used
+// with test keys.  The labeled secrets are those of epochSecretLabels, each in
+// the vector field of the same name.  The joiner and welcome secrets are only
+// known for an epoch derived with NextWithPSK, and are otherwise left out.  An
+// erased epoch has no secrets to render, and fails with ErrEpochErased.
+func (kse keyScheduleEpoch) ToTestVector() ([]byte, error) {
+	if !kse.Usable() {
+		return nil, ErrEpochErased
 	}
 
-	*b = dup(tmp.Data)
-	return read, nil
-}
+	tv := epochTestVector{
+		CipherSuite:  kse.Suite,
+		Epoch:        kse.Epoch,
+		GroupContext: hex.EncodeToString(kse.GroupContext),
+		EpochSecret:  hex.EncodeToString(kse.EpochSecret),
+	}
+	if kse.joinerSecret != nil {
+		tv.JoinerSecret = hex.EncodeToString(kse.joinerSecret)
+		tv.WelcomeSecret = hex.EncodeToString(kse.welcomeSecret)
+	}
 
-type treeBaseKeySource struct {
-	CipherSuite CipherSuite
-	SecretSize  uint32
-	Root        NodeIndex
-	Size        LeafCount
-	Secrets     map[NodeIndex]Bytes1 `tls:"head=4"`
+	epoch := reflect.ValueOf(kse)
+	vector := reflect.ValueOf(&tv).Elem()
+	for _, entry := range epochSecretLabels {
+		secret := epoch.FieldByName(entry.Field).Bytes()
+		vector.FieldByName(entry.Field).SetString(hex.EncodeToString(secret))
+	}
+
+	return json.Marshal(tv)
 }
 
-func newTreeBaseKeySource(suite CipherSuite, size LeafCount, rootSecret []byte) *treeBaseKeySource {
-	tbks := &treeBaseKeySource{
-		CipherSuite: suite,
-		SecretSize:  uint32(suite.Constants().SecretSize),
-		Root:        root(size),
-		Size:        size,
-		Secrets:     map[NodeIndex]Bytes1{},
+// Project derives the sequence of epochs that follow this one, given the
+// commit secret, group context, and group size for each step.  It is a
+// convenience for replaying a known transcript; the receiver is not modified.
+// The input slices must have the same length.  Projection stops at the first
+// epoch that can't be derived.
+func (kse *keyScheduleEpoch) Project(commitSecrets, contexts [][]byte, sizes []LeafCount) ([]keyScheduleEpoch, error) {
+	if len(contexts) != len(commitSecrets) || len(sizes) != len(commitSecrets) {
+		return nil, fmt.Errorf("Mismatched projection inputs %d %d %d", len(commitSecrets), len(contexts), len(sizes))
 	}
 
-	tbks.Secrets[tbks.Root] = rootSecret
-	return tbks
+	epochs := make([]keyScheduleEpoch, len(commitSecrets))
+	prev := kse
+	for i := range commitSecrets {
+		var err error
+		epochs[i], err = prev.Next(sizes[i], nil, commitSecrets[i], contexts[i])
+		if err != nil {
+			return nil, err
+		}
+		prev = &epochs[i]
+	}
+	return epochs, nil
 }
 
-func (tbks *treeBaseKeySource) Suite() CipherSuite {
-	return tbks.CipherSuite
+// ActiveSenders lists, in order, the senders that have handshake ratchets and
+// those that have application ratchets, i.e., the members whose keys have
+// been derived in this epoch.
+func (kse keyScheduleEpoch) ActiveSenders() ([]LeafIndex, []LeafIndex) {
+	return sortedSenders(kse.HandshakeRatchets), sortedSenders(kse.ApplicationRatchets)
 }
 
-func (tbks *treeBaseKeySource) Get(sender LeafIndex) []byte {
-	// Find an ancestor that is populated
-	senderNode := toNodeIndex(sender)
-	d := dirpath(senderNode, tbks.Size)
-	d = append([]NodeIndex{senderNode}, d...)
-	found := false
-	curr := 0
-	for i, node := range d {
-		if _, ok := tbks.Secrets[node]; ok {
-			found = true
-			curr = i
-			break
-		}
+// ApproxMemoryBytes estimates how much memory the epoch's secrets occupy: the
+// epoch-level secrets, the populated nodes of the secret trees, and every
+// ratchet's next secret and cached keys.  Map and struct overhead is not
+// counted, while a buffer shared between fields (e.g., a tree's root and the
+// secret it was built from) is counted for each, so this is only a rough
+// figure, intended for capacity planning.
+func (kse keyScheduleEpoch) ApproxMemoryBytes() int {
+	total := 0
+	for _, secret := range [][]byte{
+		kse.GroupContext,
+		kse.EpochSecret,
+		kse.SenderDataSecret,
+		kse.SenderDataKey,
+		kse.HandshakeSecret,
+		kse.ApplicationSecret,
+		kse.ExporterSecret,
+		kse.ConfirmationKey,
+		kse.InitSecret,
+		kse.ExternalSenderSecret,
+		kse.MembershipKey,
+	} {
+		total += len(secret)
 	}
 
-	if !found {
-		panic("Unable to find source for base key")
+	if kse.HandshakeBaseKeys != nil {
+		total += len(kse.HandshakeBaseKeys.RootSecret)
 	}
 
-	// Derive down
-	for ; curr > 0; curr -= 1 {
-		node := d[curr]
-		L := left(node)
-		R := right(node, tbks.Size)
+	for _, tbks := range []*treeBaseKeySource{kse.ApplicationBaseKeys, kse.HandshakeTreeBaseKeys} {
+		if tbks == nil {
+			continue
+		}
 
-		secret := tbks.Secrets[node]
-		tbks.Secrets[L] = tbks.CipherSuite.deriveAppSecret(secret, "tree", L, 0, int(tbks.SecretSize))
-		tbks.Secrets[R] = tbks.CipherSuite.deriveAppSecret(secret, "tree", R, 0, int(tbks.SecretSize))
-		zeroize(tbks.Secrets[node])
-		delete(tbks.Secrets, node)
+		for _, secret := range tbks.Secrets {
+			total += len(secret)
+		}
 	}
 
-	// Copy and return the leaf
-	out := dup(tbks.Secrets[senderNode])
-	zeroize(tbks.Secrets[senderNode])
-	delete(tbks.Secrets, senderNode)
-	return out
-}
+	ratchets := []*hashRatchet{}
+	for _, r := range kse.HandshakeRatchets {
+		ratchets = append(ratchets, r)
+	}
+	for _, r := range kse.ApplicationRatchets {
+		ratchets = append(ratchets, r)
+	}
+	for _, r := range kse.ExternalRatchets {
+		ratchets = append(ratchets, r)
+	}
 
-func (tbks *treeBaseKeySource) dump() {
-	w := nodeWidth(tbks.Size)
-	fmt.Println("=== tbks ===")
-	for i := NodeIndex(0); i < NodeIndex(w); i += 1 {
-		s, ok := tbks.Secrets[i]
-		if ok {
-			fmt.Printf("  %3x [%x]\n", i, s)
-		} else {
-			fmt.Printf("  %3x _\n", i)
+	for _, r := range ratchets {
+		total += len(r.NextSecret)
+		for _, kn := range r.Cache {
+			total += len(kn.Key) + len(kn.Nonce)
+		}
+		for _, nonce := range r.PendingNonces {
+			total += len(nonce)
 		}
 	}
+
+	return total
 }
 
-///
-/// Group key source
-///
+// ConvergesWith checks that two members hold the same view of an epoch, i.e.,
+// that every secret derived from the epoch secret matches.  It returns an
+// error naming the first value that differs.
+func (kse keyScheduleEpoch) ConvergesWith(other keyScheduleEpoch) error {
+	if kse.Suite != other.Suite {
+		return fmt.Errorf("Cipher suite mismatch %v != %v", kse.Suite, other.Suite)
+	}
 
-type groupKeySource struct {
-	Base     baseKeySource
-	Ratchets map[LeafIndex]*hashRatchet
-}
+	if kse.Epoch != other.Epoch {
+		return fmt.Errorf("Epoch mismatch %d != %d", kse.Epoch, other.Epoch)
+	}
 
-func (gks groupKeySource) ratchet(sender LeafIndex) *hashRatchet {
-	if r, ok := gks.Ratchets[sender]; ok {
-		return r
+	values := []struct {
+		name string
+		a, b []byte
+	}{
+		{"group context", kse.GroupContext, other.GroupContext},
+		{"epoch secret", kse.EpochSecret, other.EpochSecret},
+		{"sender data secret", kse.SenderDataSecret, other.SenderDataSecret},
+		{"sender data key", kse.SenderDataKey, other.SenderDataKey},
+		{"handshake secret", kse.HandshakeSecret, other.HandshakeSecret},
+		{"application secret", kse.ApplicationSecret, other.ApplicationSecret},
+		{"exporter secret", kse.ExporterSecret, other.ExporterSecret},
+		{"confirmation key", kse.ConfirmationKey, other.ConfirmationKey},
+		{"init secret", kse.InitSecret, other.InitSecret},
+		{"external sender secret", kse.ExternalSenderSecret, other.ExternalSenderSecret},
+		{"membership key", kse.MembershipKey, other.MembershipKey},
+	}
+	for _, v := range values {
+		if !bytes.Equal(v.a, v.b) {
+			return fmt.Errorf("Mismatched %s", v.name)
+		}
 	}
 
-	baseSecret := gks.Base.Get(sender)
-	gks.Ratchets[sender] = newHashRatchet(gks.Base.Suite(), toNodeIndex(sender), baseSecret)
-	return gks.Ratchets[sender]
-}
+	if !kse.HandshakeBaseKeys.Equal(other.HandshakeBaseKeys) {
+		return fmt.Errorf("Mismatched handshake base keys")
+	}
 
-func (gks groupKeySource) Next(sender LeafIndex) (uint32, keyAndNonce) {
-	return gks.ratchet(sender).Next()
+	return nil
 }
 
-func (gks groupKeySource) Get(sender LeafIndex, generation uint32) (keyAndNonce, error) {
-	return gks.ratchet(sender).Get(generation)
-}
+// SharesSecretWith reports whether any secret of this epoch is equal to any
+// secret of the other, e.g., to assert in tests that two epochs or groups never
+// reuse key material.  Secrets are compared in constant time.  Secrets that
+// have been erased are skipped, since they are all zero.
+func (kse keyScheduleEpoch) SharesSecretWith(other keyScheduleEpoch) bool {
+	live := func(secrets []namedSecret) [][]byte {
+		out := [][]byte{}
+		for _, secret := range secrets {
+			if len(secret.Secret) > 0 && !isZero(secret.Secret) {
+				out = append(out, secret.Secret)
+			}
+		}
+		return out
+	}
 
-func (gks groupKeySource) Erase(sender LeafIndex, generation uint32) {
-	gks.ratchet(sender).Erase(generation)
-}
+	mine := live(append(kse.namedSecrets(), namedSecret{"init", kse.InitSecret}))
+	theirs := live(append(other.namedSecrets(), namedSecret{"init", other.InitSecret}))
 
-///
-/// GroupInfo keys
-///
+	shared := 0
+	for _, a := range mine {
+		for _, b := range theirs {
+			shared |= subtle.ConstantTimeCompare(a, b)
+		}
+	}
 
-func groupInfoKeyAndNonce(suite CipherSuite, epochSecret []byte) keyAndNonce {
-	secretSize := suite.Constants().SecretSize
-	keySize := suite.Constants().KeySize
-	nonceSize := suite.Constants().NonceSize
+	return shared == 1
+}
 
-	groupInfoSecret := suite.hkdfExpandLabel(epochSecret, "group info", []byte{}, secretSize)
-	groupInfoKey := suite.hkdfExpandLabel(groupInfoSecret, "key", []byte{}, keySize)
-	groupInfoNonce := suite.hkdfExpandLabel(groupInfoSecret, "nonce", []byte{}, nonceSize)
+// One commit applied to an epoch, for driving convergence checks
+type epochStep struct {
+	CommitSecret []byte
+	Context      []byte
+	Size         LeafCount
+}
 
-	return keyAndNonce{
-		Key:   groupInfoKey,
-		Nonce: groupInfoNonce,
+// convergeEpochs advances two members' epochs through their respective
+// sequences of commits, checking after each step that they still agree.  Step
+// zero is the starting epochs.  The first divergence is reported along with
+// the index of the step at which it occurred.
+func convergeEpochs(a, b keyScheduleEpoch, stepsA, stepsB []epochStep) error {
+	if len(stepsA) != len(stepsB) {
+		return fmt.Errorf("Mismatched step counts %d != %d", len(stepsA), len(stepsB))
 	}
-}
 
-///
-/// Key schedule epoch
-///
+	if err := a.ConvergesWith(b); err != nil {
+		return fmt.Errorf("Divergence at step 0: %v", err)
+	}
 
-type keyScheduleEpoch struct {
-	Suite        CipherSuite
-	GroupContext []byte `tls:"head=1"`
+	for i := range stepsA {
+		var err error
+		if a, err = a.Next(stepsA[i].Size, nil, stepsA[i].CommitSecret, stepsA[i].Context); err != nil {
+			return fmt.Errorf("Failed to advance at step %d: %v", i+1, err)
+		}
+		if b, err = b.Next(stepsB[i].Size, nil, stepsB[i].CommitSecret, stepsB[i].Context); err != nil {
+			return fmt.Errorf("Failed to advance at step %d: %v", i+1, err)
+		}
+		if err := a.ConvergesWith(b); err != nil {
+			return fmt.Errorf("Divergence at step %d: %v", i+1, err)
+		}
+	}
 
-	EpochSecret       []byte `tls:"head=1"`
-	SenderDataSecret  []byte `tls:"head=1"`
-	SenderDataKey     []byte `tls:"head=1"`
-	HandshakeSecret   []byte `tls:"head=1"`
-	ApplicationSecret []byte `tls:"head=1"`
-	ExporterSecret    []byte `tls:"head=1"`
-	ConfirmationKey   []byte `tls:"head=1"`
-	InitSecret        []byte `tls:"head=1"`
+	return nil
+}
 
-	HandshakeBaseKeys   *noFSBaseKeySource
-	ApplicationBaseKeys *treeBaseKeySource
+// PRF computes an HMAC over the message with a key derived from the epoch
+// secret and the label, for applications that need a keyed MAC bound to the
+// epoch (e.g., for custom tokens).  Unlike Export, the output is a MAC over
+// caller-supplied data, not key material.  It fails with ErrEpochErased once the
+// epoch has been erased.
+func (kse *keyScheduleEpoch) PRF(label string, message []byte) ([]byte, error) {
+	if !kse.Usable() {
+		return nil, ErrEpochErased
+	}
 
-	HandshakeRatchets   map[LeafIndex]*hashRatchet `tls:"head=4"`
-	ApplicationRatchets map[LeafIndex]*hashRatchet `tls:"head=4"`
+	secretSize := kse.Suite.Constants().SecretSize
+	key := kse.Suite.hkdfExpandLabel(kse.EpochSecret, "prf", []byte(label), secretSize)
+	defer zeroize(key)
 
-	ApplicationKeys *groupKeySource `tls:"omit"`
-	HandshakeKeys   *groupKeySource `tls:"omit"`
+	mac := kse.Suite.NewHMAC(key)
+	mac.Write(message)
+	return mac.Sum(nil), nil
 }
 
-func newKeyScheduleEpoch(suite CipherSuite, size LeafCount, epochSecret, context []byte) keyScheduleEpoch {
-	senderDataSecret := suite.deriveSecret(epochSecret, "sender data", context)
-	handshakeSecret := suite.deriveSecret(epochSecret, "handshake", context)
-	applicationSecret := suite.deriveSecret(epochSecret, "app", context)
-	exporterSecret := suite.deriveSecret(epochSecret, "exporter", context)
-	confirmationKey := suite.deriveSecret(epochSecret, "confirm", context)
-	initSecret := suite.deriveSecret(epochSecret, "init", context)
+// SignatureContext returns a value unique to this epoch, for profiles that bind
+// handshake message signatures to the epoch by including it in the
+// to-be-signed content.  A signature made over one epoch's context cannot be
+// replayed into another.  Like PRF, it is derived from the epoch secret, and so
+// fails with ErrEpochErased after EraseExceptInit.
+func (kse *keyScheduleEpoch) SignatureContext() ([]byte, error) {
+	if !kse.Usable() {
+		return nil, ErrEpochErased
+	}
+
+	return kse.Suite.deriveSecret(kse.EpochSecret, "signature context", kse.GroupContext), nil
+}
 
-	senderDataKey := suite.hkdfExpandLabel(senderDataSecret, "sd key", []byte{}, suite.Constants().KeySize)
-	handshakeBaseKeys := newNoFSBaseKeySource(suite, handshakeSecret)
-	applicationBaseKeys := newTreeBaseKeySource(suite, size, applicationSecret)
+// Export derives a secret for use outside of MLS from the exporter secret.  It
+// fails with ErrEpochErased once the epoch has been erased.
+func (kse *keyScheduleEpoch) Export(label string, context []byte, keyLength int) ([]byte, error) {
+	if !kse.Usable() {
+		return nil, ErrEpochErased
+	}
 
-	kse := keyScheduleEpoch{
-		Suite:        suite,
-		GroupContext: context,
+	exporterBase := kse.Suite.deriveSecret(kse.ExporterSecret, label, kse.GroupContext)
+	hctx := kse.Suite.Digest(context)
+	return kse.Suite.hkdfExpandLabel(exporterBase, "exporter", hctx, keyLength), nil
+}
 
-		EpochSecret:       epochSecret,
-		SenderDataSecret:  senderDataSecret,
-		SenderDataKey:     senderDataKey,
-		HandshakeSecret:   handshakeSecret,
-		ApplicationSecret: applicationSecret,
-		ExporterSecret:    exporterSecret,
-		ConfirmationKey:   confirmationKey,
-		InitSecret:        initSecret,
+// ExportExternalInit is the joiner's side of an external commit.  It chooses a
+// fresh init secret and encrypts it to the group's external public key, bound
+// to the group context of the epoch being joined.  The joiner uses the init
+// secret to derive the next epoch, and sends the ciphertext to the group.
+func ExportExternalInit(suite CipherSuite, externalPub []byte, context []byte) ([]byte, []byte, error) {
+	initSecret := make([]byte, suite.Constants().SecretSize)
+	if _, err := rand.Read(initSecret); err != nil {
+		return nil, nil, err
+	}
 
-		HandshakeBaseKeys:   handshakeBaseKeys,
-		ApplicationBaseKeys: applicationBaseKeys,
+	ct, err := suite.hpke().Encrypt(HPKEPublicKey{externalPub}, context, initSecret)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		HandshakeRatchets:   map[LeafIndex]*hashRatchet{},
-		ApplicationRatchets: map[LeafIndex]*hashRatchet{},
+	ctData, err := syntax.Marshal(ct)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	kse.enableKeySources()
-	return kse
+	return initSecret, ctData, nil
 }
 
-// Wire up the key sources as logic on top of data owned by the epoch
-func (kse *keyScheduleEpoch) enableKeySources() {
-	kse.HandshakeKeys = &groupKeySource{kse.HandshakeBaseKeys, kse.HandshakeRatchets}
-	kse.ApplicationKeys = &groupKeySource{kse.ApplicationBaseKeys, kse.ApplicationRatchets}
-}
+// ImportExternalInit is the group's side of an external commit.  It decrypts
+// the init secret chosen by the joiner with the external private key, and
+// installs it in place of the epoch's own init secret, so that the next epoch
+// is derived from it.  A copy of the init secret is also returned, which the
+// caller may zeroize without affecting the epoch.
+func (kse *keyScheduleEpoch) ImportExternalInit(ciphertext []byte, priv []byte) ([]byte, error) {
+	var ct HPKECiphertext
+	read, err := syntax.Unmarshal(ciphertext, &ct)
+	if err != nil {
+		return nil, err
+	}
 
-func (kse *keyScheduleEpoch) Next(size LeafCount, pskIn, commitSecret, context []byte) keyScheduleEpoch {
-	psk := pskIn
-	if len(psk) == 0 {
-		psk = kse.Suite.zero()
+	if read != len(ciphertext) {
+		return nil, fmt.Errorf("Extra data after external init ciphertext")
 	}
 
-	earlySecret := kse.Suite.hkdfExtract(psk, kse.InitSecret)
-	preEpochSecret := kse.Suite.deriveSecret(earlySecret, "derived", context)
-	epochSecret := kse.Suite.hkdfExtract(commitSecret, preEpochSecret)
-	return newKeyScheduleEpoch(kse.Suite, size, epochSecret, context)
-}
+	initSecret, err := kse.Suite.hpke().Decrypt(HPKEPrivateKey{Data: priv}, kse.GroupContext, ct)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt external init secret: %v", err)
+	}
 
-func (kse *keyScheduleEpoch) Export(label string, context []byte, keyLength int) []byte {
-	exporterBase := kse.Suite.deriveSecret(kse.ExporterSecret, label, kse.GroupContext)
-	hctx := kse.Suite.Digest(context)
-	return kse.Suite.hkdfExpandLabel(exporterBase, "exporter", hctx, keyLength)
+	secretSize := kse.Suite.Constants().SecretSize
+	if len(initSecret) != secretSize {
+		return nil, fmt.Errorf("Incorrect external init secret length %d != %d", len(initSecret), secretSize)
+	}
+
+	zeroize(kse.InitSecret)
+	kse.Config.secretZeroized("init")
+	kse.InitSecret = initSecret
+	kse.Config.secretAllocated("init")
+	return dup(initSecret), nil
 }
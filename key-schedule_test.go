@@ -2,8 +2,19 @@ package mls
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cisco/go-tls-syntax"
 	"github.com/stretchr/testify/require"
@@ -15,7 +26,8 @@ import (
 func TestTreeBaseKeySource(t *testing.T) {
 	size := LeafCount(11)
 	root := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
-	tbks := newTreeBaseKeySource(P256_SHA256_AES128GCM, size, root)
+	tbks, err := newTreeBaseKeySource(P256_SHA256_AES128GCM, size, root)
+	require.Nil(t, err)
 	for i := LeafIndex(0); i < LeafIndex(size); i += 1 {
 		tbks.Get(i)
 		tbks.dump()
@@ -41,88 +53,3176 @@ func TestKeySchedule(t *testing.T) {
 	commitSecret2 := unhex("404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f")
 	context2 := []byte("second")
 
-	exportSize := 128
-	targetGeneration := uint32(3)
+	exportSize := 128
+	targetGeneration := uint32(3)
+
+	checkEpoch := func(epoch *keyScheduleEpoch, size LeafCount) {
+		require.Equal(t, epoch.Suite, suite)
+		require.Equal(t, len(epoch.EpochSecret), secretSize)
+		require.Equal(t, len(epoch.SenderDataSecret), secretSize)
+		require.Equal(t, len(epoch.SenderDataKey), keySize)
+		require.Equal(t, len(epoch.HandshakeSecret), secretSize)
+		require.Equal(t, len(epoch.ApplicationSecret), secretSize)
+		require.Equal(t, len(epoch.ExporterSecret), secretSize)
+		require.Equal(t, len(epoch.ConfirmationKey), secretSize)
+		require.Equal(t, len(epoch.InitSecret), secretSize)
+		require.NotNil(t, epoch.HandshakeKeys)
+		require.NotNil(t, epoch.HandshakeKeys)
+
+		exportedKey, err := epoch.Export("test", []byte{0, 1, 2, 3}, exportSize)
+		require.Nil(t, err)
+		require.Equal(t, len(exportedKey), exportSize)
+
+		for i := LeafIndex(0); i < LeafIndex(size); i += 1 {
+			// Test successful generation
+			hs, err := epoch.HandshakeKeys.Get(i, targetGeneration)
+			require.Nil(t, err)
+			require.Equal(t, len(hs.Key), keySize)
+			require.Equal(t, len(hs.Nonce), nonceSize)
+
+			app, err := epoch.ApplicationKeys.Get(i, targetGeneration)
+			require.Nil(t, err)
+			require.Equal(t, len(app.Key), keySize)
+			require.Equal(t, len(app.Nonce), nonceSize)
+
+			err = epoch.HandshakeKeys.Erase(i, targetGeneration)
+			require.Nil(t, err)
+			err = epoch.ApplicationKeys.Erase(i, targetGeneration)
+			require.Nil(t, err)
+
+			// Test forward secrecy
+			_, err = epoch.HandshakeKeys.Get(i, targetGeneration)
+			require.Error(t, err)
+
+			_, err = epoch.ApplicationKeys.Get(i, targetGeneration)
+			require.Error(t, err)
+		}
+	}
+
+	epoch1, err := newKeyScheduleEpoch(suite, size1, epochSecret1, context1)
+	require.Nil(t, err)
+	checkEpoch(&epoch1, size1)
+
+	epoch2, err := epoch1.Next(size2, psk2, commitSecret2, context2)
+	require.Nil(t, err)
+	checkEpoch(&epoch2, size2)
+
+	// Check that marshal/unmarshal works
+	epoch2m, err := syntax.Marshal(epoch2)
+	require.Nil(t, err)
+
+	var epoch2u keyScheduleEpoch
+	_, err = syntax.Unmarshal(epoch2m, &epoch2u)
+	require.Nil(t, err)
+
+	epoch2u.enableKeySources()
+
+	// Verify that the contents match (not the group key generators)
+	require.Equal(t, epoch2.Suite, epoch2u.Suite)
+	require.Equal(t, epoch2.EpochSecret, epoch2u.EpochSecret)
+	require.Equal(t, epoch2.SenderDataSecret, epoch2u.SenderDataSecret)
+	require.Equal(t, epoch2.SenderDataKey, epoch2u.SenderDataKey)
+	require.Equal(t, epoch2.HandshakeSecret, epoch2u.HandshakeSecret)
+	require.Equal(t, epoch2.ApplicationSecret, epoch2u.ApplicationSecret)
+	require.Equal(t, epoch2.ConfirmationKey, epoch2u.ConfirmationKey)
+	require.Equal(t, epoch2.InitSecret, epoch2u.InitSecret)
+	require.Equal(t, epoch2.HandshakeBaseKeys, epoch2u.HandshakeBaseKeys)
+	require.Equal(t, epoch2.ApplicationBaseKeys, epoch2u.ApplicationBaseKeys)
+	require.Equal(t, epoch2.HandshakeRatchets, epoch2u.HandshakeRatchets)
+	require.Equal(t, epoch2.ApplicationRatchets, epoch2u.ApplicationRatchets)
+
+	// Verify that we can't get a key for the target generation (because it's
+	// already consumed)
+	_, err = epoch2u.HandshakeKeys.Get(0, targetGeneration)
+	require.Error(t, err)
+
+	// Verify that we can get one for the next epoch, and it's the same as the
+	// original key schedule would have produced
+	_, err = epoch2u.HandshakeKeys.Get(0, targetGeneration+1)
+	require.Nil(t, err)
+}
+
+func TestHashRatchetLabels(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	app := newHashRatchet(suite, 2, dup(baseSecret))
+	explicit := newHashRatchetWithLabels(suite, 2, dup(baseSecret), "app")
+	hs := newHashRatchetWithLabels(suite, 2, dup(baseSecret), "hs")
+	require.Equal(t, hs.KeyLabel, []byte("hs-key"))
+
+	_, appKN := app.Next()
+	_, explicitKN := explicit.Next()
+	_, hsKN := hs.Next()
+	require.Equal(t, appKN, explicitKN)
+	require.NotEqual(t, appKN.Key, hsKN.Key)
+	require.NotEqual(t, appKN.Nonce, hsKN.Nonce)
+	require.NotEqual(t, app.NextSecret, hs.NextSecret)
+
+	// Labels survive serialization
+	enc, err := syntax.Marshal(hs)
+	require.Nil(t, err)
+	var restored hashRatchet
+	_, err = syntax.Unmarshal(enc, &restored)
+	require.Nil(t, err)
+	_, expected := hs.Next()
+	_, kn := restored.Next()
+	require.Equal(t, kn, expected)
+}
+
+func TestHashRatchetTryNext(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	hr := newHashRatchet(suite, 2, dup(baseSecret))
+	gen, kn, err := hr.TryNext()
+	require.Nil(t, err)
+	require.Equal(t, gen, uint32(0))
+
+	expected, err := newHashRatchet(suite, 2, dup(baseSecret)).Get(0)
+	require.Nil(t, err)
+	require.Equal(t, kn, expected)
+
+	// Overflow
+	hr.NextGeneration = math.MaxUint32
+	secret := dup(hr.NextSecret)
+	_, _, err = hr.TryNext()
+	require.Error(t, err)
+	require.Equal(t, hr.NextGeneration, uint32(math.MaxUint32))
+	require.Equal(t, hr.NextSecret, secret)
+
+	// Erased secret
+	hr.NextGeneration = 1
+	hr.eraseAll()
+	_, _, err = hr.TryNext()
+	require.Error(t, err)
+	require.Equal(t, hr.NextGeneration, uint32(1))
+	require.Equal(t, hr.NextSecret, make([]byte, len(secret)))
+}
+
+func TestHashRatchetNoNonce(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	withNonce := newHashRatchet(suite, 2, dup(baseSecret))
+	_, expected := withNonce.Next()
+
+	hr := newHashRatchet(suite, 2, dup(baseSecret))
+	hr.DeriveNonce = false
+	_, kn := hr.Next()
+	require.Equal(t, kn.Key, expected.Key)
+	require.Equal(t, len(kn.Nonce), 0)
+
+	kn, err := hr.Get(3)
+	require.Nil(t, err)
+	require.Equal(t, len(kn.Nonce), 0)
+
+	// The setting survives serialization
+	enc, err := syntax.Marshal(hr)
+	require.Nil(t, err)
+	var restored hashRatchet
+	_, err = syntax.Unmarshal(enc, &restored)
+	require.Nil(t, err)
+	require.False(t, restored.DeriveNonce)
+
+	_, kn = restored.Next()
+	require.Equal(t, len(kn.Nonce), 0)
+
+	enc, err = syntax.Marshal(withNonce)
+	require.Nil(t, err)
+	_, err = syntax.Unmarshal(enc, &restored)
+	require.Nil(t, err)
+	require.True(t, restored.DeriveNonce)
+}
+
+func TestHashRatchetLazyNonce(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	eager := newHashRatchet(suite, 2, dup(baseSecret))
+	lazy := newHashRatchet(suite, 2, dup(baseSecret))
+	lazy.LazyNonce = true
+
+	_, expected := eager.Next()
+	_, kn := lazy.Next()
+	require.Equal(t, kn.Key, expected.Key)
+	require.Equal(t, len(kn.Nonce), 0)
+	require.Equal(t, len(lazy.PendingNonces), 1)
+
+	// Only the nonce is held back, never the chain secret
+	require.Equal(t, lazy.PendingNonces[0], Bytes1(expected.Nonce))
+
+	nonce, err := lazy.Nonce(0)
+	require.Nil(t, err)
+	require.Equal(t, nonce, expected.Nonce)
+	require.Equal(t, len(lazy.PendingNonces), 0)
+
+	// Skipped generations are also deferred, and Get fills in the nonce
+	expected, err = eager.Get(3)
+	require.Nil(t, err)
+	kn, err = lazy.Get(3)
+	require.Nil(t, err)
+	require.Equal(t, kn, expected)
+	require.Equal(t, len(lazy.PendingNonces), 2)
+
+	// Pending nonces survive serialization, and are erased with their key
+	enc, err := syntax.Marshal(lazy)
+	require.Nil(t, err)
+	var restored hashRatchet
+	_, err = syntax.Unmarshal(enc, &restored)
+	require.Nil(t, err)
+	require.Equal(t, len(restored.PendingNonces), 2)
+
+	expected, err = eager.Get(2)
+	require.Nil(t, err)
+	nonce, err = restored.Nonce(2)
+	require.Nil(t, err)
+	require.Equal(t, nonce, expected.Nonce)
+
+	restored.Erase(1)
+	require.Equal(t, len(restored.PendingNonces), 0)
+
+	// A pending nonce of the wrong size is rejected
+	malformed := newHashRatchet(suite, 2, dup(baseSecret))
+	malformed.LazyNonce = true
+	malformed.Next()
+	malformed.PendingNonces[0] = dup(baseSecret)
+	enc, err = syntax.Marshal(malformed)
+	require.Nil(t, err)
+	restored = hashRatchet{}
+	_, err = syntax.Unmarshal(enc, &restored)
+	require.Error(t, err)
+}
+
+func TestHashRatchetRewindTo(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	hr := newHashRatchet(suite, 2, dup(baseSecret))
+	original := []keyAndNonce{}
+	for i := 0; i < 5; i += 1 {
+		gen, kn := hr.Next()
+		original = append(original, kn)
+		hr.Erase(gen)
+	}
+
+	// Disabled by default
+	require.Error(t, hr.RewindTo(2, baseSecret))
+
+	hr.AllowRewind = true
+	require.Error(t, hr.RewindTo(6, baseSecret))
+	require.Error(t, hr.RewindTo(2, baseSecret[:4]))
+
+	require.Nil(t, hr.RewindTo(2, baseSecret))
+	require.Equal(t, hr.NextGeneration, uint32(2))
+	require.Equal(t, hr.ErasedBelow, uint32(2))
+	require.Equal(t, len(hr.Erased), 0)
+
+	for i := 2; i < 5; i += 1 {
+		gen, kn := hr.Next()
+		require.Equal(t, gen, uint32(i))
+		require.Equal(t, kn, original[i])
+	}
+
+	// Earlier generations stay erased
+	_, err := hr.Get(1)
+	require.Equal(t, err, ErrKeyErased)
+
+	// Rewinding all the way back reproduces the whole sequence
+	require.Nil(t, hr.RewindTo(0, baseSecret))
+	kn, err := hr.Get(4)
+	require.Nil(t, err)
+	require.Equal(t, kn, original[4])
+	require.Equal(t, hr.Cache[0], original[0])
+}
+
+func TestHashRatchetLabelSeparation(t *testing.T) {
+	// This suite has a 32-byte key and a 32-byte secret
+	suite := X25519_CHACHA20POLY1305_SHA256_Ed25519
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	hr := newHashRatchet(suite, 2, dup(baseSecret))
+	_, kn := hr.Next()
+	require.NotEqual(t, kn.Key[:len(kn.Nonce)], kn.Nonce)
+	require.NotEqual(t, kn.Key, hr.NextSecret)
+
+	// Swapping the key and nonce labels changes both outputs
+	swapped := newHashRatchet(suite, 2, dup(baseSecret))
+	swapped.KeyLabel, swapped.NonceLabel = swapped.NonceLabel, swapped.KeyLabel
+	_, swappedKN := swapped.Next()
+	require.NotEqual(t, swappedKN.Key, kn.Key)
+	require.NotEqual(t, swappedKN.Nonce, kn.Nonce)
+
+	// With equal labels, only the lengths separate the outputs, and here the
+	// key collapses into the next secret
+	collapsed := newHashRatchet(suite, 2, dup(baseSecret))
+	collapsed.KeyLabel = collapsed.SecretLabel
+	_, collapsedKN := collapsed.Next()
+	require.Equal(t, collapsedKN.Key, collapsed.NextSecret)
+
+	// ... so a ratchet like that is rejected when decoded
+	enc, err := syntax.Marshal(collapsed)
+	require.Nil(t, err)
+	var decoded hashRatchet
+	_, err = syntax.Unmarshal(enc, &decoded)
+	require.Error(t, err)
+}
+
+func TestHashRatchetCostToGet(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	hr := newHashRatchet(suite, 2, dup(baseSecret))
+	derived := 0
+	hr.Events = func(node NodeIndex, generation uint32) { derived += 1 }
+
+	// Future
+	cost, err := hr.CostToGet(2)
+	require.Nil(t, err)
+	require.Equal(t, cost, 3)
+	_, err = hr.Get(2)
+	require.Nil(t, err)
+	require.Equal(t, derived, cost)
+
+	cost, err = hr.CostToGet(5)
+	require.Nil(t, err)
+	require.Equal(t, cost, 3)
+
+	// Cached
+	cost, err = hr.CostToGet(1)
+	require.Nil(t, err)
+	require.Equal(t, cost, 0)
+
+	// Expired
+	hr.Erase(1)
+	_, err = hr.CostToGet(1)
+	require.Equal(t, err, ErrKeyErased)
+	hr.skipTo(10)
+	_, err = hr.CostToGet(7)
+	require.Equal(t, err, ErrExpiredKey)
+
+	// Too far
+	cost, err = hr.CostToGet(10 + DefaultMaxGenerationSkip)
+	require.Nil(t, err)
+	require.Equal(t, cost, int(DefaultMaxGenerationSkip)+1)
+	_, err = hr.CostToGet(10 + DefaultMaxGenerationSkip + 1)
+	require.Equal(t, err, ErrKeyTooFar)
+}
+
+func TestHashRatchetNonceUniqueAcrossSenders(t *testing.T) {
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	size := LeafCount(8)
+
+	for _, suite := range supportedSuites {
+		epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+		require.Nil(t, err)
+		nonces := map[string]bool{}
+		for sender := LeafIndex(0); LeafCount(sender) < size; sender += 1 {
+			for _, keys := range []*groupKeySource{epoch.HandshakeKeys, epoch.ApplicationKeys} {
+				kn, err := keys.Get(sender, 0)
+				require.Nil(t, err)
+				require.False(t, nonces[string(kn.Nonce)])
+				nonces[string(kn.Nonce)] = true
+			}
+		}
+
+		// The node is mixed into every derivation, so even ratchets with the
+		// same base secret produce different nonces
+		baseSecret := bytes.Repeat([]byte{0x42}, suite.Constants().SecretSize)
+		a := newHashRatchet(suite, toNodeIndex(0), dup(baseSecret))
+		b := newHashRatchet(suite, toNodeIndex(1), dup(baseSecret))
+		_, knA := a.Next()
+		_, knB := b.Next()
+		require.NotEqual(t, knA.Nonce, knB.Nonce)
+		require.NotEqual(t, knA.Key, knB.Key)
+	}
+}
+
+type fakeCacheStore struct {
+	keys map[uint32]keyAndNonce
+	ops  []string
+}
+
+func (fs *fakeCacheStore) Put(generation uint32, kn keyAndNonce) {
+	fs.ops = append(fs.ops, fmt.Sprintf("put %d", generation))
+	fs.keys[generation] = kn.clone()
+}
+
+func (fs *fakeCacheStore) Get(generation uint32) (keyAndNonce, bool) {
+	fs.ops = append(fs.ops, fmt.Sprintf("get %d", generation))
+	kn, ok := fs.keys[generation]
+	return kn, ok
+}
+
+func (fs *fakeCacheStore) Delete(generation uint32) {
+	fs.ops = append(fs.ops, fmt.Sprintf("delete %d", generation))
+	delete(fs.keys, generation)
+}
+
+func TestHashRatchetCacheStore(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	plain := newHashRatchet(suite, 2, dup(baseSecret))
+	expected := []keyAndNonce{}
+	for i := 0; i < 3; i += 1 {
+		_, kn := plain.Next()
+		expected = append(expected, kn)
+	}
+
+	store := &fakeCacheStore{keys: map[uint32]keyAndNonce{}}
+	hr := newHashRatchet(suite, 2, dup(baseSecret))
+	hr.Store = store
+
+	_, kn := hr.Next()
+	require.Equal(t, kn, expected[0])
+	kn, err := hr.Get(2)
+	require.Nil(t, err)
+	require.Equal(t, kn, expected[2])
+	kn, err = hr.Get(0)
+	require.Nil(t, err)
+	require.Equal(t, kn, expected[0])
+	hr.Erase(1)
+
+	require.Equal(t, store.ops, []string{"put 0", "put 1", "put 2", "get 2", "get 0", "delete 1"})
+	require.Equal(t, store.keys, map[uint32]keyAndNonce{0: expected[0], 2: expected[2]})
+
+	// The ratchet itself only tracks which generations are cached
+	require.Equal(t, sortedGenerations(hr.Cache), []uint32{0, 2})
+	for _, kn := range hr.Cache {
+		require.Empty(t, kn.Key)
+		require.Empty(t, kn.Nonce)
+	}
+
+	_, err = hr.Get(1)
+	require.Equal(t, err, ErrKeyErased)
+
+	_, err = syntax.Marshal(hr)
+	require.Error(t, err)
+
+	// A key the store has lost is reported, not returned as all zeros
+	delete(store.keys, 2)
+	_, err = hr.Get(2)
+	require.Equal(t, err, ErrKeyNotInStore)
+
+	hr.eraseAll()
+	require.Empty(t, store.keys)
+}
+
+func TestHashRatchetMarshalDeterministic(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	hr := newHashRatchet(suite, 2, dup(baseSecret))
+	_, err := hr.Get(40)
+	require.Nil(t, err)
+	for gen := uint32(0); gen < 40; gen += 3 {
+		hr.Erase(gen)
+	}
+
+	enc, err := syntax.Marshal(hr)
+	require.Nil(t, err)
+	for i := 0; i < 10; i += 1 {
+		again, err := syntax.Marshal(hr)
+		require.Nil(t, err)
+		require.Equal(t, again, enc)
+	}
+
+	var restored hashRatchet
+	read, err := syntax.Unmarshal(enc, &restored)
+	require.Nil(t, err)
+	require.Equal(t, read, len(enc))
+	require.Equal(t, restored.Cache, hr.Cache)
+
+	reencoded, err := syntax.Marshal(restored)
+	require.Nil(t, err)
+	require.Equal(t, reencoded, enc)
+}
+
+func TestHashRatchetMarshalEncrypted(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	newAEAD := func(key []byte) cipher.AEAD {
+		block, err := aes.NewCipher(key)
+		require.Nil(t, err)
+		aead, err := cipher.NewGCM(block)
+		require.Nil(t, err)
+		return aead
+	}
+	aead := newAEAD(bytes.Repeat([]byte{0x01}, 16))
+
+	hr := newHashRatchet(suite, 2, dup(baseSecret))
+	_, err := hr.Get(3)
+	require.Nil(t, err)
+
+	enc, err := hr.MarshalEncrypted(aead)
+	require.Nil(t, err)
+	require.False(t, bytes.Contains(enc, hr.NextSecret))
+	require.False(t, bytes.Contains(enc, hr.Cache[3].Key))
+
+	var restored hashRatchet
+	require.Nil(t, restored.UnmarshalEncrypted(aead, enc))
+	require.Equal(t, restored.NextSecret, hr.NextSecret)
+	require.Equal(t, restored.Cache, hr.Cache)
+
+	// Tampered ciphertext
+	tampered := dup(enc)
+	tampered[len(tampered)-1] ^= 0x01
+	require.Error(t, restored.UnmarshalEncrypted(aead, tampered))
+
+	// Wrong key, and truncated input
+	require.Error(t, restored.UnmarshalEncrypted(newAEAD(bytes.Repeat([]byte{0x02}, 16)), enc))
+	require.Error(t, restored.UnmarshalEncrypted(aead, enc[:4]))
+}
+
+func BenchmarkHashRatchetNext(b *testing.B) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	for _, deriveNonce := range []bool{true, false} {
+		b.Run(fmt.Sprintf("DeriveNonce=%v", deriveNonce), func(b *testing.B) {
+			hr := newHashRatchet(suite, 2, dup(baseSecret))
+			hr.DeriveNonce = deriveNonce
+			for i := 0; i < b.N; i += 1 {
+				gen, _ := hr.Next()
+				hr.Erase(gen)
+			}
+		})
+	}
+}
+
+func TestHashRatchetEvents(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	type event struct {
+		node       NodeIndex
+		generation uint32
+	}
+	events := []event{}
+
+	hr := newHashRatchet(suite, 4, dup(baseSecret))
+	hr.Events = func(node NodeIndex, generation uint32) {
+		events = append(events, event{node, generation})
+	}
+
+	for i := uint32(0); i < 3; i += 1 {
+		gen, _ := hr.Next()
+		require.Equal(t, len(events), int(i)+1)
+		require.Equal(t, events[i], event{4, gen})
+	}
+
+	// Keys already cached don't produce events
+	_, err := hr.Get(1)
+	require.Nil(t, err)
+	require.Equal(t, len(events), 3)
+
+	// A replica following the events stays in lockstep
+	replica := newHashRatchet(suite, 4, dup(baseSecret))
+	for _, e := range events {
+		gen, _ := replica.Next()
+		require.Equal(t, gen, e.generation)
+	}
+	require.Equal(t, replica.NextSecret, hr.NextSecret)
+}
+
+func TestHashRatchetErasedKey(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	hr := newHashRatchet(suite, 2, baseSecret)
+	_, _ = hr.Next()
+	_, _ = hr.Next()
+
+	hr.Erase(0)
+	_, err := hr.Get(0)
+	require.Equal(t, err, ErrKeyErased)
+
+	// A past generation dropped from the cache without Erase, e.g., by pruning
+	delete(hr.Cache, 1)
+	_, err = hr.Get(1)
+	require.Equal(t, err, ErrExpiredKey)
+
+	// The erased set survives serialization
+	enc, err := syntax.Marshal(hr)
+	require.Nil(t, err)
+	var restored hashRatchet
+	_, err = syntax.Unmarshal(enc, &restored)
+	require.Nil(t, err)
+
+	_, err = restored.Get(0)
+	require.Equal(t, err, ErrKeyErased)
+}
+
+func TestHashRatchetErasedBounded(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	// Erasing in order only raises the low-water mark
+	hr := newHashRatchet(suite, 2, dup(baseSecret))
+	for i := 0; i < 1000; i += 1 {
+		gen, _ := hr.Next()
+		hr.Erase(gen)
+	}
+	require.Equal(t, hr.ErasedBelow, uint32(1000))
+	require.Equal(t, len(hr.Erased), 0)
+
+	// Out of order, the gaps are held until they are filled
+	_, err := hr.Get(1003)
+	require.Nil(t, err)
+	hr.Erase(1002)
+	hr.Erase(1001)
+	require.Equal(t, hr.Erased, []uint32{1001, 1002})
+	hr.Erase(1000)
+	require.Equal(t, hr.ErasedBelow, uint32(1003))
+	require.Equal(t, len(hr.Erased), 0)
+
+	// Gaps that are never filled don't grow the record without bound
+	for i := 0; i < 1000; i += 1 {
+		hr.Next()
+		gen, _ := hr.Next()
+		hr.Erase(gen)
+	}
+	require.Equal(t, len(hr.Erased), maxErasedGenerations)
+	_, err = hr.Get(hr.Erased[0])
+	require.Equal(t, err, ErrKeyErased)
+	_, err = hr.Get(hr.ErasedBelow - 1)
+	require.Equal(t, err, ErrKeyErased)
+	_, err = hr.Get(hr.NextGeneration - 2)
+	require.Nil(t, err)
+}
+
+func TestHashRatchetRestoreInvalidCache(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	hr := newHashRatchet(suite, 2, baseSecret)
+	_, kn0 := hr.Next()
+	_, _ = hr.Next()
+
+	// Plant a cached key for a generation the ratchet hasn't reached
+	hr.Cache[5] = keyAndNonce{
+		Key:   bytes.Repeat([]byte{0xA0}, 16),
+		Nonce: bytes.Repeat([]byte{0xB0}, 12),
+	}
+
+	enc, err := syntax.Marshal(hr)
+	require.Nil(t, err)
+
+	logged := 0
+	config := &KeyScheduleConfig{
+		Logger: func(format string, args ...interface{}) { logged += 1 },
+	}
+
+	restored := hashRatchet{config: config}
+	_, err = syntax.Unmarshal(enc, &restored)
+	require.Nil(t, err)
+	require.Equal(t, logged, 1)
+	require.Equal(t, len(restored.Cache), 2)
+
+	_, ok := restored.Cache[5]
+	require.False(t, ok)
+
+	kn, err := restored.Get(0)
+	require.Nil(t, err)
+	require.Equal(t, kn, kn0)
+
+	// A ratchet decoded without a config, e.g., as part of an epoch, reports
+	// the discarded generation once it is given one
+	var unconfigured hashRatchet
+	_, err = syntax.Unmarshal(enc, &unconfigured)
+	require.Nil(t, err)
+	require.Equal(t, logged, 1)
+	unconfigured.setConfig(config)
+	require.Equal(t, logged, 2)
+	unconfigured.setConfig(config)
+	require.Equal(t, logged, 2)
+}
+
+func TestKeyAndNonceMarshal(t *testing.T) {
+	kn := keyAndNonce{
+		Key:   bytes.Repeat([]byte{0xA0}, 16),
+		Nonce: bytes.Repeat([]byte{0xB0}, 12),
+	}
+
+	enc, err := syntax.Marshal(kn)
+	require.Nil(t, err)
+
+	var decoded keyAndNonce
+	_, err = syntax.Unmarshal(enc, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, decoded, kn)
+
+	kn.Key = bytes.Repeat([]byte{0xA0}, 256)
+	_, err = syntax.Marshal(kn)
+	require.Error(t, err)
+
+	kn.Key = bytes.Repeat([]byte{0xA0}, 16)
+	kn.Nonce = bytes.Repeat([]byte{0xB0}, 256)
+	_, err = syntax.Marshal(kn)
+	require.Error(t, err)
+}
+
+func TestNoFSBaseKeySourceReseed(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	oldRoot := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	newRoot := unhex("202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f")
+
+	nfbks := newNoFSBaseKeySource(suite, oldRoot)
+	before, err := nfbks.Get(3)
+	require.Nil(t, err)
+
+	nfbks.Reseed(dup(newRoot))
+	require.Equal(t, oldRoot, make([]byte, len(oldRoot)))
+
+	after, err := nfbks.Get(3)
+	require.Nil(t, err)
+	require.NotEqual(t, before, after)
+
+	expected, err := newNoFSBaseKeySource(suite, newRoot).Get(3)
+	require.Nil(t, err)
+	require.Equal(t, after, expected)
+}
+
+func TestNoFSBaseKeySourceCloneEqual(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	root := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	other := unhex("202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f")
+
+	nfbks := newNoFSBaseKeySource(suite, dup(root))
+	clone := nfbks.clone()
+	require.True(t, nfbks.Equal(clone))
+	require.True(t, nfbks.Equal(newNoFSBaseKeySource(suite, dup(root))))
+	require.False(t, nfbks.Equal(newNoFSBaseKeySource(suite, other)))
+	require.False(t, nfbks.Equal(newNoFSBaseKeySource(X25519_AES128GCM_SHA256_Ed25519, dup(root))))
+	require.False(t, nfbks.Equal(nil))
+
+	// Erasing the original leaves the clone intact
+	expected, err := nfbks.Get(2)
+	require.Nil(t, err)
+	nfbks.eraseAll()
+	require.False(t, nfbks.Equal(clone))
+	require.Equal(t, clone.RootSecret, root)
+
+	actual, err := clone.Get(2)
+	require.Nil(t, err)
+	require.Equal(t, actual, expected)
+
+	// Convergence checks cover the handshake base keys
+	epochSecret := unhex("404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f")
+	a, err := newKeyScheduleEpoch(suite, LeafCount(3), epochSecret, []byte("context"))
+	require.Nil(t, err)
+	b, err := newKeyScheduleEpoch(suite, LeafCount(3), dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+	require.Nil(t, a.ConvergesWith(b))
+
+	b.HandshakeBaseKeys = newNoFSBaseKeySource(suite, dup(other))
+	require.EqualError(t, a.ConvergesWith(b), "Mismatched handshake base keys")
+}
+
+func TestTreeBaseKeySourceFromGroupInfo(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	member, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	rootSecret := dup(member.ApplicationSecret)
+
+	// Senders 1 and 3 have already sent some messages
+	for i := 0; i < 3; i += 1 {
+		_, _, err := member.ApplicationKeys.Next(1)
+		require.Nil(t, err)
+	}
+	_, _, err = member.ApplicationKeys.Next(3)
+	require.Nil(t, err)
+
+	start := map[LeafIndex]uint32{1: 3, 3: 1}
+	tbks, ratchets, err := newTreeBaseKeySourceFromGroupInfo(suite, size, rootSecret, start)
+	require.Nil(t, err)
+	joiner := groupKeySource{Base: tbks, Ratchets: ratchets}
+
+	for _, sender := range []LeafIndex{1, 3, 4} {
+		gen, expected, err := member.ApplicationKeys.Next(sender)
+		require.Nil(t, err)
+
+		joinerGen, kn, err := joiner.Next(sender)
+		require.Nil(t, err)
+		require.Equal(t, joinerGen, gen)
+		require.Equal(t, kn, expected)
+	}
+
+	_, _, err = newTreeBaseKeySourceFromGroupInfo(suite, size, dup(rootSecret), map[LeafIndex]uint32{5: 0})
+	require.Error(t, err)
+}
+
+func TestTreeBaseKeySourceDiff(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	rootSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	alice, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	bob, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	require.Equal(t, alice.Diff(bob), []NodeIndex{})
+
+	// Same consumption on both sides
+	_, err = alice.Get(4)
+	require.Nil(t, err)
+	_, err = bob.Get(4)
+	require.Nil(t, err)
+	require.Equal(t, alice.Diff(bob), []NodeIndex{})
+
+	// Alice consumes leaf 0, replacing node 3 with nodes 2 and 5
+	_, err = alice.Get(0)
+	require.Nil(t, err)
+	require.Equal(t, alice.Diff(bob), []NodeIndex{2, 3, 5})
+
+	// A corrupted secret shows up at its node
+	bob, err = newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	_, err = bob.Get(4)
+	require.Nil(t, err)
+	_, err = bob.Get(0)
+	require.Nil(t, err)
+	bob.Secrets[2] = bytes.Repeat([]byte{0xff}, 32)
+	require.Equal(t, alice.Diff(bob), []NodeIndex{2})
+}
+
+func TestTreeBaseKeySourceSnapshot(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	rootSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	tbks, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	snap := tbks.Snapshot()
+
+	expected := map[LeafIndex][]byte{}
+	for i := LeafIndex(0); i < LeafIndex(size); i += 1 {
+		secret, err := tbks.Get(i)
+		require.Nil(t, err)
+		expected[i] = secret
+	}
+
+	// The destructive Gets didn't touch the snapshot's copies
+	require.Equal(t, snap.Secrets[snap.Root], Bytes1(rootSecret))
+
+	for round := 0; round < 2; round += 1 {
+		tbks.Restore(snap)
+		for i := LeafIndex(0); i < LeafIndex(size); i += 1 {
+			secret, err := tbks.Get(i)
+			require.Nil(t, err)
+			require.Equal(t, secret, expected[i])
+		}
+	}
+}
+
+func TestTreeBaseKeySourceValidate(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(11)
+	rootSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	tbks, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	require.Nil(t, tbks.Validate())
+
+	enc, err := syntax.Marshal(tbks)
+	require.Nil(t, err)
+	var decoded treeBaseKeySource
+	_, err = syntax.Unmarshal(enc, &decoded)
+	require.Nil(t, err)
+
+	// Root inconsistent with the size
+	corrupt, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	corrupt.Size = 3
+	require.Error(t, corrupt.Validate())
+
+	enc, err = syntax.Marshal(corrupt)
+	require.Nil(t, err)
+	_, err = syntax.Unmarshal(enc, &decoded)
+	require.Error(t, err)
+
+	// Secret for a node outside the tree
+	corrupt, err = newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	corrupt.Secrets[NodeIndex(nodeWidth(size))] = dup(rootSecret)
+	require.Error(t, corrupt.Validate())
+}
+
+func TestTreeBaseKeySourceConsistentWith(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	rootSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	for _, size := range []LeafCount{1, 2, 3, 5, 8, 11} {
+		tbks, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+		require.Nil(t, err)
+		require.Nil(t, tbks.ConsistentWith(size))
+	}
+
+	tbks, err := newTreeBaseKeySource(suite, 5, dup(rootSecret))
+	require.Nil(t, err)
+	require.Error(t, tbks.ConsistentWith(4))
+	require.Error(t, tbks.ConsistentWith(6))
+}
+
+func TestTreeBaseKeySourceMaxSize(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	rootSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	// The largest supported tree works at both edges
+	tbks, err := newTreeBaseKeySource(suite, maxLeafCount, dup(rootSecret))
+	require.Nil(t, err)
+	require.Equal(t, tbks.Root, NodeIndex(1<<31-1))
+	require.Nil(t, tbks.Validate())
+
+	last := LeafIndex(maxLeafCount - 1)
+	require.Equal(t, dirpath(toNodeIndex(last), maxLeafCount)[30], tbks.Root)
+	_, err = tbks.Get(last)
+	require.Nil(t, err)
+	_, err = tbks.Get(0)
+	require.Nil(t, err)
+
+	// Larger trees, and empty ones, are rejected
+	_, err = newTreeBaseKeySource(suite, maxLeafCount+1, dup(rootSecret))
+	require.Error(t, err)
+	_, err = newTreeBaseKeySource(suite, LeafCount(math.MaxUint32), dup(rootSecret))
+	require.Error(t, err)
+	_, err = newTreeBaseKeySource(suite, 0, dup(rootSecret))
+	require.EqualError(t, err, "Empty tree")
+	_, _, err = newTreeBaseKeySourceFromGroupInfo(suite, 0, dup(rootSecret), nil)
+	require.EqualError(t, err, "Empty tree")
+}
+
+func TestKeyScheduleUnsupportedSize(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := bytes.Repeat([]byte{0x01}, 32)
+
+	// An empty group has no secret tree
+	_, err := newKeyScheduleEpoch(suite, 0, dup(epochSecret), []byte("context"))
+	require.EqualError(t, err, "mls.ks: Empty tree")
+
+	// A size too large for the secret tree is an error, not a panic
+	_, err = newKeyScheduleEpoch(suite, maxLeafCount+1, dup(epochSecret), []byte("context"))
+	require.Error(t, err)
+	_, err = newKeyScheduleEpochWithOptions(suite, maxLeafCount+1, dup(epochSecret), []byte("context"), KeyScheduleHandshakeFS, nil)
+	require.Error(t, err)
+
+	epoch, err := newKeyScheduleEpoch(suite, 3, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+	_, err = epoch.Next(0, nil, commitSecret, []byte("next"))
+	require.EqualError(t, err, "mls.ks: Empty tree")
+	_, err = epoch.Next(maxLeafCount+1, nil, commitSecret, []byte("next"))
+	require.Error(t, err)
+	_, err = epoch.NextWithPSK(maxLeafCount+1, nil, commitSecret, []byte("next"))
+	require.Error(t, err)
+}
+
+func TestTreeBaseKeySourceOutOfRange(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	// Senders beyond the tree, including ones beyond any tree, are errors
+	// rather than panics, since they come from the wire
+	for _, sender := range []LeafIndex{LeafIndex(size), LeafIndex(maxLeafCount), math.MaxUint32 - 1} {
+		_, err := epoch.ApplicationBaseKeys.Get(sender)
+		require.Error(t, err)
+		_, err = epoch.ApplicationKeys.Get(sender, 0)
+		require.Error(t, err)
+	}
+
+	_, err = epoch.ApplicationBaseKeys.Get(math.MaxUint32)
+	require.Error(t, err)
+
+	// So are senders beyond any tree for the sources without one
+	for _, sender := range []LeafIndex{LeafIndex(maxLeafCount), math.MaxUint32 - 1} {
+		require.False(t, epoch.HandshakeKeys.CanGet(sender, 0))
+		_, err = epoch.HandshakeKeys.Get(sender, 0)
+		require.Error(t, err)
+		_, err = epoch.HandshakeKeys.ExternalRatchet(uint32(sender))
+		require.Error(t, err)
+	}
+
+	epoch, err = newKeyScheduleEpochWithOptions(suite, size, dup(epochSecret), []byte("context"), KeyScheduleSenderDataPerSender, nil)
+	require.Nil(t, err)
+	_, err = epoch.SenderDataKeyFor(LeafIndex(maxLeafCount))
+	require.Error(t, err)
+	_, err = epoch.SenderDataKeyFor(MembershipSender)
+	require.Nil(t, err)
+}
+
+func TestTreeBaseKeySourceKeepSecrets(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(11)
+	rootSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	get := func(tbks *treeBaseKeySource, sender LeafIndex) []byte {
+		secret, err := tbks.Get(sender)
+		require.Nil(t, err)
+		return secret
+	}
+
+	destructive, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	expected := get(destructive, 3)
+
+	tbks, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	tbks.KeepSecrets = true
+
+	require.Equal(t, get(tbks, 3), expected)
+	require.Equal(t, get(tbks, 3), expected)
+	require.Equal(t, tbks.Secrets[tbks.Root], Bytes1(rootSecret))
+
+	// Other leaves are still derivable, including the sender's sibling
+	require.Equal(t, get(tbks, 2), get(destructive, 2))
+	require.Equal(t, get(tbks, 10), get(destructive, 10))
+
+	// ... but the destructive source can't derive a leaf twice
+	_, err = destructive.Get(3)
+	require.Error(t, err)
+}
+
+func TestTreeBaseKeySourceExportLeaf(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(11)
+	rootSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	tbks, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	_, err = tbks.ExportLeaf(3)
+	require.Error(t, err)
+
+	logged := []string{}
+	tbks.config = &KeyScheduleConfig{
+		Logger: func(format string, args ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		},
+	}
+
+	tbks.AllowLeafExport = true
+	exported, err := tbks.ExportLeaf(3)
+	require.Nil(t, err)
+	require.Equal(t, len(logged), 1)
+
+	// Export leaves the stored secrets alone, so Get still works and agrees
+	require.Equal(t, len(tbks.Secrets), 1)
+	expected, err := tbks.Get(3)
+	require.Nil(t, err)
+	require.Equal(t, exported, expected)
+
+	// Exports also work from secrets lower in the tree
+	exported, err = tbks.ExportLeaf(2)
+	require.Nil(t, err)
+	expected, err = tbks.Get(2)
+	require.Nil(t, err)
+	require.Equal(t, exported, expected)
+}
+
+func TestTreeBaseKeySourceFingerprint(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(11)
+	rootSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	tbks, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	other, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+
+	fp := tbks.Fingerprint(suite)
+	require.Equal(t, len(fp), suite.newDigest().Size())
+	require.Equal(t, fp, tbks.Fingerprint(suite))
+	require.Equal(t, fp, other.Fingerprint(suite))
+	require.False(t, bytes.Contains(fp, rootSecret))
+
+	_, err = tbks.Get(3)
+	require.Nil(t, err)
+	consumed := tbks.Fingerprint(suite)
+	require.NotEqual(t, fp, consumed)
+
+	_, err = other.Get(3)
+	require.Nil(t, err)
+	require.Equal(t, consumed, other.Fingerprint(suite))
+}
+
+func TestTreeBaseKeySourceLeafCommitments(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(11)
+	rootSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	tbks, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+	other, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+	require.Nil(t, err)
+
+	fp := tbks.Fingerprint(suite)
+	commitments := tbks.LeafCommitments(suite)
+	require.Equal(t, len(commitments), int(size))
+	require.Equal(t, commitments, other.LeafCommitments(suite))
+	require.Equal(t, fp, tbks.Fingerprint(suite))
+
+	seen := map[string]bool{}
+	for leaf, commitment := range commitments {
+		require.False(t, seen[string(commitment)])
+		seen[string(commitment)] = true
+
+		secret, err := other.Get(leaf)
+		require.Nil(t, err)
+		require.Equal(t, commitment, suite.Digest(secret))
+	}
+
+	// Consumed leaves are left out
+	_, err = tbks.Get(3)
+	require.Nil(t, err)
+	consumed := tbks.LeafCommitments(suite)
+	require.Equal(t, len(consumed), int(size)-1)
+	_, ok := consumed[3]
+	require.False(t, ok)
+	require.Equal(t, consumed[4], commitments[4])
+}
+
+func TestTreeBaseKeySourceBlankLeaf(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	rootSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	for size := LeafCount(1); size <= 16; size += 1 {
+		reference, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+		require.Nil(t, err)
+		expected := map[LeafIndex][]byte{}
+		for leaf := LeafIndex(0); LeafCount(leaf) < size; leaf += 1 {
+			expected[leaf], err = reference.Get(leaf)
+			require.Nil(t, err)
+		}
+
+		for blank := LeafIndex(0); LeafCount(blank) < size; blank += 1 {
+			tbks, err := newTreeBaseKeySource(suite, size, dup(rootSecret))
+			require.Nil(t, err)
+			require.Nil(t, tbks.MarkBlank(blank))
+			require.Nil(t, tbks.MarkBlank(blank))
+
+			for leaf := LeafIndex(0); LeafCount(leaf) < size; leaf += 1 {
+				secret, err := tbks.Get(leaf)
+				if leaf == blank {
+					require.Equal(t, err, ErrBlankLeaf)
+					continue
+				}
+
+				require.Nil(t, err)
+				require.Equal(t, secret, expected[leaf])
+			}
+		}
+	}
+
+	tbks, err := newTreeBaseKeySource(suite, 5, dup(rootSecret))
+	require.Nil(t, err)
+	require.Error(t, tbks.MarkBlank(5))
+
+	// A leaf whose key was already consumed can still be marked
+	_, err = tbks.Get(2)
+	require.Nil(t, err)
+	require.Nil(t, tbks.MarkBlank(2))
+	_, err = tbks.Get(2)
+	require.Equal(t, err, ErrBlankLeaf)
+
+	// Through a key source, blank leaves get no ratchet
+	keys := groupKeySource{Base: tbks, Ratchets: map[LeafIndex]*hashRatchet{}}
+	tbks.KeepSecrets = true
+	require.Nil(t, tbks.MarkBlank(3))
+	require.False(t, keys.CanGet(3, 0))
+	_, err = keys.Get(3, 0)
+	require.Equal(t, err, ErrBlankLeaf)
+	require.Empty(t, keys.Ratchets)
+	require.True(t, keys.CanGet(4, 0))
+
+	// The blank leaf's base secret is gone, even though KeepSecrets holds
+	// onto the others
+	_, ok := tbks.Secrets[toNodeIndex(3)]
+	require.False(t, ok)
+	_, err = keys.Get(4, 0)
+	require.Nil(t, err)
+}
+
+func TestCommitSecret(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	pathSecrets := [][]byte{
+		unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"),
+		unhex("202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"),
+		unhex("404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f"),
+	}
+
+	var empty CommitSecret
+	require.Nil(t, empty.Finalize())
+
+	var forward CommitSecret
+	for _, secret := range pathSecrets {
+		err := forward.AddPathSecret(suite, secret)
+		require.Nil(t, err)
+	}
+	commitSecret := forward.Finalize()
+	require.Equal(t, len(commitSecret), suite.Constants().SecretSize)
+	require.Equal(t, commitSecret, forward.Finalize())
+	require.Equal(t, commitSecret, unhex("12daeaa95d0f4a4ae5315b303f285b9a3129bddfda7146afc8425395c31ab8fe"))
+
+	var backward CommitSecret
+	for i := len(pathSecrets) - 1; i >= 0; i -= 1 {
+		err := backward.AddPathSecret(suite, pathSecrets[i])
+		require.Nil(t, err)
+	}
+	require.NotEqual(t, commitSecret, backward.Finalize())
+
+	err := forward.AddPathSecret(X25519_AES128GCM_SHA256_Ed25519, pathSecrets[0])
+	require.Error(t, err)
+	require.Equal(t, forward.Finalize(), commitSecret)
+}
+
+func TestKeyScheduleEraseExceptInit(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := unhex("404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f")
+	context := []byte("context")
+
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, context)
+	require.Nil(t, err)
+	expected, err := epoch.Next(size, nil, commitSecret, context)
+	require.Nil(t, err)
+
+	for i := LeafIndex(0); i < LeafIndex(size); i += 1 {
+		_, err := epoch.HandshakeKeys.Get(i, 1)
+		require.Nil(t, err)
+		_, err = epoch.ApplicationKeys.Get(i, 1)
+		require.Nil(t, err)
+	}
+
+	initSecret := dup(epoch.InitSecret)
+	epoch.EraseExceptInit()
+
+	zero := make([]byte, suite.Constants().SecretSize)
+	require.Equal(t, epoch.EpochSecret, zero)
+	require.Equal(t, epoch.SenderDataSecret, zero)
+	require.Equal(t, epoch.SenderDataKey, make([]byte, suite.Constants().KeySize))
+	require.Equal(t, epoch.HandshakeSecret, zero)
+	require.Equal(t, epoch.ApplicationSecret, zero)
+	require.Equal(t, epoch.ExporterSecret, zero)
+	require.Equal(t, epoch.ConfirmationKey, zero)
+	require.Equal(t, epoch.HandshakeBaseKeys.RootSecret, zero)
+	require.Equal(t, len(epoch.ApplicationBaseKeys.Secrets), 0)
+	for _, ratchets := range []map[LeafIndex]*hashRatchet{epoch.HandshakeRatchets, epoch.ApplicationRatchets} {
+		for _, r := range ratchets {
+			require.Equal(t, r.NextSecret, zero)
+			require.Equal(t, len(r.Cache), 0)
+		}
+	}
+
+	require.Equal(t, epoch.InitSecret, initSecret)
+	next, err := epoch.Next(size, nil, commitSecret, context)
+	require.Nil(t, err)
+	require.Equal(t, next.EpochSecret, expected.EpochSecret)
+
+	epoch.EraseInit()
+	require.Equal(t, epoch.InitSecret, zero)
+}
+
+// A deliberately trivial ratchet, with each key derived directly from the base
+// secret and the generation
+type counterRatchet struct {
+	suite  CipherSuite
+	base   []byte
+	next   uint32
+	erased map[uint32]bool
+}
+
+func (cr *counterRatchet) key(generation uint32) keyAndNonce {
+	return keyAndNonce{
+		Key:   cr.suite.deriveAppSecret(cr.base, "counter key", 0, generation, cr.suite.Constants().KeySize),
+		Nonce: cr.suite.deriveAppSecret(cr.base, "counter nonce", 0, generation, cr.suite.Constants().NonceSize),
+	}
+}
+
+func (cr *counterRatchet) Next() (uint32, keyAndNonce) {
+	generation := cr.next
+	cr.next += 1
+	return generation, cr.key(generation)
+}
+
+func (cr *counterRatchet) Get(generation uint32) (keyAndNonce, error) {
+	if cr.erased[generation] {
+		return keyAndNonce{}, fmt.Errorf("Erased")
+	}
+	return cr.key(generation), nil
+}
+
+func (cr *counterRatchet) Erase(generation uint32) {
+	cr.erased[generation] = true
+}
+
+func TestGroupKeySourceNextKey(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(4)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	epoch, err = epoch.Next(size, nil, bytes.Repeat([]byte{0x01}, 32), []byte("next"))
+	require.Nil(t, err)
+
+	for i := 0; i < 3; i += 1 {
+		mk, err := epoch.ApplicationKeys.NextKey(2)
+		require.Nil(t, err)
+		require.Equal(t, mk.Epoch, epoch.CurrentEpoch())
+		require.Equal(t, mk.Generation, uint32(i))
+		require.Equal(t, epoch.ApplicationRatchets[2].NextGeneration, mk.Generation+1)
+
+		kn, err := epoch.ApplicationKeys.Get(2, mk.Generation)
+		require.Nil(t, err)
+		require.Equal(t, kn, mk.KN)
+	}
+
+	mk, err := epoch.HandshakeKeys.NextKey(0)
+	require.Nil(t, err)
+	require.Equal(t, mk.Epoch, Epoch(1))
+	require.Equal(t, mk.Generation, uint32(0))
+}
+
+func TestGroupKeySourceExternalRatchet(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(4)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	external, err := epoch.HandshakeKeys.ExternalRatchet(1)
+	require.Nil(t, err)
+	_, externalKN := external.Next()
+
+	_, memberKN, err := epoch.HandshakeKeys.Next(1)
+	require.Nil(t, err)
+	require.NotEqual(t, externalKN, memberKN)
+
+	// The same ratchet is returned on later calls
+	again, err := epoch.HandshakeKeys.ExternalRatchet(1)
+	require.Nil(t, err)
+	require.Equal(t, again.NextGeneration, uint32(1))
+
+	_, err = epoch.ApplicationKeys.ExternalRatchet(1)
+	require.Error(t, err)
+}
+
+func TestGroupKeySourceCanGet(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(4)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	keys := epoch.ApplicationKeys
+
+	// No ratchet yet; checking doesn't create one
+	require.True(t, keys.CanGet(1, 3))
+	require.False(t, keys.CanGet(1, DefaultMaxGenerationSkip+1))
+	require.Equal(t, len(epoch.ApplicationRatchets), 0)
+
+	_, err = keys.Get(1, 2)
+	require.Nil(t, err)
+	err = keys.Erase(1, 0)
+	require.Nil(t, err)
+	before := epoch.ApplicationRatchets[1].NextGeneration
+
+	require.True(t, keys.CanGet(1, 1))                             // cached
+	require.True(t, keys.CanGet(1, 10))                            // reachable
+	require.False(t, keys.CanGet(1, 0))                            // expired
+	require.False(t, keys.CanGet(1, 3+DefaultMaxGenerationSkip+1)) // too far
+	require.Equal(t, epoch.ApplicationRatchets[1].NextGeneration, before)
+
+	_, err = keys.Get(1, 3+DefaultMaxGenerationSkip+1)
+	require.Equal(t, err, ErrKeyTooFar)
+
+	// A sender whose base key has been consumed can't get a ratchet
+	_, err = epoch.ApplicationBaseKeys.Get(2)
+	require.Nil(t, err)
+	require.False(t, keys.CanGet(2, 0))
+}
+
+func TestGroupKeySourceCachedGenerations(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(4)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	require.Nil(t, epoch.ApplicationKeys.CachedGenerations(1))
+	require.Equal(t, len(epoch.ApplicationRatchets), 0)
+
+	_, _, err = epoch.ApplicationKeys.Next(1)
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(1, 3)
+	require.Nil(t, err)
+	err = epoch.ApplicationKeys.Erase(1, 2)
+	require.Nil(t, err)
+
+	require.Equal(t, epoch.ApplicationKeys.CachedGenerations(1), []uint32{0, 1, 3})
+}
+
+func TestGroupKeySourceFSFloor(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(4)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	_, ok := epoch.ApplicationKeys.FSFloor(1)
+	require.False(t, ok)
+
+	_, err = epoch.ApplicationKeys.Get(1, 5)
+	require.Nil(t, err)
+	floor, ok := epoch.ApplicationKeys.FSFloor(1)
+	require.True(t, ok)
+	require.Equal(t, floor, uint32(0))
+
+	// Erasing the lowest generations raises the floor; a gap above it doesn't
+	for _, gen := range []uint32{0, 1, 3} {
+		require.Nil(t, epoch.ApplicationKeys.Erase(1, gen))
+	}
+	floor, ok = epoch.ApplicationKeys.FSFloor(1)
+	require.True(t, ok)
+	require.Equal(t, floor, uint32(2))
+
+	for _, gen := range []uint32{2, 4, 5} {
+		require.Nil(t, epoch.ApplicationKeys.Erase(1, gen))
+	}
+	_, ok = epoch.ApplicationKeys.FSFloor(1)
+	require.False(t, ok)
+}
+
+func TestGroupKeySourceEraseIdle(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	config := &KeyScheduleConfig{Now: func() time.Time { return clock }}
+
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(4)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpochWithOptions(suite, size, epochSecret, []byte("context"), 0, config)
+	require.Nil(t, err)
+
+	// Without tracking, nothing is considered idle
+	_, err = epoch.ApplicationKeys.Get(0, 0)
+	require.Nil(t, err)
+	clock = clock.Add(time.Hour)
+	require.Equal(t, epoch.ApplicationKeys.EraseIdle(time.Minute), 0)
+
+	epoch.ApplicationKeys.EnableIdleTracking()
+	for sender := LeafIndex(1); sender < 3; sender += 1 {
+		_, err := epoch.ApplicationKeys.Get(sender, 0)
+		require.Nil(t, err)
+	}
+	quiet := epoch.ApplicationRatchets[2].Cache[0]
+
+	// Senders 0 and 1 stay active, while sender 2 goes quiet
+	clock = clock.Add(10 * time.Minute)
+	_, _, err = epoch.ApplicationKeys.Next(0)
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(1, 0)
+	require.Nil(t, err)
+
+	clock = clock.Add(10 * time.Minute)
+	require.Equal(t, epoch.ApplicationKeys.EraseIdle(15*time.Minute), 1)
+	require.Equal(t, len(epoch.ApplicationRatchets), 2)
+	_, ok := epoch.ApplicationRatchets[2]
+	require.False(t, ok)
+	require.True(t, isZero(quiet.Key))
+
+	// Its keys can't be recovered
+	_, err = epoch.ApplicationKeys.Get(2, 0)
+	require.Error(t, err)
+
+	clock = clock.Add(time.Hour)
+	require.Equal(t, epoch.ApplicationKeys.EraseIdle(15*time.Minute), 2)
+	require.Empty(t, epoch.ApplicationRatchets)
+}
+
+func TestGroupKeySourceStats(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(4)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	// Nothing is counted until stats are enabled
+	_, err = epoch.ApplicationKeys.Get(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, epoch.ApplicationKeys.Stats(), RatchetStats{})
+
+	epoch.ApplicationKeys.EnableStats()
+
+	// An existing ratchet: one hit, then a miss that skips generation 1
+	_, err = epoch.ApplicationKeys.Get(0, 0)
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(0, 2)
+	require.Nil(t, err)
+	require.Equal(t, epoch.ApplicationRatchets[0].Stats(), RatchetStats{CacheHits: 1, CacheMisses: 1, FastForwards: 1})
+
+	// A new ratchet: a miss without skipping, a hit, and a failed miss
+	_, err = epoch.ApplicationKeys.Get(1, 0)
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(1, 0)
+	require.Nil(t, err)
+	require.Nil(t, epoch.ApplicationKeys.Erase(1, 0))
+	_, err = epoch.ApplicationKeys.Get(1, 0)
+	require.Error(t, err)
+	require.Equal(t, epoch.ApplicationRatchets[1].Stats(), RatchetStats{CacheHits: 1, CacheMisses: 2})
+
+	require.Equal(t, epoch.ApplicationKeys.Stats(), RatchetStats{CacheHits: 2, CacheMisses: 3, FastForwards: 1})
+}
+
+func TestGroupKeySourceRestore(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	context := []byte("context")
+	sender, err := newKeyScheduleEpoch(suite, size, epochSecret, context)
+	require.Nil(t, err)
+	receiver, err := newKeyScheduleEpoch(suite, size, dup(epochSecret), context)
+	require.Nil(t, err)
+
+	// Provide base secrets from the sender's view of the tree
+	generations := map[LeafIndex]uint32{0: 0, 2: 3, 4: 7}
+	seeds := map[LeafIndex]RatchetSeed{}
+	for leaf, generation := range generations {
+		baseSecret, err := sender.ApplicationBaseKeys.Get(leaf)
+		require.Nil(t, err)
+		seeds[leaf] = RatchetSeed{Secret: baseSecret, Generation: generation}
+		sender.ApplicationRatchets[leaf] = newHashRatchet(suite, toNodeIndex(leaf), dup(baseSecret))
+	}
+
+	require.Nil(t, receiver.ApplicationKeys.Restore(seeds))
+	for leaf, generation := range generations {
+		expected, err := sender.ApplicationKeys.Get(leaf, generation)
+		require.Nil(t, err)
+
+		next, kn, err := receiver.ApplicationKeys.Next(leaf)
+		require.Nil(t, err)
+		require.Equal(t, next, generation)
+		require.Equal(t, kn, expected)
+	}
+
+	// Invalid seeds are rejected without installing anything
+	bad := map[LeafIndex]RatchetSeed{
+		1: {Secret: seeds[0].Secret, Generation: 0},
+		5: {Secret: seeds[0].Secret, Generation: 0},
+	}
+	require.Error(t, receiver.ApplicationKeys.Restore(bad))
+	_, ok := receiver.ApplicationRatchets[1]
+	require.False(t, ok)
+
+	short := map[LeafIndex]RatchetSeed{1: {Secret: seeds[0].Secret[:4]}}
+	require.Error(t, receiver.ApplicationKeys.Restore(short))
+}
+
+func TestGroupKeySourceMaxRatchets(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	epoch.ApplicationKeys.MaxRatchets = 2
+
+	_, _, err = epoch.ApplicationKeys.Next(0)
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(1, 3)
+	require.Nil(t, err)
+
+	// A third sender is refused, without consuming its base key
+	_, err = epoch.ApplicationKeys.Get(2, 0)
+	require.Error(t, err)
+	require.Equal(t, len(epoch.ApplicationRatchets), 2)
+	require.True(t, epoch.ApplicationKeys.CanGet(2, 0))
+
+	// Existing senders still work
+	_, _, err = epoch.ApplicationKeys.Next(0)
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(1, 4)
+	require.Nil(t, err)
+}
+
+func TestGroupKeySourceMaxCachedKeys(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	epoch.ApplicationKeys.MaxCachedKeys = 3
+
+	for sender := LeafIndex(0); sender < 3; sender += 1 {
+		_, err := epoch.ApplicationKeys.Get(sender, 0)
+		require.Nil(t, err)
+	}
+
+	// Using sender 0's key again leaves sender 1's as the least recently used
+	_, err = epoch.ApplicationKeys.Get(0, 0)
+	require.Nil(t, err)
+	evicted := epoch.ApplicationRatchets[1].Cache[0]
+
+	_, err = epoch.ApplicationKeys.Get(2, 1)
+	require.Nil(t, err)
+	require.True(t, isZero(evicted.Key))
+	require.True(t, isZero(evicted.Nonce))
+	require.Empty(t, epoch.ApplicationKeys.CachedGenerations(1))
+	require.Equal(t, epoch.ApplicationKeys.CachedGenerations(0), []uint32{0})
+	require.Equal(t, epoch.ApplicationKeys.CachedGenerations(2), []uint32{0, 1})
+
+	_, err = epoch.ApplicationKeys.Get(1, 0)
+	require.Equal(t, err, ErrExpiredKey)
+
+	// Skipped generations count against the budget too, oldest first
+	_, err = epoch.ApplicationKeys.Get(3, 2)
+	require.Nil(t, err)
+	require.Empty(t, epoch.ApplicationKeys.CachedGenerations(0))
+	require.Empty(t, epoch.ApplicationKeys.CachedGenerations(2))
+	require.Equal(t, epoch.ApplicationKeys.CachedGenerations(3), []uint32{0, 1, 2})
+}
+
+func TestGroupKeySourceStream(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	sender, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	receiver, err := newKeyScheduleEpoch(suite, size, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+
+	next, err := receiver.ApplicationKeys.Stream(2)
+	require.Nil(t, err)
+
+	for expected := uint32(0); expected < 4; expected += 1 {
+		sent, sentKN, err := sender.ApplicationKeys.Next(2)
+		require.Nil(t, err)
+
+		generation, kn, err := next()
+		require.Nil(t, err)
+		require.Equal(t, generation, expected)
+		require.Equal(t, generation, sent)
+		require.Equal(t, kn, sentKN)
+
+		// Only the key just returned is held
+		require.Equal(t, receiver.ApplicationKeys.CachedGenerations(2), []uint32{generation})
+		if generation > 0 {
+			_, err = receiver.ApplicationKeys.Get(2, generation-1)
+			require.Equal(t, err, ErrKeyErased)
+		}
+	}
+
+	// The stream can't be started for a sender outside the tree
+	_, err = receiver.ApplicationKeys.Stream(LeafIndex(size))
+	require.Error(t, err)
+}
+
+func TestGroupKeySourceOpenNext(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	sender, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	receiver, err := newKeyScheduleEpoch(suite, size, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+	aad := []byte("aad")
+
+	seal := func(pt string) []byte {
+		_, kn, err := sender.ApplicationKeys.Next(2)
+		require.Nil(t, err)
+		ct, err := suite.seal(kn.Key, kn.Nonce, aad, []byte(pt))
+		require.Nil(t, err)
+		return ct
+	}
+
+	// In order
+	for i, msg := range []string{"zero", "one"} {
+		pt, generation, err := receiver.ApplicationKeys.OpenNext(2, aad, seal(msg))
+		require.Nil(t, err)
+		require.Equal(t, string(pt), msg)
+		require.Equal(t, generation, uint32(i))
+	}
+
+	// A ciphertext that no key opens leaves the ratchet alone
+	_, _, err = receiver.ApplicationKeys.OpenNext(2, aad, []byte("not a ciphertext"))
+	require.Error(t, err)
+	require.Equal(t, receiver.ApplicationRatchets[2].NextGeneration, uint32(2))
+
+	// With one message lost, the next one still opens, and the lost one's
+	// key is kept in case it turns up
+	seal("lost")
+	pt, generation, err := receiver.ApplicationKeys.OpenNext(2, aad, seal("three"))
+	require.Nil(t, err)
+	require.Equal(t, string(pt), "three")
+	require.Equal(t, generation, uint32(3))
+	require.Equal(t, receiver.ApplicationKeys.CachedGenerations(2), []uint32{2})
+
+	_, err = receiver.ApplicationKeys.Get(2, 3)
+	require.Equal(t, err, ErrKeyErased)
+}
+
+func TestGroupKeySourcePrefetch(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	sender, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	receiver, err := newKeyScheduleEpoch(suite, size, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+	aad := []byte("aad")
+
+	err = receiver.ApplicationKeys.Prefetch(2, 5)
+	require.Nil(t, err)
+	require.Equal(t, receiver.ApplicationKeys.CachedGenerations(2), []uint32{0, 1, 2, 3, 4})
+	require.Equal(t, receiver.ApplicationRatchets[2].NextGeneration, uint32(5))
+
+	// The prefetched keys open the sender's messages
+	for i := uint32(0); i < 5; i += 1 {
+		generation, kn, err := sender.ApplicationKeys.Next(2)
+		require.Nil(t, err)
+		require.Equal(t, generation, i)
+		ct, err := suite.seal(kn.Key, kn.Nonce, aad, []byte("message"))
+		require.Nil(t, err)
+
+		kn, err = receiver.ApplicationKeys.Get(2, generation)
+		require.Nil(t, err)
+		pt, err := suite.open(kn.Key, kn.Nonce, aad, ct)
+		require.Nil(t, err)
+		require.Equal(t, pt, []byte("message"))
+	}
+
+	// Acknowledged keys are erased
+	err = receiver.ApplicationKeys.EraseThrough(2, 2)
+	require.Nil(t, err)
+	require.Equal(t, receiver.ApplicationKeys.CachedGenerations(2), []uint32{3, 4})
+	_, err = receiver.ApplicationKeys.Get(2, 1)
+	require.Equal(t, err, ErrKeyErased)
+
+	// A window beyond the skip limit is refused
+	err = receiver.ApplicationKeys.Prefetch(3, int(DefaultMaxGenerationSkip)+2)
+	require.Equal(t, err, ErrKeyTooFar)
+}
+
+func TestGroupKeySourceMembership(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	context := []byte("context")
+	alice, err := newKeyScheduleEpoch(suite, size, epochSecret, context)
+	require.Nil(t, err)
+	bob, err := newKeyScheduleEpoch(suite, size, dup(epochSecret), context)
+	require.Nil(t, err)
+
+	require.True(t, alice.ApplicationKeys.CanGet(MembershipSender, 0))
+	generation, kn, err := alice.ApplicationKeys.Next(MembershipSender)
+	require.Nil(t, err)
+	received, err := bob.ApplicationKeys.Get(MembershipSender, generation)
+	require.Nil(t, err)
+	require.Equal(t, received, kn)
+
+	// Leaf 0's ratchet is separate, and its base key is still available
+	_, leafKN, err := alice.ApplicationKeys.Next(0)
+	require.Nil(t, err)
+	require.NotEqual(t, leafKN.Key, kn.Key)
+	require.NotEqual(t, leafKN.Nonce, kn.Nonce)
+
+	// The membership ratchet is bound to a node of its own, not that of the
+	// last leaf of the largest tree
+	last := LeafIndex(maxLeafCount - 1)
+	require.Equal(t, alice.ApplicationKeys.Ratchets[MembershipSender].Node, membershipNode)
+	require.NotEqual(t, membershipNode, toNodeIndex(last))
+	require.NotEqual(t, membershipNode, root(maxLeafCount))
+
+	// Membership keys are only for application content
+	require.False(t, alice.HandshakeKeys.CanGet(MembershipSender, 0))
+	_, _, err = alice.HandshakeKeys.Next(MembershipSender)
+	require.Error(t, err)
+
+	// The membership key is restored when the epoch is decoded
+	enc, err := syntax.Marshal(alice)
+	require.Nil(t, err)
+	var decoded keyScheduleEpoch
+	_, err = syntax.Unmarshal(enc, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, decoded.MembershipKey, alice.MembershipKey)
+}
+
+func TestGroupKeySourceEraseRange(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(8)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	for i := LeafIndex(0); i < LeafIndex(size); i += 1 {
+		_, _, err := epoch.ApplicationKeys.Next(i)
+		require.Nil(t, err)
+	}
+
+	erased := epoch.ApplicationRatchets[3]
+	epoch.ApplicationKeys.EraseRange(2, 5)
+	require.Equal(t, len(erased.Cache), 0)
+
+	for i := LeafIndex(0); i < LeafIndex(size); i += 1 {
+		_, ok := epoch.ApplicationRatchets[i]
+		require.Equal(t, ok, i < 2 || i >= 5)
+	}
+}
+
+func TestGroupKeySourceEraseUnknownSender(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	fp := epoch.ApplicationBaseKeys.Fingerprint(suite)
+
+	err = epoch.ApplicationKeys.Erase(3, 0)
+	require.Nil(t, err)
+	err = epoch.HandshakeKeys.Erase(3, 0)
+	require.Nil(t, err)
+
+	require.Equal(t, len(epoch.ApplicationRatchets), 0)
+	require.Equal(t, len(epoch.HandshakeRatchets), 0)
+	require.Equal(t, epoch.ApplicationBaseKeys.Fingerprint(suite), fp)
+}
+
+func TestGroupKeySourceConsumedBase(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	// Consume the base secret for leaf 1 behind the key source's back
+	_, err = epoch.ApplicationBaseKeys.Get(1)
+	require.Nil(t, err)
+
+	require.NotPanics(t, func() {
+		_, _, err = epoch.ApplicationKeys.Next(1)
+		require.Error(t, err)
+
+		_, err = epoch.ApplicationKeys.Get(1, 0)
+		require.Error(t, err)
+
+		// There is no ratchet, so nothing to erase
+		err = epoch.ApplicationKeys.Erase(1, 0)
+		require.Nil(t, err)
+	})
+
+	// Other senders are unaffected
+	_, _, err = epoch.ApplicationKeys.Next(2)
+	require.Nil(t, err)
+}
+
+func TestRebuildEpoch(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	original, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	original, err = original.Next(size, nil, bytes.Repeat([]byte{0x01}, 32), []byte("next"))
+	require.Nil(t, err)
+
+	saved := dup(original.EpochSecret)
+	rebuilt, err := RebuildEpoch(suite, size, saved, []byte("next"))
+	require.Nil(t, err)
+	rebuilt.setEpoch(original.CurrentEpoch())
+	require.Nil(t, rebuilt.ConvergesWith(original))
+
+	_, expected, err := original.ApplicationKeys.Next(3)
+	require.Nil(t, err)
+	_, kn, err := rebuilt.ApplicationKeys.Next(3)
+	require.Nil(t, err)
+	require.Equal(t, kn, expected)
+}
+
+func TestKeyScheduleExternalPSK(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	context := []byte("context")
+	psk := []byte("shared external psk")
+
+	alice, err := newKeyScheduleEpochWithExternalPSK(suite, size, psk, context)
+	require.Nil(t, err)
+	bob, err := newKeyScheduleEpochWithExternalPSK(suite, size, dup(psk), context)
+	require.Nil(t, err)
+	require.Nil(t, alice.ConvergesWith(bob))
+
+	eve, err := newKeyScheduleEpochWithExternalPSK(suite, size, []byte("another psk"), context)
+	require.Nil(t, err)
+	require.Error(t, alice.ConvergesWith(eve))
+}
+
+func TestKeyScheduleNextForSuite(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := bytes.Repeat([]byte{0x01}, 32)
+	context := []byte("next")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	next, err := epoch.NextForSuite(suite, size, nil, commitSecret, context)
+	require.Nil(t, err)
+	expected, err := epoch.Next(size, nil, commitSecret, context)
+	require.Nil(t, err)
+	require.Nil(t, next.ConvergesWith(expected))
+
+	_, err = epoch.NextForSuite(X25519_AES128GCM_SHA256_Ed25519, size, nil, commitSecret, context)
+	require.Error(t, err)
+}
+
+func TestKeyScheduleZeroSecret(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(4)
+	context := []byte("context")
+	initSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	expectedEpoch := unhex("a42d6bc6e8eb92d4a18906e33bd3359b7ef7a5e83589d00bcc1a9ce3d44c0aaa")
+
+	zero := ZeroSecret(suite)
+	require.Equal(t, len(zero), suite.newDigest().Size())
+	require.True(t, isZero(zero))
+
+	// An add-only commit
+	epoch := keyScheduleEpoch{Suite: suite, InitSecret: initSecret}
+	next, err := epoch.NextChecked(size, nil, zero, context, true)
+	require.Nil(t, err)
+	require.Equal(t, next.EpochSecret, expectedEpoch)
+	expected, err := epoch.Next(size, nil, ZeroSecret(suite), context)
+	require.Nil(t, err)
+	require.Nil(t, next.ConvergesWith(expected))
+
+	_, err = epoch.NextChecked(size, nil, zero, context, false)
+	require.Error(t, err)
+}
+
+func TestKeySchedulePreviewInitSecret(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := unhex("101112131415161718191a1b1c1d1e1f000102030405060708090a0b0c0d0e0f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	preview, err := epoch.PreviewInitSecret(commitSecret, []byte("next"))
+	require.Nil(t, err)
+	next, err := epoch.Next(size, nil, commitSecret, []byte("next"))
+	require.Nil(t, err)
+	require.Equal(t, preview, next.InitSecret)
+
+	// The preview leaves the epoch as it was
+	again, err := epoch.Next(size, nil, commitSecret, []byte("next"))
+	require.Nil(t, err)
+	require.Equal(t, again.InitSecret, next.InitSecret)
+
+	other, err := epoch.PreviewInitSecret(commitSecret, []byte("other"))
+	require.Nil(t, err)
+	require.NotEqual(t, other, preview)
+}
+
+func TestKeyScheduleJoinerSecret(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	context := []byte("context")
+	initSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := unhex("404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f")
+	psk := unhex("808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+
+	expectedJoiner := unhex("fc92e8d72d18e727716e91c09f407eed3785c05215b7f8ec6404df192275dd9c")
+	expectedEpoch := unhex("ebb6de1cf1606ca240a6c24bca5642b0a562029a04f9df656292dd7d28ce4f70")
+	expectedNoPSK := unhex("2f29308318b3f999cb12701d4b8c798966938571435d488ee5fae2abdc7b7e82")
+
+	require.Equal(t, suite.DeriveJoinerSecret(initSecret, commitSecret), expectedJoiner)
+
+	epoch := keyScheduleEpoch{Suite: suite, InitSecret: initSecret}
+	next, err := epoch.NextWithPSK(size, psk, commitSecret, context)
+	require.Nil(t, err)
+	require.Equal(t, next.EpochSecret, expectedEpoch)
+	require.Equal(t, next.Epoch, Epoch(1))
+
+	// No PSK is the same as an all-zero PSK
+	next, err = epoch.NextWithPSK(size, nil, commitSecret, context)
+	require.Nil(t, err)
+	require.Equal(t, next.EpochSecret, expectedNoPSK)
+}
+
+func TestKeyScheduleApplicationNoFS(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpochWithOptions(suite, size, epochSecret, []byte("context"), KeyScheduleApplicationNoFS, nil)
+	require.Nil(t, err)
+
+	first, err := epoch.ApplicationKeys.Base.Get(3)
+	require.Nil(t, err)
+	second, err := epoch.ApplicationKeys.Base.Get(3)
+	require.Nil(t, err)
+	require.Equal(t, first, second)
+
+	hsBase, err := epoch.HandshakeKeys.Base.Get(3)
+	require.Nil(t, err)
+	require.NotEqual(t, first, hsBase)
+
+	// A discarded ratchet can be rebuilt from the same base key
+	kn0, err := epoch.ApplicationKeys.Get(3, 0)
+	require.Nil(t, err)
+	delete(epoch.ApplicationRatchets, 3)
+	kn1, err := epoch.ApplicationKeys.Get(3, 0)
+	require.Nil(t, err)
+	require.Equal(t, kn0, kn1)
+
+	// The option survives serialization and carries into the next epoch
+	enc, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+	var decoded keyScheduleEpoch
+	_, err = syntax.Unmarshal(enc, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, decoded.Options, KeyScheduleApplicationNoFS)
+
+	next, err := epoch.Next(size, nil, suite.zero(), []byte("next"))
+	require.Nil(t, err)
+	require.Equal(t, next.Options, KeyScheduleApplicationNoFS)
+	_, err = next.ApplicationKeys.Base.Get(3)
+	require.Nil(t, err)
+	_, err = next.ApplicationKeys.Base.Get(3)
+	require.Nil(t, err)
+}
+
+func TestKeyScheduleNextChecked(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := bytes.Repeat([]byte{0x01}, 32)
+	context := []byte("next")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	next, err := epoch.NextChecked(size, nil, commitSecret, context, false)
+	require.Nil(t, err)
+	expected, err := epoch.Next(size, nil, commitSecret, context)
+	require.Nil(t, err)
+	require.Nil(t, next.ConvergesWith(expected))
+
+	// Zero commit secret, with and without the override
+	_, err = epoch.NextChecked(size, nil, suite.zero(), context, false)
+	require.Error(t, err)
+	_, err = epoch.NextChecked(size, nil, suite.zero(), context, true)
+	require.Nil(t, err)
+
+	// Wrong-length inputs
+	_, err = epoch.NextChecked(size, nil, commitSecret[:16], context, false)
+	require.Error(t, err)
+
+	initSecret := epoch.InitSecret
+	epoch.InitSecret = append(dup(initSecret), 0x00)
+	_, err = epoch.NextChecked(size, nil, commitSecret, context, false)
+	require.Error(t, err)
+	epoch.InitSecret = initSecret
+
+	// Zero init secret, which the override doesn't cover
+	epoch.EraseInit()
+	_, err = epoch.NextChecked(size, nil, commitSecret, context, true)
+	require.Error(t, err)
+}
+
+func TestKeyScheduleSenderDataPerSender(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(4)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	for _, sender := range []LeafIndex{1, 2} {
+		key, err := epoch.SenderDataKeyFor(sender)
+		require.Nil(t, err)
+		require.Equal(t, key, epoch.SenderDataKey)
+	}
+
+	epoch, err = newKeyScheduleEpochWithOptions(suite, size, dup(epochSecret), []byte("context"), KeyScheduleSenderDataPerSender, nil)
+	require.Nil(t, err)
+	key1, err := epoch.SenderDataKeyFor(1)
+	require.Nil(t, err)
+	key2, err := epoch.SenderDataKeyFor(2)
+	require.Nil(t, err)
+	require.Equal(t, len(key1), suite.Constants().KeySize)
+	require.NotEqual(t, key1, key2)
+	require.NotEqual(t, key1, epoch.SenderDataKey)
+	again, err := epoch.SenderDataKeyFor(1)
+	require.Nil(t, err)
+	require.Equal(t, key1, again)
+}
+
+func TestKeyScheduleRotateSenderDataKey(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	alice, err := newKeyScheduleEpoch(suite, 2, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	bob, err := newKeyScheduleEpoch(suite, 2, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+	require.Equal(t, alice.SenderDataVersion, uint32(0))
+
+	original := dup(alice.SenderDataKey)
+	version, err := alice.RotateSenderDataKey()
+	require.Nil(t, err)
+	require.Equal(t, version, uint32(1))
+	require.Equal(t, len(alice.SenderDataKey), suite.Constants().KeySize)
+	require.NotEqual(t, alice.SenderDataKey, original)
+
+	second := dup(alice.SenderDataKey)
+	version, err = alice.RotateSenderDataKey()
+	require.Nil(t, err)
+	require.Equal(t, version, uint32(2))
+	require.NotEqual(t, alice.SenderDataKey, second)
+
+	// Peers rotating the same number of times agree on the key
+	bob.RotateSenderDataKey()
+	bob.RotateSenderDataKey()
+	require.Nil(t, alice.ConvergesWith(bob))
+}
+
+func TestKeyScheduleSenderDataSuite(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	sdSuite := X25519_CHACHA20POLY1305_SHA256_Ed25519
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	plain, err := newKeyScheduleEpoch(suite, 2, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	sender, err := newKeyScheduleEpoch(suite, 2, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+	receiver, err := newKeyScheduleEpoch(suite, 2, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+
+	// By default, sender data uses the epoch's own suite
+	require.Equal(t, plain.senderDataSuite(), suite)
+
+	require.Nil(t, sender.UseSenderDataSuite(sdSuite))
+	require.Nil(t, receiver.UseSenderDataSuite(sdSuite))
+	require.Equal(t, sender.senderDataSuite(), sdSuite)
+	require.Equal(t, len(sender.SenderDataKey), sdSuite.Constants().KeySize)
+	require.NotEqual(t, sender.SenderDataKey[:len(plain.SenderDataKey)], plain.SenderDataKey)
+	require.Equal(t, sender.SenderDataSecret, plain.SenderDataSecret)
+
+	nonce := make([]byte, sdSuite.Constants().NonceSize)
+	sendKey, err := sender.SenderDataKeyFor(0)
+	require.Nil(t, err)
+	ct, err := sdSuite.seal(sendKey, nonce, []byte("aad"), []byte("sender data"))
+	require.Nil(t, err)
+	receiveKey, err := receiver.SenderDataKeyFor(0)
+	require.Nil(t, err)
+	pt, err := receiver.senderDataSuite().open(receiveKey, nonce, []byte("aad"), ct)
+	require.Nil(t, err)
+	require.Equal(t, pt, []byte("sender data"))
+
+	// Rotation stays on the sender data suite
+	sender.RotateSenderDataKey()
+	rotated, err := receiver.SenderDataKeyForVersion(1)
+	require.Nil(t, err)
+	require.Equal(t, rotated, sender.SenderDataKey)
+	require.Equal(t, len(rotated), sdSuite.Constants().KeySize)
+
+	require.Error(t, plain.UseSenderDataSuite(X448_AES256GCM_SHA512_Ed448))
+}
+
+func TestKeyScheduleSenderDataKeyForVersion(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	sender, err := newKeyScheduleEpoch(suite, 2, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	receiver, err := newKeyScheduleEpoch(suite, 2, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+
+	for i := 0; i < 3; i += 1 {
+		sender.RotateSenderDataKey()
+	}
+
+	key, err := receiver.SenderDataKeyForVersion(3)
+	require.Nil(t, err)
+	require.Equal(t, key, sender.SenderDataKey)
+	require.Equal(t, receiver.SenderDataVersion, uint32(0))
+
+	current, err := receiver.SenderDataKeyForVersion(0)
+	require.Nil(t, err)
+	require.Equal(t, current, receiver.SenderDataKey)
+
+	// Versions already erased, or too far ahead, are refused
+	receiver.RotateSenderDataKey()
+	_, err = receiver.SenderDataKeyForVersion(0)
+	require.Error(t, err)
+	_, err = receiver.SenderDataKeyForVersion(1 + DefaultMaxGenerationSkip + 1)
+	require.Error(t, err)
+}
+
+func TestKeySchedulePreviewNext(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := bytes.Repeat([]byte{0x01}, 32)
+	context := []byte("next")
+
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	before, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+
+	// Roll back by not applying the preview
+	preview, _, err := epoch.PreviewNext(size, commitSecret, context)
+	require.Nil(t, err)
+	after, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+	require.Equal(t, before, after)
+
+	expected, err := epoch.Next(size, nil, commitSecret, context)
+	require.Nil(t, err)
+	require.Nil(t, preview.ConvergesWith(expected))
+
+	// Apply
+	preview, apply, err := epoch.PreviewNext(size, commitSecret, context)
+	require.Nil(t, err)
+	apply()
+	require.Nil(t, epoch.ConvergesWith(preview))
+	require.Nil(t, epoch.ConvergesWith(expected))
+
+	// A preview is only registered and reported once it is applied
+	warnings := []string{}
+	live := map[string]int{}
+	config := &KeyScheduleConfig{
+		Logger: func(format string, args ...interface{}) {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		},
+		OnSecretAllocated: func(kind string) { live[kind] += 1 },
+	}
+	epoch, err = newKeyScheduleEpochWithOptions(suite, size, epochSecret, []byte("context"), 0, config)
+	require.Nil(t, err)
+	DetectEpochSecretReuse(true)
+	defer DetectEpochSecretReuse(false)
+	allocated := live["init"]
+
+	_, _, err = epoch.PreviewNext(size, commitSecret, context)
+	require.Nil(t, err)
+	_, apply, err = epoch.PreviewNext(size, commitSecret, context)
+	require.Nil(t, err)
+	require.Equal(t, live["init"], allocated)
+	apply()
+	require.Equal(t, live["init"], allocated+1)
+	require.Equal(t, len(warnings), 0)
+}
+
+func TestKeyScheduleHandshakeFS(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpochWithOptions(suite, size, epochSecret, []byte("context"), KeyScheduleHandshakeFS, nil)
+	require.Nil(t, err)
+
+	_, err = epoch.HandshakeKeys.Base.Get(3)
+	require.Nil(t, err)
+	_, err = epoch.HandshakeKeys.Base.Get(3)
+	require.Error(t, err)
+
+	// Handshake keys still work for other senders, and differ from the
+	// default derivation
+	_, kn, err := epoch.HandshakeKeys.Next(1)
+	require.Nil(t, err)
+
+	plain, err := newKeyScheduleEpoch(suite, size, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+	_, plainKN, err := plain.HandshakeKeys.Next(1)
+	require.Nil(t, err)
+	require.NotEqual(t, kn, plainKN)
+
+	// The tree survives serialization and is used again after a restore
+	enc, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+	var decoded keyScheduleEpoch
+	_, err = syntax.Unmarshal(enc, &decoded)
+	require.Nil(t, err)
+	decoded.enableKeySources()
+
+	_, err = decoded.HandshakeKeys.Base.Get(3)
+	require.Error(t, err)
+	_, err = decoded.HandshakeKeys.Base.Get(2)
+	require.Nil(t, err)
+}
+
+func TestKeyScheduleEpochNumber(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	require.Equal(t, epoch.CurrentEpoch(), Epoch(0))
+
+	epoch.Epoch = 41
+	next, err := epoch.Next(size, nil, suite.zero(), []byte("next"))
+	require.Nil(t, err)
+	require.Equal(t, next.CurrentEpoch(), Epoch(42))
+
+	enc, err := syntax.Marshal(next)
+	require.Nil(t, err)
+	var decoded keyScheduleEpoch
+	_, err = syntax.Unmarshal(enc, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, decoded.CurrentEpoch(), Epoch(42))
+}
+
+func TestCustomRatchet(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	epoch.ApplicationKeys.UseRatchets(func(suite CipherSuite, node NodeIndex, baseSecret []byte) Ratchet {
+		return &counterRatchet{suite: suite, base: baseSecret, erased: map[uint32]bool{}}
+	})
+
+	gen, kn, err := epoch.ApplicationKeys.Next(2)
+	require.Nil(t, err)
+	require.Equal(t, gen, uint32(0))
+
+	kn0, err := epoch.ApplicationKeys.Get(2, 0)
+	require.Nil(t, err)
+	require.Equal(t, kn, kn0)
+
+	// Generations can be fetched in any order, since this ratchet keeps no
+	// chain state
+	_, err = epoch.ApplicationKeys.Get(2, 7)
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(2, 3)
+	require.Nil(t, err)
+
+	err = epoch.ApplicationKeys.Erase(2, 0)
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(2, 0)
+	require.Error(t, err)
+
+	require.Equal(t, len(epoch.ApplicationKeys.Custom), 1)
+	require.Equal(t, len(epoch.ApplicationRatchets), 0)
+
+	// The handshake keys still use the default hash ratchet
+	_, _, err = epoch.HandshakeKeys.Next(2)
+	require.Nil(t, err)
+	require.Equal(t, len(epoch.HandshakeRatchets), 1)
+}
+
+func TestKeyScheduleBoundedUnmarshal(t *testing.T) {
+	// A length prefix claiming far more data than is present, for a type that
+	// would otherwise allocate on the basis of the claim
+	type vector struct {
+		Data []byte `tls:"head=4"`
+	}
+	crafted := []byte{0xff, 0xff, 0xff, 0xf0, 0x00, 0x01}
+	_, err := checkVectorBounds(crafted, reflect.TypeOf(vector{}), 0, false, DefaultMaxKeyScheduleVectorSize)
+	require.Error(t, err)
+
+	_, err = checkVectorBounds(crafted, reflect.TypeOf(vector{}), 0, false, 1<<30)
+	require.Error(t, err)
+
+	// A nested oversized prefix inside a map value
+	type nested struct {
+		Entries map[uint32]vector `tls:"head=4"`
+	}
+	crafted = []byte{0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x01, 0x7f, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00}
+	_, err = checkVectorBounds(crafted, reflect.TypeOf(nested{}), 0, false, DefaultMaxKeyScheduleVectorSize)
+	require.Error(t, err)
+
+	// A real epoch passes under the default bound and fails under a tight one
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, 5, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(1, 3)
+	require.Nil(t, err)
+
+	data, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+
+	var epochU keyScheduleEpoch
+	_, err = syntax.Unmarshal(data, &epochU)
+	require.Nil(t, err)
+	require.Equal(t, epochU.EpochSecret, epoch.EpochSecret)
+
+	// The limit comes from the config of the epoch being decoded into
+	limited := keyScheduleEpoch{Config: &KeyScheduleConfig{MaxVectorSize: 16}}
+	_, err = syntax.Unmarshal(data, &limited)
+	require.Error(t, err)
+
+	_, err = syntax.Unmarshal(data, &epochU)
+	require.Nil(t, err)
+}
+
+func TestKeyScheduleProject(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, 5, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	initSecret := dup(epoch.InitSecret)
+
+	commitSecrets := [][]byte{}
+	contexts := [][]byte{}
+	sizes := []LeafCount{}
+	for i := 0; i < 4; i += 1 {
+		commitSecrets = append(commitSecrets, bytes.Repeat([]byte{byte(i)}, 32))
+		contexts = append(contexts, []byte(fmt.Sprintf("context @ %d", i)))
+		sizes = append(sizes, LeafCount(5+i))
+	}
+
+	projected, err := epoch.Project(commitSecrets, contexts, sizes)
+	require.Nil(t, err)
+	require.Equal(t, len(projected), len(commitSecrets))
+	require.Equal(t, epoch.InitSecret, initSecret)
+
+	curr := epoch
+	for i := range commitSecrets {
+		curr, err = curr.Next(sizes[i], nil, commitSecrets[i], contexts[i])
+		require.Nil(t, err)
+		require.Equal(t, projected[i].EpochSecret, curr.EpochSecret)
+		require.Equal(t, projected[i].InitSecret, curr.InitSecret)
+		require.Equal(t, projected[i].ApplicationBaseKeys.Size, sizes[i])
+	}
+
+	_, err = epoch.Project(commitSecrets, contexts[:1], sizes)
+	require.Error(t, err)
+}
+
+func TestKeyScheduleActiveSenders(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(4)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	alice, bob, charlie := LeafIndex(0), LeafIndex(2), LeafIndex(3)
+	_, _, err = epoch.ApplicationKeys.Next(bob)
+	require.Nil(t, err)
+	_, _, err = epoch.ApplicationKeys.Next(alice)
+	require.Nil(t, err)
+	_, _, err = epoch.HandshakeKeys.Next(bob)
+	require.Nil(t, err)
+
+	handshake, application := epoch.ActiveSenders()
+	require.Equal(t, handshake, []LeafIndex{bob})
+	require.Equal(t, application, []LeafIndex{alice, bob})
+	require.NotContains(t, application, charlie)
+}
+
+func TestKeyScheduleApproxMemoryBytes(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	initial := epoch.ApproxMemoryBytes()
+	require.True(t, initial > 0)
+
+	_, _, err = epoch.HandshakeKeys.Next(0)
+	require.Nil(t, err)
+	afterNext := epoch.ApproxMemoryBytes()
+	require.True(t, afterNext > initial)
+
+	_, err = epoch.ApplicationKeys.Get(1, 5)
+	require.Nil(t, err)
+	require.True(t, epoch.ApproxMemoryBytes() > afterNext)
+}
+
+func TestKeyScheduleConvergence(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	alice, err := newKeyScheduleEpoch(suite, 2, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	bob, err := newKeyScheduleEpoch(suite, 2, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+
+	steps := []epochStep{}
+	for i := 0; i < 4; i++ {
+		steps = append(steps, epochStep{
+			CommitSecret: bytes.Repeat([]byte{byte(i)}, 32),
+			Context:      []byte{byte(i)},
+			Size:         LeafCount(3 + i),
+		})
+	}
+
+	err = convergeEpochs(alice, bob, steps, steps)
+	require.Nil(t, err)
+
+	forked := append([]epochStep{}, steps...)
+	forked[2].CommitSecret = bytes.Repeat([]byte{0xff}, 32)
+	err = convergeEpochs(alice, bob, steps, forked)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "step 3")
+}
+
+func TestKeySchedulePRF(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, 2, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	prf := func(label string, message []byte) []byte {
+		mac, err := epoch.PRF(label, message)
+		require.Nil(t, err)
+		return mac
+	}
+
+	mac := prf("token", []byte("message"))
+	require.Equal(t, len(mac), suite.newDigest().Size())
+	require.Equal(t, mac, prf("token", []byte("message")))
+
+	require.NotEqual(t, mac, prf("other", []byte("message")))
+	require.NotEqual(t, mac, prf("token", []byte("other")))
+
+	exported, err := epoch.Export("token", []byte("message"), len(mac))
+	require.Nil(t, err)
+	require.NotEqual(t, mac, exported)
+}
+
+func TestKeyScheduleNextOwnKey(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	context := []byte("context")
+	committer, err := newKeyScheduleEpoch(suite, size, epochSecret, context)
+	require.Nil(t, err)
+	other, err := newKeyScheduleEpoch(suite, size, dup(epochSecret), context)
+	require.Nil(t, err)
+
+	generation, kn, err := committer.NextHandshakeKey(1)
+	require.Nil(t, err)
+	received, err := other.HandshakeKeys.Get(1, generation)
+	require.Nil(t, err)
+	require.Equal(t, received, kn)
+
+	generation, kn, err = committer.NextApplicationKey(1)
+	require.Nil(t, err)
+	received, err = other.ApplicationKeys.Get(1, generation)
+	require.Nil(t, err)
+	require.Equal(t, received, kn)
+	require.NotEqual(t, kn, committer.HandshakeRatchets[1].Cache[0])
+}
+
+func TestKeyScheduleUsable(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := bytes.Repeat([]byte{0x01}, 32)
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	require.True(t, epoch.Usable())
+
+	_, _, err = epoch.NextApplicationKey(1)
+	require.Nil(t, err)
+	_, err = epoch.Export("label", []byte("context"), 16)
+	require.Nil(t, err)
+
+	epoch.EraseExceptInit()
+	require.False(t, epoch.Usable())
+
+	erasedErrors := []struct {
+		name string
+		call func(kse *keyScheduleEpoch) error
+	}{
+		{"NextApplicationKey", func(kse *keyScheduleEpoch) error { _, _, err := kse.NextApplicationKey(1); return err }},
+		{"NextHandshakeKey", func(kse *keyScheduleEpoch) error { _, _, err := kse.NextHandshakeKey(1); return err }},
+		{"Export", func(kse *keyScheduleEpoch) error { _, err := kse.Export("label", []byte("context"), 16); return err }},
+		{"SenderDataKeyForVersion", func(kse *keyScheduleEpoch) error { _, err := kse.SenderDataKeyForVersion(1); return err }},
+		{"PRF", func(kse *keyScheduleEpoch) error { _, err := kse.PRF("label", []byte("message")); return err }},
+		{"SignatureContext", func(kse *keyScheduleEpoch) error { _, err := kse.SignatureContext(); return err }},
+		{"SenderDataKeyFor", func(kse *keyScheduleEpoch) error { _, err := kse.SenderDataKeyFor(1); return err }},
+		{"RotateSenderDataKey", func(kse *keyScheduleEpoch) error { _, err := kse.RotateSenderDataKey(); return err }},
+		{"PreviewInitSecret", func(kse *keyScheduleEpoch) error {
+			_, err := kse.PreviewInitSecret(commitSecret, []byte("next"))
+			return err
+		}},
+		{"ToTestVector", func(kse *keyScheduleEpoch) error { _, err := kse.ToTestVector(); return err }},
+		{"ApplicationKeys.Get", func(kse *keyScheduleEpoch) error { _, err := kse.ApplicationKeys.Get(1, 0); return err }},
+		{"ApplicationKeys.Next", func(kse *keyScheduleEpoch) error { _, _, err := kse.ApplicationKeys.Next(2); return err }},
+		{"HandshakeKeys.Get", func(kse *keyScheduleEpoch) error { _, err := kse.HandshakeKeys.Get(1, 0); return err }},
+		{"OpenNext", func(kse *keyScheduleEpoch) error {
+			_, _, err := kse.ApplicationKeys.OpenNext(1, []byte("aad"), []byte("ciphertext"))
+			return err
+		}},
+	}
+	for _, tc := range erasedErrors {
+		require.Equal(t, tc.call(&epoch), ErrEpochErased, tc.name)
+	}
+
+	// An erased epoch stays unusable when it is decoded
+	enc, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+	var decoded keyScheduleEpoch
+	_, err = syntax.Unmarshal(enc, &decoded)
+	require.Nil(t, err)
+	require.False(t, decoded.Usable())
+	decoded.enableKeySources()
+	for _, tc := range erasedErrors {
+		require.Equal(t, tc.call(&decoded), ErrEpochErased, tc.name)
+	}
+
+	// ... but can still derive its successor
+	next, err := epoch.Next(size, nil, commitSecret, []byte("next"))
+	require.Nil(t, err)
+	require.True(t, next.Usable())
+	_, err = next.Export("label", []byte("context"), 16)
+	require.Nil(t, err)
+}
+
+func TestKeyScheduleSignatureContext(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(2)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := bytes.Repeat([]byte{0x01}, 32)
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	signatureContext := func(kse keyScheduleEpoch) []byte {
+		sigCtx, err := kse.SignatureContext()
+		require.Nil(t, err)
+		return sigCtx
+	}
+
+	sigCtx := signatureContext(epoch)
+	require.Equal(t, len(sigCtx), suite.Constants().SecretSize)
+	require.Equal(t, sigCtx, signatureContext(epoch))
+
+	rebuilt, err := RebuildEpoch(suite, size, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+	require.Equal(t, sigCtx, signatureContext(rebuilt))
+
+	next, err := epoch.Next(size, nil, commitSecret, []byte("next"))
+	require.Nil(t, err)
+	require.NotEqual(t, sigCtx, signatureContext(next))
+	mac, err := epoch.PRF("signature context", []byte{})
+	require.Nil(t, err)
+	require.NotEqual(t, sigCtx, mac)
+}
+
+func TestKeyScheduleExternalInit(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	context := []byte("context")
+	commitSecret := bytes.Repeat([]byte{0x01}, 32)
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, context)
+	require.Nil(t, err)
+
+	externalPriv, err := suite.hpke().Generate()
+	require.Nil(t, err)
+
+	initSecret, ct, err := ExportExternalInit(suite, externalPriv.PublicKey.Data, context)
+	require.Nil(t, err)
+	require.Equal(t, len(initSecret), suite.Constants().SecretSize)
+
+	// A ciphertext for a different group context is rejected
+	_, wrongCt, err := ExportExternalInit(suite, externalPriv.PublicKey.Data, []byte("other"))
+	require.Nil(t, err)
+	_, err = epoch.ImportExternalInit(wrongCt, externalPriv.Data)
+	require.Error(t, err)
+
+	imported, err := epoch.ImportExternalInit(ct, externalPriv.Data)
+	require.Nil(t, err)
+	require.Equal(t, imported, initSecret)
+	require.Equal(t, epoch.InitSecret, initSecret)
+
+	// The caller's copy can be wiped without touching the epoch's
+	zeroize(imported)
+	require.Equal(t, epoch.InitSecret, initSecret)
+
+	// The joiner and the group arrive at the same next epoch
+	joiner := keyScheduleEpoch{Suite: suite, InitSecret: initSecret}
+	next, err := epoch.Next(size, nil, commitSecret, []byte("next"))
+	require.Nil(t, err)
+	expected, err := joiner.Next(size, nil, commitSecret, []byte("next"))
+	require.Nil(t, err)
+	require.Nil(t, next.ConvergesWith(expected))
+
+	// Replacing the init secret is reported to the config's hooks
+	events := []string{}
+	epoch.SetConfig(&KeyScheduleConfig{
+		OnSecretAllocated: func(kind string) { events = append(events, "allocated "+kind) },
+		OnSecretZeroized:  func(kind string) { events = append(events, "zeroized "+kind) },
+	})
+	_, err = epoch.ImportExternalInit(ct, externalPriv.Data)
+	require.Nil(t, err)
+	require.Equal(t, events, []string{"zeroized init", "allocated init"})
+}
+
+func TestGroupInfoKeyContext(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	a := groupInfoKeyAndNonce(suite, epochSecret, []byte("group a"))
+	b := groupInfoKeyAndNonce(suite, epochSecret, []byte("group b"))
+	require.NotEqual(t, a.Key, b.Key)
+	require.NotEqual(t, a.Nonce, b.Nonce)
+	require.Equal(t, a, groupInfoKeyAndNonce(suite, epochSecret, []byte("group a")))
+
+	// A GroupInfo sealed for one group doesn't open for the other
+	ct, err := suite.seal(a.Key, a.Nonce, []byte{}, []byte("group info"))
+	require.Nil(t, err)
+	_, err = suite.open(b.Key, b.Nonce, []byte{}, ct)
+	require.Error(t, err)
+
+	// The empty context gives the keys Welcome has always used
+	secretSize := suite.Constants().SecretSize
+	giSecret := suite.hkdfExpandLabel(epochSecret, "group info", []byte{}, secretSize)
+	require.Equal(t, groupInfoKeyAndNonce(suite, epochSecret, []byte{}).Key,
+		suite.hkdfExpandLabel(giSecret, "key", []byte{}, suite.Constants().KeySize))
+}
+
+func TestWelcomeNonceForRecipient(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	base := groupInfoKeyAndNonce(suite, epochSecret, []byte{}).Nonce
+
+	nonce, err := welcomeNonceForRecipient(base, 0)
+	require.Nil(t, err)
+	require.Equal(t, nonce, base)
+
+	seen := map[string]bool{}
+	for _, index := range []int{0, 1, 2, 255, 256, 1 << 24, math.MaxInt32} {
+		nonce, err := welcomeNonceForRecipient(base, index)
+		require.Nil(t, err)
+		require.Equal(t, len(nonce), len(base))
+		require.False(t, seen[string(nonce)])
+		seen[string(nonce)] = true
+	}
+
+	// The base nonce is left alone
+	require.Equal(t, base, groupInfoKeyAndNonce(suite, epochSecret, []byte{}).Nonce)
+
+	_, err = welcomeNonceForRecipient(base, -1)
+	require.Error(t, err)
+	_, err = welcomeNonceForRecipient(base[:3], 1)
+	require.Error(t, err)
+}
+
+func TestKeyScheduleMarshalTo(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(7)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	for i := LeafIndex(0); i < LeafIndex(size); i += 1 {
+		_, _, err := epoch.HandshakeKeys.Next(i)
+		require.Nil(t, err)
+		_, err = epoch.ApplicationKeys.Get(i, uint32(i))
+		require.Nil(t, err)
+	}
+
+	expected, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	err = epoch.MarshalTo(&buf)
+	require.Nil(t, err)
+	require.Equal(t, buf.Bytes(), expected)
+}
+
+func TestKeyScheduleVersion(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(1, 2)
+	require.Nil(t, err)
+
+	enc, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+	require.Equal(t, enc[:2], []byte{0xff, 0x02})
+
+	// A version from the future is rejected
+	future := dup(enc)
+	future[1] = 0x03
+	var decoded keyScheduleEpoch
+	_, err = syntax.Unmarshal(future, &decoded)
+	require.Error(t, err)
+}
+
+// An epoch encoded before encodings were versioned, from
+// newKeyScheduleEpoch(P256_AES128GCM_SHA256_P256, 2, epochSecret, "context")
+// after ApplicationKeys.Get(1, 1) and HandshakeKeys.Get(0, 0)
+var keyScheduleV1Epoch = unhex(
+	"000207636f6e7465787420000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f208a6b3d3b" +
+		"69955f31c1833445cfb181bfe3cd62cf6f4453b0b358bd449985a0e010159d1f9d4ab991d1d797d2271e61b35d20bf05" +
+		"8e465a82b98de86a3746ea729ceb217c469197a6ffdaff2c6db0dde6218c200000000000000000000000000000000000" +
+		"00000000000000000000000000000020d689a4fb5ae16650c28ea2ad862815233eb538ebdcecb94c9205079e0de94461" +
+		"2083aa713e808e81618b5f237eb1503473eb174571f8d0c59a892b23cd61b5b7da202b9c89203d8ed7af054050e98d87" +
+		"5861125291731ac9e6c4d38a4f128f67c22c000220bf058e465a82b98de86a3746ea729ceb217c469197a6ffdaff2c6d" +
+		"b0dde6218c0002000000200000000100000002000000250000000020d332cc80484e269e8a3dbecfa5bf16571597fb2a" +
+		"3c26aff47deed73db4b3c762000000610000000000020000000020c61acb39b9dc947f44c01fa3fd8a7f864ca6235ca2" +
+		"e5ed515e763765c45ab1a500000001000000220000000010a85ae07ccae5f50051e136ecd9095cc20c2dfd2f7e80b339" +
+		"5da4fc63bb000000100000000c00000020000000830000000100020000000220446e645e5b8833287b2df125e52cbf27" +
+		"acff2469ba2f3f242585e8148a04391c00000002000000440000000010ffa04133a909b54a8d3fe4e0d2e9a0cd0caf69" +
+		"ca7b44299a10a04e8a6800000001103bec3eaab0f77bbc1d65091e9b9648cf0c35f772365e6f435863e08dd700000010" +
+		"0000000c00000020")
+
+func TestKeyScheduleVersion1Migration(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(2)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(1, 1)
+	require.Nil(t, err)
+	_, err = epoch.HandshakeKeys.Get(0, 0)
+	require.Nil(t, err)
+
+	var migrated keyScheduleEpoch
+	read, err := syntax.Unmarshal(keyScheduleV1Epoch, &migrated)
+	require.Nil(t, err)
+	require.Equal(t, read, len(keyScheduleV1Epoch))
+	migrated.enableKeySources()
+	require.Nil(t, migrated.ConvergesWith(epoch))
+	require.Equal(t, migrated.Options, KeyScheduleOption(0))
+	require.Empty(t, migrated.ExternalRatchets)
+
+	// The ratchets pick up where they left off
+	require.Equal(t, migrated.ApplicationKeys.CachedGenerations(1), epoch.ApplicationKeys.CachedGenerations(1))
+	for _, step := range []struct {
+		keys, expected *groupKeySource
+		sender         LeafIndex
+		generation     uint32
+	}{
+		{migrated.ApplicationKeys, epoch.ApplicationKeys, 1, 0},
+		{migrated.ApplicationKeys, epoch.ApplicationKeys, 1, 1},
+		{migrated.ApplicationKeys, epoch.ApplicationKeys, 1, 5},
+		{migrated.ApplicationKeys, epoch.ApplicationKeys, 0, 0},
+		{migrated.HandshakeKeys, epoch.HandshakeKeys, 0, 0},
+		{migrated.HandshakeKeys, epoch.HandshakeKeys, 0, 3},
+		{migrated.HandshakeKeys, epoch.HandshakeKeys, 1, 0},
+	} {
+		actual, err := step.keys.Get(step.sender, step.generation)
+		require.Nil(t, err)
+		expected, err := step.expected.Get(step.sender, step.generation)
+		require.Nil(t, err)
+		require.Equal(t, actual, expected)
+	}
+
+	// Once re-encoded, it is in the current format
+	enc, err := syntax.Marshal(migrated)
+	require.Nil(t, err)
+	require.Equal(t, enc[:2], []byte{0xff, 0x02})
+}
+
+func TestKeyScheduleDump(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(11)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	for _, i := range []LeafIndex{7, 2, 9, 0, 4} {
+		_, err := epoch.HandshakeKeys.Get(i, uint32(i))
+		require.Nil(t, err)
+		_, err = epoch.ApplicationKeys.Get(i, 2)
+		require.Nil(t, err)
+	}
+
+	var first, second bytes.Buffer
+	epoch.dump(&first)
+	epoch.dump(&second)
+	require.Equal(t, first.Bytes(), second.Bytes())
+	require.True(t, first.Len() > 0)
+}
+
+func TestKeyScheduleJSON(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	secrets := [][]byte{
+		dup(epoch.EpochSecret), dup(epoch.SenderDataSecret), dup(epoch.SenderDataKey),
+		dup(epoch.HandshakeSecret), dup(epoch.ApplicationSecret), dup(epoch.ExporterSecret),
+		dup(epoch.ConfirmationKey), dup(epoch.InitSecret),
+	}
+
+	hs, err := epoch.HandshakeKeys.Get(1, 2)
+	require.Nil(t, err)
+	app, err := epoch.ApplicationKeys.Get(3, 0)
+	require.Nil(t, err)
+	secrets = append(secrets, hs.Key, hs.Nonce, app.Key, app.Nonce)
+
+	data, err := json.Marshal(epoch)
+	require.Nil(t, err)
+
+	for _, secret := range secrets {
+		require.False(t, strings.Contains(strings.ToLower(string(data)), hex.EncodeToString(secret)))
+	}
+
+	var decoded map[string]interface{}
+	err = json.Unmarshal(data, &decoded)
+	require.Nil(t, err)
+	for field := range decoded {
+		require.False(t, strings.Contains(strings.ToLower(field), "secret") && field != "tree_secrets")
+		require.False(t, strings.Contains(strings.ToLower(field), "key"))
+	}
+
+	var diag epochDiagnostics
+	err = json.Unmarshal(data, &diag)
+	require.Nil(t, err)
+	require.Equal(t, diag.CipherSuite, suite.String())
+	require.Equal(t, diag.TreeSize, size)
+	require.Equal(t, diag.HandshakeRatchets, []ratchetDiagnostics{{Sender: 1, NextGeneration: 3, CachedKeys: 3}})
+	require.Equal(t, diag.ApplicationRatchets, []ratchetDiagnostics{{Sender: 3, NextGeneration: 1, CachedKeys: 1}})
+}
+
+func TestEpochSecretLabels(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, LeafCount(3), epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	vector, err := epoch.ToTestVector()
+	require.Nil(t, err)
+	var tv epochTestVector
+	err = json.Unmarshal(vector, &tv)
+	require.Nil(t, err)
+
+	v := reflect.ValueOf(epoch)
+	seen := map[string]bool{string(epochSecret): true}
+	labels := map[string]bool{}
+	for _, entry := range epochSecretLabels {
+		require.False(t, labels[entry.Label], entry.Label)
+		labels[entry.Label] = true
+
+		secret := v.FieldByName(entry.Field).Bytes()
+		require.Equal(t, secret, suite.deriveSecret(epochSecret, entry.Label, []byte("context")), entry.Field)
+		require.Equal(t, len(secret), suite.Constants().SecretSize, entry.Field)
+		require.False(t, isZero(secret), entry.Field)
+
+		require.False(t, seen[string(secret)], entry.Field)
+		seen[string(secret)] = true
+
+		vectorValue := reflect.ValueOf(tv).FieldByName(entry.Field).String()
+		require.Equal(t, vectorValue, hex.EncodeToString(secret), entry.Field)
+	}
+}
+
+// The draft's Derive-Secret for SHA-256, written out from the draft's
+// definition on the standard library alone, so that the vector is checked
+// against something other than the key schedule it renders
+func draftDeriveSecretSHA256(secret []byte, label string, context []byte) []byte {
+	contextHash := sha256.Sum256(context)
+	mlsLabel := "mls10 " + label
 
-	checkEpoch := func(epoch *keyScheduleEpoch, size LeafCount) {
-		require.Equal(t, epoch.Suite, suite)
-		require.Equal(t, len(epoch.EpochSecret), secretSize)
-		require.Equal(t, len(epoch.SenderDataSecret), secretSize)
-		require.Equal(t, len(epoch.SenderDataKey), keySize)
-		require.Equal(t, len(epoch.HandshakeSecret), secretSize)
-		require.Equal(t, len(epoch.ApplicationSecret), secretSize)
-		require.Equal(t, len(epoch.ExporterSecret), secretSize)
-		require.Equal(t, len(epoch.ConfirmationKey), secretSize)
-		require.Equal(t, len(epoch.InitSecret), secretSize)
-		require.NotNil(t, epoch.HandshakeKeys)
-		require.NotNil(t, epoch.HandshakeKeys)
+	info := []byte{0x00, sha256.Size, byte(len(mlsLabel))}
+	info = append(info, mlsLabel...)
+	info = append(info, 0x00, 0x00, 0x00, sha256.Size)
+	info = append(info, contextHash[:]...)
 
-		exportedKey := epoch.Export("test", []byte{0, 1, 2, 3}, exportSize)
-		require.Equal(t, len(exportedKey), exportSize)
+	// One block of HKDF-Expand is a full secret
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(info)
+	mac.Write([]byte{0x01})
+	return mac.Sum(nil)
+}
 
-		for i := LeafIndex(0); i < LeafIndex(size); i += 1 {
-			// Test successful generation
-			hs, err := epoch.HandshakeKeys.Get(i, targetGeneration)
-			require.Nil(t, err)
-			require.Equal(t, len(hs.Key), keySize)
-			require.Equal(t, len(hs.Nonce), nonceSize)
+func draftExtractSHA256(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
 
-			app, err := epoch.ApplicationKeys.Get(i, targetGeneration)
-			require.Nil(t, err)
-			require.Equal(t, len(app.Key), keySize)
-			require.Equal(t, len(app.Nonce), nonceSize)
+func TestKeyScheduleToTestVector(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := bytes.Repeat([]byte{0x01}, 32)
+	psk := bytes.Repeat([]byte{0x02}, 32)
+	context := []byte("next")
+	prev, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	prev.Epoch = 2
 
-			epoch.HandshakeKeys.Erase(i, targetGeneration)
-			epoch.ApplicationKeys.Erase(i, targetGeneration)
+	epoch, err := prev.NextWithPSK(size, psk, commitSecret, context)
+	require.Nil(t, err)
 
-			// Test forward secrecy
-			_, err = epoch.HandshakeKeys.Get(i, targetGeneration)
-			require.Error(t, err)
+	tv, err := epoch.ToTestVector()
+	require.Nil(t, err)
+	var fields map[string]interface{}
+	err = json.Unmarshal(tv, &fields)
+	require.Nil(t, err)
 
-			_, err = epoch.ApplicationKeys.Get(i, targetGeneration)
-			require.Error(t, err)
-		}
+	// The vector holds exactly the secrets the draft derives
+	initSecret := draftDeriveSecretSHA256(epochSecret, "init", []byte("context"))
+	joinerSecret := draftExtractSHA256(initSecret, commitSecret)
+	memberSecret := draftExtractSHA256(joinerSecret, psk)
+	nextEpochSecret := draftDeriveSecretSHA256(memberSecret, "epoch", context)
+	derived := func(label string) string {
+		return hex.EncodeToString(draftDeriveSecretSHA256(nextEpochSecret, label, context))
 	}
+	expected := map[string]interface{}{
+		"cipher_suite":           float64(suite),
+		"epoch":                  float64(3),
+		"group_context":          hex.EncodeToString(context),
+		"epoch_secret":           hex.EncodeToString(nextEpochSecret),
+		"joiner_secret":          hex.EncodeToString(joinerSecret),
+		"welcome_secret":         hex.EncodeToString(draftDeriveSecretSHA256(memberSecret, "welcome", context)),
+		"init_secret":            derived("init"),
+		"sender_data_secret":     derived("sender data"),
+		"handshake_secret":       derived("handshake"),
+		"application_secret":     derived("app"),
+		"exporter_secret":        derived("exporter"),
+		"confirmation_key":       derived("confirm"),
+		"membership_key":         derived("membership"),
+		"external_sender_secret": derived("external sender"),
+	}
+	require.Equal(t, expected, fields)
 
-	epoch1 := newKeyScheduleEpoch(suite, size1, epochSecret1, context1)
-	checkEpoch(&epoch1, size1)
+	// An epoch not derived with NextWithPSK has no joiner or welcome secret
+	tv, err = prev.ToTestVector()
+	require.Nil(t, err)
+	fields = nil
+	err = json.Unmarshal(tv, &fields)
+	require.Nil(t, err)
+	require.NotContains(t, fields, "joiner_secret")
+	require.NotContains(t, fields, "welcome_secret")
+	require.Equal(t, fields["init_secret"], hex.EncodeToString(initSecret))
+}
 
-	epoch2 := epoch1.Next(size2, psk2, commitSecret2, context2)
-	checkEpoch(&epoch2, size2)
+func TestKeyScheduleSecretLifetime(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := bytes.Repeat([]byte{0x01}, 32)
 
-	// Check that marshal/unmarshal works
-	epoch2m, err := syntax.Marshal(epoch2)
+	live := map[string]int{}
+	config := &KeyScheduleConfig{
+		OnSecretAllocated: func(kind string) { live[kind] += 1 },
+		OnSecretZeroized:  func(kind string) { live[kind] -= 1 },
+	}
+
+	epoch, err := newKeyScheduleEpochWithOptions(suite, size, dup(epochSecret), []byte("context"), 0, config)
 	require.Nil(t, err)
+	require.Equal(t, live["epoch"], 1)
+	require.Equal(t, live["init"], 1)
 
-	var epoch2u keyScheduleEpoch
-	_, err = syntax.Unmarshal(epoch2m, &epoch2u)
+	epoch.RotateSenderDataKey()
+	next, err := epoch.Next(size, nil, commitSecret, []byte("next"))
 	require.Nil(t, err)
+	require.Equal(t, live["epoch"], 2)
 
-	epoch2u.enableKeySources()
+	epoch.EraseExceptInit()
+	epoch.EraseInit()
+	next.EraseExceptInit()
+	next.EraseInit()
+	for kind, count := range live {
+		require.Equal(t, count, 0, kind)
+	}
+	require.Equal(t, len(live), 10)
+}
 
-	// Verify that the contents match (not the group key generators)
-	require.Equal(t, epoch2.Suite, epoch2u.Suite)
-	require.Equal(t, epoch2.EpochSecret, epoch2u.EpochSecret)
-	require.Equal(t, epoch2.SenderDataSecret, epoch2u.SenderDataSecret)
-	require.Equal(t, epoch2.SenderDataKey, epoch2u.SenderDataKey)
-	require.Equal(t, epoch2.HandshakeSecret, epoch2u.HandshakeSecret)
-	require.Equal(t, epoch2.ApplicationSecret, epoch2u.ApplicationSecret)
-	require.Equal(t, epoch2.ConfirmationKey, epoch2u.ConfirmationKey)
-	require.Equal(t, epoch2.InitSecret, epoch2u.InitSecret)
-	require.Equal(t, epoch2.HandshakeBaseKeys, epoch2u.HandshakeBaseKeys)
-	require.Equal(t, epoch2.ApplicationBaseKeys, epoch2u.ApplicationBaseKeys)
-	require.Equal(t, epoch2.HandshakeRatchets, epoch2u.HandshakeRatchets)
-	require.Equal(t, epoch2.ApplicationRatchets, epoch2u.ApplicationRatchets)
+func TestKeyScheduleConfig(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(3)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	commitSecret := bytes.Repeat([]byte{0x01}, 32)
 
-	// Verify that we can't get a key for the target generation (because it's
-	// already consumed)
-	_, err = epoch2u.HandshakeKeys.Get(0, targetGeneration)
+	config := &KeyScheduleConfig{MaxGenerationSkip: 4}
+	limited, err := newKeyScheduleEpochWithOptions(suite, size, dup(epochSecret), []byte("context"), 0, config)
+	require.Nil(t, err)
+	unlimited, err := newKeyScheduleEpoch(suite, size, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+
+	// The limit applies to the configured epoch only
+	_, err = limited.ApplicationKeys.Get(1, 5)
+	require.Equal(t, err, ErrKeyTooFar)
+	require.False(t, limited.HandshakeKeys.CanGet(1, 5))
+	require.Equal(t, limited.ApplicationKeys.Prefetch(1, 6), ErrKeyTooFar)
+	_, err = limited.SenderDataKeyForVersion(5)
 	require.Error(t, err)
+	_, err = unlimited.ApplicationKeys.Get(1, 5)
+	require.Nil(t, err)
 
-	// Verify that we can get one for the next epoch, and it's the same as the
-	// original key schedule would have produced
-	_, err = epoch2u.HandshakeKeys.Get(0, targetGeneration+1)
+	// ... and to the epochs derived from it
+	next, err := limited.Next(size, nil, commitSecret, []byte("next"))
+	require.Nil(t, err)
+	require.True(t, next.Config == config)
+	_, err = next.ApplicationKeys.Get(1, 5)
+	require.Equal(t, err, ErrKeyTooFar)
+
+	// A decoded epoch takes the config it is given, down to its ratchets
+	_, err = unlimited.ApplicationKeys.Get(2, 0)
 	require.Nil(t, err)
+	data, err := syntax.Marshal(unlimited)
+	require.Nil(t, err)
+
+	var decoded keyScheduleEpoch
+	_, err = syntax.Unmarshal(data, &decoded)
+	require.Nil(t, err)
+	decoded.SetConfig(config)
+	_, err = decoded.ApplicationKeys.Get(2, 6)
+	require.Equal(t, err, ErrKeyTooFar)
+	_, err = decoded.ApplicationKeys.Get(2, 5)
+	require.Nil(t, err)
+}
+
+func TestEpochSecretReuse(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	warnings := []string{}
+	config := &KeyScheduleConfig{
+		Logger: func(format string, args ...interface{}) {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		},
+	}
+	derive := func(context string) {
+		newKeyScheduleEpochWithOptions(suite, 5, epochSecret, []byte(context), 0, config)
+	}
+	DetectEpochSecretReuse(true)
+	defer DetectEpochSecretReuse(false)
+
+	// Any second derivation of the same secret warns, whatever the context
+	derive("group A")
+	require.Equal(t, len(warnings), 0)
+	derive("group A")
+	require.Equal(t, len(warnings), 1)
+	derive("group B")
+	require.Equal(t, len(warnings), 2)
+	require.False(t, strings.Contains(warnings[0], hex.EncodeToString(epochSecret)))
+
+	// Only a fixed number of fingerprints are remembered
+	for i := 0; i < epochSecretReuseWindow; i += 1 {
+		checkEpochSecretReuse(suite, []byte{byte(i), byte(i >> 8)}, config)
+	}
+	require.Equal(t, len(epochSecretReuse.seen), epochSecretReuseWindow)
+	derive("group A")
+	require.Equal(t, len(warnings), 2)
+
+	// Detection is off by default
+	DetectEpochSecretReuse(false)
+	derive("group C")
+	require.Equal(t, len(warnings), 2)
+}
+
+func TestEpochSecretReuseConcurrent(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+
+	DetectEpochSecretReuse(true)
+	defer DetectEpochSecretReuse(false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i += 1 {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			newKeyScheduleEpoch(suite, 5, []byte{byte(i)}, []byte("group"))
+		}(i)
+		go func() {
+			defer wg.Done()
+			DetectEpochSecretReuse(true)
+		}()
+	}
+	wg.Wait()
 }
 
 ///
@@ -201,7 +3301,8 @@ func generateKeyScheduleVectors(t *testing.T) []byte {
 
 			psk := []byte(fmt.Sprintf("psk @ %d", i))
 			commitSecret := []byte(fmt.Sprintf("commitSecret @ %d", i))
-			epoch = epoch.Next(LeafCount(nMembers), psk, commitSecret, ctx)
+			epoch, err = epoch.Next(LeafCount(nMembers), psk, commitSecret, ctx)
+			require.Nil(t, err)
 
 			var handshakeKeys []keyAndNonce
 			var applicationKeys []keyAndNonce
@@ -213,7 +3314,7 @@ func generateKeyScheduleVectors(t *testing.T) []byte {
 				applicationKeys = append(applicationKeys, as)
 			}
 
-			exportedSecret := epoch.Export(string(tv.ExportLabel), tv.ExportContext, int(tv.ExportSize))
+			exportedSecret, _ := epoch.Export(string(tv.ExportLabel), tv.ExportContext, int(tv.ExportSize))
 
 			kse := KsEpoch{
 				PSK:          psk,
@@ -260,7 +3361,8 @@ func verifyKeyScheduleVectors(t *testing.T, data []byte) {
 		myEpoch.InitSecret = tv.BaseInitSecret
 		for _, epoch := range tc.Epochs {
 			ctx, _ := syntax.Marshal(grpCtx)
-			myEpoch = myEpoch.Next(epoch.NumMembers, epoch.PSK, epoch.CommitSecret, ctx)
+			myEpoch, err = myEpoch.Next(epoch.NumMembers, epoch.PSK, epoch.CommitSecret, ctx)
+			require.Nil(t, err)
 
 			// check the secrets
 			require.Equal(t, myEpoch.EpochSecret, epoch.EpochSecret)
@@ -273,7 +3375,8 @@ func verifyKeyScheduleVectors(t *testing.T, data []byte) {
 			require.Equal(t, myEpoch.InitSecret, epoch.InitSecret)
 
 			// check export
-			exportedSecret := myEpoch.Export(string(tv.ExportLabel), tv.ExportContext, int(tv.ExportSize))
+			exportedSecret, err := myEpoch.Export(string(tv.ExportLabel), tv.ExportContext, int(tv.ExportSize))
+			require.Nil(t, err)
 			require.Equal(t, exportedSecret, epoch.ExportedSecret)
 
 			// check the keys
@@ -293,3 +3396,458 @@ func verifyKeyScheduleVectors(t *testing.T, data []byte) {
 		}
 	}
 }
+
+func TestKeyScheduleSharesSecretWith(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	context := []byte("context")
+	commitSecret := unhex("101112131415161718191a1b1c1d1e1f000102030405060708090a0b0c0d0e0f")
+
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, context)
+	require.Nil(t, err)
+	clone, err := newKeyScheduleEpoch(suite, size, dup(epochSecret), context)
+	require.Nil(t, err)
+	next, err := epoch.Next(size, nil, commitSecret, []byte("next"))
+	require.Nil(t, err)
+	otherGroup, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("other"))
+	require.Nil(t, err)
+
+	require.True(t, epoch.SharesSecretWith(clone))
+	require.False(t, epoch.SharesSecretWith(next))
+
+	// A group reusing the epoch secret shares it, even though none of its
+	// other secrets match
+	require.True(t, otherGroup.SharesSecretWith(epoch))
+	require.Error(t, otherGroup.ConvergesWith(epoch))
+
+	// Erased secrets don't count as shared
+	clone.EraseExceptInit()
+	require.True(t, epoch.SharesSecretWith(clone))
+	clone.EraseInit()
+	require.False(t, epoch.SharesSecretWith(clone))
+}
+
+func TestKeyScheduleEnableKeySourcesTwice(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, 5, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	epoch.ApplicationKeys.MaxCachedKeys = 2
+	epoch.ApplicationKeys.EnableStats()
+	_, err = epoch.ApplicationKeys.Get(1, 0)
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(1, 0)
+	require.Nil(t, err)
+
+	sources := epoch.ApplicationKeys
+	epoch.enableKeySources()
+	require.True(t, epoch.ApplicationKeys == sources)
+	require.Equal(t, epoch.ApplicationKeys.MaxCachedKeys, 2)
+	require.Equal(t, epoch.ApplicationKeys.Stats().CacheHits, uint64(1))
+	require.Equal(t, epoch.ApplicationKeys.CachedGenerations(1), []uint32{0})
+
+	// The budget still applies to the keys cached before
+	_, err = epoch.ApplicationKeys.Get(2, 1)
+	require.Nil(t, err)
+	require.Empty(t, epoch.ApplicationKeys.CachedGenerations(1))
+
+	// Once the maps are replaced, the sources are rebuilt around them
+	enc, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+	_, err = syntax.Unmarshal(enc, &epoch)
+	require.Nil(t, err)
+	epoch.enableKeySources()
+	require.False(t, epoch.ApplicationKeys == sources)
+	require.True(t, sameMap(epoch.ApplicationKeys.Ratchets, epoch.ApplicationRatchets))
+}
+
+func TestBaseSecretFromPassword(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	password := []byte("correct horse battery staple")
+
+	root := BaseSecretFromPassword(suite, password, []byte("salt"))
+	require.Equal(t, root, unhex("7052adea8f9823817065456ecad5bf24dcd31a698f7bc9a0b5fc170849af4226"))
+	require.Equal(t, BaseSecretFromPassword(suite, password, []byte("salt")), root)
+	require.NotEqual(t, BaseSecretFromPassword(suite, password, []byte("pepper")), root)
+
+	// Both parties arrive at the same key schedule
+	alice, err := RebuildEpoch(suite, 3, root, []byte("context"))
+	require.Nil(t, err)
+	bob, err := RebuildEpoch(suite, 3, BaseSecretFromPassword(suite, password, []byte("salt")), []byte("context"))
+	require.Nil(t, err)
+	require.Nil(t, alice.ConvergesWith(bob))
+}
+
+func TestKeyScheduleConcurrentNext(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	_, err = epoch.ApplicationKeys.Get(1, 2)
+	require.Nil(t, err)
+
+	before, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+
+	// Two competing commits, each tried several times at once
+	commitSecrets := [][]byte{
+		unhex("101112131415161718191a1b1c1d1e1f000102030405060708090a0b0c0d0e0f"),
+		unhex("202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"),
+	}
+	results := make([]keyScheduleEpoch, 8)
+	errs := make(chan error, 3*len(results))
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			results[i], err = epoch.Next(size, nil, commitSecrets[i%2], []byte("next"))
+			errs <- err
+			if err != nil {
+				return
+			}
+
+			// Using the new epoch doesn't touch the old one
+			_, err = results[i].ApplicationKeys.Get(1, 2)
+			errs <- err
+			_, _, err = results[i].HandshakeKeys.Next(0)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.Nil(t, err)
+	}
+
+	after, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+	require.Equal(t, after, before)
+
+	for i, next := range results {
+		require.Nil(t, next.ConvergesWith(results[i%2]))
+		require.False(t, next.SharesSecretWith(epoch))
+		require.False(t, sameMap(next.ApplicationRatchets, epoch.ApplicationRatchets))
+	}
+	require.False(t, results[0].SharesSecretWith(results[1]))
+}
+
+func TestKeyScheduleSenderDecryptor(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	senders, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	receiver, err := newKeyScheduleEpoch(suite, size, dup(epochSecret), []byte("context"))
+	require.Nil(t, err)
+
+	generations := uint32(5)
+	expected := map[LeafIndex][][2]keyAndNonce{}
+	decryptors := map[LeafIndex]*SenderDecryptor{}
+	for sender := LeafIndex(0); LeafCount(sender) < size; sender += 1 {
+		for gen := uint32(0); gen < generations; gen += 1 {
+			_, hs, err := senders.HandshakeKeys.Next(sender)
+			require.Nil(t, err)
+			_, app, err := senders.ApplicationKeys.Next(sender)
+			require.Nil(t, err)
+			expected[sender] = append(expected[sender], [2]keyAndNonce{hs, app})
+		}
+
+		sd, err := receiver.SenderDecryptor(sender)
+		require.Nil(t, err)
+		decryptors[sender] = sd
+	}
+	require.Empty(t, receiver.ApplicationRatchets)
+	require.Empty(t, receiver.HandshakeRatchets)
+
+	// Each decryptor advances independently, concurrently with the others,
+	// and in a different order
+	var wg sync.WaitGroup
+	results := map[LeafIndex][][2]keyAndNonce{}
+	errs := make(chan error, len(decryptors))
+	var mu sync.Mutex
+	for sender, sd := range decryptors {
+		wg.Add(1)
+		go func(sender LeafIndex, sd *SenderDecryptor) {
+			defer wg.Done()
+			out := make([][2]keyAndNonce, generations)
+			for i := uint32(0); i < generations; i += 1 {
+				gen := generations - 1 - i
+				if sender%2 == 0 {
+					gen = i
+				}
+
+				hs, err := sd.HandshakeKey(gen)
+				if err != nil {
+					errs <- err
+					return
+				}
+				app, err := sd.ApplicationKey(gen)
+				if err != nil {
+					errs <- err
+					return
+				}
+				out[gen] = [2]keyAndNonce{hs, app}
+			}
+
+			mu.Lock()
+			results[sender] = out
+			mu.Unlock()
+		}(sender, sd)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.Nil(t, err)
+	}
+	require.Equal(t, results, expected)
+	for sender, sd := range decryptors {
+		require.Equal(t, sd.Sender, sender)
+		require.Equal(t, sd.Application.NextGeneration, generations)
+	}
+
+	// The application base keys went with the decryptors
+	_, err = receiver.ApplicationKeys.Get(0, 0)
+	require.Error(t, err)
+
+	// The epoch doesn't start the split senders' ratchets over, which would
+	// reuse the decryptors' keys and nonces
+	_, err = receiver.HandshakeKeys.Get(0, 0)
+	require.Equal(t, err, ErrSenderSplit)
+	_, _, err = receiver.NextHandshakeKey(1)
+	require.Equal(t, err, ErrSenderSplit)
+	err = receiver.HandshakeKeys.Restore(map[LeafIndex]RatchetSeed{2: {make([]byte, 32), 0}})
+	require.Equal(t, err, ErrSenderSplit)
+	_, err = syntax.Marshal(receiver)
+	require.Error(t, err)
+}
+
+func TestKeyScheduleSenderDecryptorNoFS(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpochWithOptions(suite, 3, epochSecret, []byte("context"), KeyScheduleApplicationNoFS, nil)
+	require.Nil(t, err)
+
+	_, err = epoch.SenderDecryptor(1)
+	require.Nil(t, err)
+
+	// Without forward secrecy, the base keys could be derived again
+	_, err = epoch.ApplicationKeys.Get(1, 0)
+	require.Equal(t, err, ErrSenderSplit)
+	_, _, err = epoch.NextApplicationKey(1)
+	require.Equal(t, err, ErrSenderSplit)
+
+	_, err = epoch.ApplicationKeys.Get(2, 0)
+	require.Nil(t, err)
+}
+
+func TestKeyScheduleDiff(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	prev, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	next, err := prev.Next(size, nil, bytes.Repeat([]byte{0x01}, suite.Constants().SecretSize), []byte("next context"))
+	require.Nil(t, err)
+	_, err = next.ApplicationKeys.Get(2, 3)
+	require.Nil(t, err)
+
+	diff, err := next.DiffFrom(&prev)
+	require.Nil(t, err)
+
+	// Unchanged fields are left out
+	full, err := syntax.Marshal(next)
+	require.Nil(t, err)
+	require.Less(t, len(diff), len(full))
+
+	rebuilt, err := prev.ApplyDiff(diff)
+	require.Nil(t, err)
+	rebuilt.enableKeySources()
+	require.Nil(t, rebuilt.ConvergesWith(next))
+	require.Equal(t, rebuilt.ApplicationRatchets, next.ApplicationRatchets)
+
+	enc, err := syntax.Marshal(*rebuilt)
+	require.Nil(t, err)
+	require.Equal(t, enc, full)
+
+	// The diff only applies to the epoch it was computed from
+	_, err = next.ApplyDiff(diff)
+	require.Error(t, err)
+
+	// ... and only in the same format version
+	future := dup(diff)
+	future[1] = 0x03
+	_, err = prev.ApplyDiff(future)
+	require.Error(t, err)
+}
+
+func TestKeyScheduleDiffFromBase(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	size := LeafCount(5)
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	parent, err := newKeyScheduleEpoch(suite, size, epochSecret, []byte("context"))
+	require.Nil(t, err)
+	epoch, err := parent.Next(size, nil, bytes.Repeat([]byte{0x01}, suite.Constants().SecretSize), []byte("next context"))
+	require.Nil(t, err)
+
+	// A snapshot of the epoch after its handshake keys have been used
+	_, err = epoch.HandshakeKeys.Get(1, 4)
+	require.Nil(t, err)
+	snapshot, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+	var base keyScheduleEpoch
+	_, err = syntax.Unmarshal(snapshot, &base)
+	require.Nil(t, err)
+	base.enableKeySources()
+
+	_, err = epoch.ApplicationKeys.Get(2, 3)
+	require.Nil(t, err)
+
+	// Diffing and applying derive the epoch again without registering it
+	DetectEpochSecretReuse(true)
+	defer DetectEpochSecretReuse(false)
+
+	// The handshake ratchets haven't changed since the snapshot, so they are
+	// taken from it rather than repeated
+	diff, err := epoch.DiffFrom(&base)
+	require.Nil(t, err)
+	fromParent, err := epoch.DiffFrom(&parent)
+	require.Nil(t, err)
+	require.Less(t, len(diff), len(fromParent))
+
+	rebuilt, err := base.ApplyDiff(diff)
+	require.Nil(t, err)
+	full, err := syntax.Marshal(epoch)
+	require.Nil(t, err)
+	enc, err := syntax.Marshal(*rebuilt)
+	require.Nil(t, err)
+	require.Equal(t, enc, full)
+	require.Empty(t, epochSecretReuse.seen)
+
+	// Once the base has moved on, the diff no longer applies to it
+	_, err = base.HandshakeKeys.Get(1, 5)
+	require.Nil(t, err)
+	_, err = base.ApplyDiff(diff)
+	require.Error(t, err)
+}
+
+func TestGroupKeySourceConcurrentGet(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, LeafCount(4), epochSecret, []byte("context"))
+	require.Nil(t, err)
+	epoch.ApplicationKeys.EnableStats()
+
+	const workers = 32
+	keys := make([]keyAndNonce, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i += 1 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys[i], errs[i] = epoch.ApplicationKeys.Get(1, 3)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < workers; i += 1 {
+		require.Nil(t, errs[i])
+		require.Equal(t, keys[i], keys[0])
+	}
+
+	// The generation was derived once, and every other Get hit the cache
+	stats := epoch.ApplicationKeys.Stats()
+	require.Equal(t, stats.CacheMisses, uint64(1))
+	require.Equal(t, stats.CacheHits, uint64(workers-1))
+}
+
+func TestGroupKeySourceConcurrentUse(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	epochSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	epoch, err := newKeyScheduleEpoch(suite, LeafCount(4), epochSecret, []byte("context"))
+	require.Nil(t, err)
+	reference, err := newKeyScheduleEpoch(suite, LeafCount(4), epochSecret, []byte("context"))
+	require.Nil(t, err)
+
+	// Senders 1-3 are read with Get, Prefetch and EraseThrough while sender
+	// 0 sends with Next
+	const workers = 8
+	const steps = 16
+	type sent struct {
+		generation uint32
+		kn         keyAndNonce
+	}
+	sentCh := make(chan sent, workers*steps)
+	errCh := make(chan error, 2*workers*steps)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i += 1 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < steps; j += 1 {
+				generation, kn, err := epoch.ApplicationKeys.Next(0)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				sentCh <- sent{generation, kn}
+			}
+		}()
+
+		go func(i int) {
+			defer wg.Done()
+			sender := LeafIndex(1 + i%3)
+			for j := 0; j < steps; j += 1 {
+				generation := uint32(j)
+				kn, err := epoch.ApplicationKeys.Get(sender, generation)
+				if err != nil {
+					errCh <- err
+					return
+				}
+
+				expected, err := reference.ApplicationKeys.Get(sender, generation)
+				if err == nil && !(bytes.Equal(kn.Key, expected.Key) && bytes.Equal(kn.Nonce, expected.Nonce)) {
+					err = fmt.Errorf("Wrong key for sender %d generation %d", sender, generation)
+				}
+				if err == nil {
+					err = epoch.ApplicationKeys.Prefetch(sender, 2)
+				}
+				if err == nil {
+					epoch.ApplicationKeys.CachedGenerations(sender)
+					epoch.ApplicationKeys.CanGet(sender, generation)
+				}
+				if err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(sentCh)
+	close(errCh)
+
+	for err := range errCh {
+		require.Nil(t, err)
+	}
+
+	// Every Next returned a distinct generation, with the right key
+	seen := map[uint32]bool{}
+	for s := range sentCh {
+		require.False(t, seen[s.generation])
+		seen[s.generation] = true
+
+		expected, err := reference.ApplicationKeys.Get(0, s.generation)
+		require.Nil(t, err)
+		require.Equal(t, s.kn, expected)
+	}
+	require.Equal(t, len(seen), workers*steps)
+}
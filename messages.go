@@ -680,6 +680,30 @@ type Welcome struct {
 	Secrets            []EncryptedGroupSecrets `tls:"head=4"`
 	EncryptedGroupInfo []byte                  `tls:"head=4"`
 	epochSecret        []byte                  `tls:"omit"`
+	groupInfo          []byte                  `tls:"omit"`
+}
+
+// The context that the GroupInfo key is bound to: the hashes of the
+// KeyPackages that the Welcome is addressed to, in order.  The joiner has these
+// before decrypting, and a GroupInfo sealed for one set of recipients can't be
+// moved into a Welcome for another.
+func (w Welcome) groupInfoContext() []byte {
+	context := []byte{}
+	for _, egs := range w.Secrets {
+		context = append(context, egs.KeyPackageHash...)
+	}
+	return context
+}
+
+// Encrypt the GroupInfo for the Welcome's current recipients
+func (w *Welcome) sealGroupInfo() {
+	kn := groupInfoKeyAndNonce(w.CipherSuite, w.epochSecret, w.groupInfoContext())
+	ct, err := w.CipherSuite.seal(kn.Key, kn.Nonce, []byte{}, w.groupInfo)
+	if err != nil {
+		panic(fmt.Errorf("mls.welcome: GroupInfo encryption failure: %v", err))
+	}
+
+	w.EncryptedGroupInfo = ct
 }
 
 // XXX(rlb): The pattern we follow here basically locks us into having empty
@@ -699,20 +723,16 @@ func newWelcome(cs CipherSuite, epochSecret []byte, groupInfo *GroupInfo) *Welco
 		panic(fmt.Errorf("mls.welcome: GroupInfo marshal failure %v", err))
 	}
 
-	kn := groupInfoKeyAndNonce(cs, epochSecret)
-	aead, err := cs.NewAEAD(kn.Key)
-	if err != nil {
-		panic(fmt.Errorf("mls.welcome: error creating AEAD: %v", err))
-	}
-	ct := aead.Seal(nil, kn.Nonce, pt, []byte{})
-
-	// Assemble the Welcome
-	return &Welcome{
-		Version:            ProtocolVersionMLS10,
-		CipherSuite:        cs,
-		EncryptedGroupInfo: ct,
-		epochSecret:        epochSecret,
+	// Assemble the Welcome.  The GroupInfo is sealed again each time a
+	// recipient is added, since its key is bound to the list of recipients.
+	w := &Welcome{
+		Version:     ProtocolVersionMLS10,
+		CipherSuite: cs,
+		epochSecret: epochSecret,
+		groupInfo:   pt,
 	}
+	w.sealGroupInfo()
+	return w
 }
 
 // TODO(RLB): Return error instead of panicking
@@ -755,17 +775,13 @@ func (w *Welcome) EncryptTo(kp KeyPackage, pathSecret []byte) {
 		EncryptedGroupSecrets: egs,
 	}
 	w.Secrets = append(w.Secrets, ekp)
+	w.sealGroupInfo()
 }
 
 func (w Welcome) Decrypt(suite CipherSuite, epochSecret []byte) (*GroupInfo, error) {
-	gikn := groupInfoKeyAndNonce(suite, epochSecret)
-
-	aead, err := suite.NewAEAD(gikn.Key)
-	if err != nil {
-		return nil, fmt.Errorf("mls.state: error creating AEAD: %v", err)
-	}
+	gikn := groupInfoKeyAndNonce(suite, epochSecret, w.groupInfoContext())
 
-	data, err := aead.Open(nil, gikn.Nonce, w.EncryptedGroupInfo, []byte{})
+	data, err := suite.open(gikn.Key, gikn.Nonce, []byte{}, w.EncryptedGroupInfo)
 	if err != nil {
 		return nil, fmt.Errorf("mls.state: unable to decrypt groupInfo: %v", err)
 	}
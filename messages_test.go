@@ -252,6 +252,7 @@ func TestWelcomeMarshalUnMarshalWithDecryption(t *testing.T) {
 	w1.EncryptTo(keyPackage, randomBytes(32))
 	// doing this so that test can omit this field when matching w1, w2
 	w1.epochSecret = nil
+	w1.groupInfo = nil
 	w2 := new(Welcome)
 	t.Run("WelcomeOneMember", roundTrip(w1, w2))
 
@@ -88,7 +88,11 @@ func NewEmptyStateWithExtensions(groupID []byte, leafSecret []byte, sigPriv Sign
 	}
 
 	secret := make([]byte, suite.newDigest().Size())
-	kse := newKeyScheduleEpoch(suite, 1, secret, []byte{})
+	kse, err := newKeyScheduleEpoch(suite, 1, secret, []byte{})
+	if err != nil {
+		return nil, err
+	}
+
 	s := &State{
 		CipherSuite:             kp.CipherSuite,
 		GroupID:                 groupID,
@@ -100,8 +104,8 @@ func NewEmptyStateWithExtensions(groupID []byte, leafSecret []byte, sigPriv Sign
 		TreePriv:                *treePriv,
 		Scheme:                  kp.Credential.Scheme(),
 		PendingUpdates:          map[ProposalRef]updateSecrets{},
-		ConfirmedTranscriptHash: []byte{},
-		InterimTranscriptHash:   []byte{},
+		ConfirmedTranscriptHash: InitialTranscriptHash(),
+		InterimTranscriptHash:   InitialTranscriptHash(),
 		Extensions:              ext,
 		NewCredentials:          map[LeafIndex]bool{},
 	}
@@ -233,7 +237,11 @@ func NewJoinedState(initSecret []byte, sigPrivs []SignaturePrivateKey, kps []Key
 		return nil, fmt.Errorf("mls.state: groupCtx marshal failure %v", err)
 	}
 
-	s.Keys = newKeyScheduleEpoch(suite, LeafCount(s.Tree.Size()), groupSecrets.EpochSecret, encGrpCtx)
+	s.Keys, err = newKeyScheduleEpoch(suite, LeafCount(s.Tree.Size()), groupSecrets.EpochSecret, encGrpCtx)
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: key schedule failure %v", err)
+	}
+	s.Keys.setEpoch(s.Epoch)
 
 	// confirmation verification
 	if !s.verifyConfirmation(confirmation) {
@@ -538,19 +546,22 @@ func (s State) sign(p Proposal) (*MLSPlaintext, error) {
 	return pt, nil
 }
 
-func (s *State) updateEpochSecrets(secret []byte) {
-	ctx, err := syntax.Marshal(GroupContext{
-		GroupID:                 s.GroupID,
-		Epoch:                   s.Epoch,
-		TreeHash:                s.Tree.RootHash(),
-		ConfirmedTranscriptHash: s.ConfirmedTranscriptHash,
-	})
+func (s *State) updateEpochSecrets(secret []byte) error {
+	// The full group context, including the group's extensions, is bound into
+	// the new epoch, so that a change to the extensions changes the keys
+	ctx, err := syntax.Marshal(s.groupContext())
 	if err != nil {
-		panic(fmt.Errorf("mls.state: update epoch secret failed %v", err))
+		return fmt.Errorf("mls.state: update epoch secret failed %v", err)
 	}
 
 	// TODO(RLB) Provide an API to provide PSKs
-	s.Keys = s.Keys.Next(LeafCount(s.Tree.Size()), nil, secret, ctx)
+	next, err := s.Keys.NextForSuite(s.CipherSuite, LeafCount(s.Tree.Size()), nil, secret, ctx)
+	if err != nil {
+		return fmt.Errorf("mls.state: update epoch secret failed %v", err)
+	}
+
+	s.Keys = next
+	return nil
 }
 
 func (s *State) ratchetAndSign(op Commit, commitSecret []byte, prevGrpCtx GroupContext, sigPriv SignaturePrivateKey) (*MLSPlaintext, error) {
@@ -566,14 +577,13 @@ func (s *State) ratchetAndSign(op Commit, commitSecret []byte, prevGrpCtx GroupC
 	}
 
 	// Update the Confirmed Transcript Hash
-	digest := s.CipherSuite.newDigest()
-	digest.Write(s.InterimTranscriptHash)
-	digest.Write(pt.commitContent())
-	s.ConfirmedTranscriptHash = digest.Sum(nil)
+	s.ConfirmedTranscriptHash = TranscriptHash(s.CipherSuite, s.InterimTranscriptHash, pt.commitContent())
 
 	// Advance the key schedule
 	s.Epoch += 1
-	s.updateEpochSecrets(commitSecret)
+	if err := s.updateEpochSecrets(commitSecret); err != nil {
+		return nil, err
+	}
 
 	// generate the confirmation based on the new keys
 	commit := pt.Content.Commit
@@ -593,10 +603,7 @@ func (s *State) ratchetAndSign(op Commit, commitSecret []byte, prevGrpCtx GroupC
 		return nil, err
 	}
 
-	digest = s.CipherSuite.newDigest()
-	digest.Write(s.ConfirmedTranscriptHash)
-	digest.Write(authData)
-	s.InterimTranscriptHash = digest.Sum(nil)
+	s.InterimTranscriptHash = TranscriptHash(s.CipherSuite, s.ConfirmedTranscriptHash, authData)
 
 	return pt, nil
 }
@@ -665,7 +672,7 @@ func (s *State) Handle(pt *MLSPlaintext) (*State, error) {
 	next.PendingProposals = next.PendingProposals[:0]
 
 	// apply the direct path, if provided
-	commitSecret := s.CipherSuite.zero()
+	commitSecret := ZeroSecret(s.CipherSuite)
 	if commitData.Commit.Path != nil {
 		ctx, err := syntax.Marshal(GroupContext{
 			GroupID:                 next.GroupID,
@@ -691,14 +698,13 @@ func (s *State) Handle(pt *MLSPlaintext) (*State, error) {
 	}
 
 	// Update the confirmed transcript hash
-	digest := next.CipherSuite.newDigest()
-	digest.Write(next.InterimTranscriptHash)
-	digest.Write(pt.commitContent())
-	next.ConfirmedTranscriptHash = digest.Sum(nil)
+	next.ConfirmedTranscriptHash = TranscriptHash(next.CipherSuite, next.InterimTranscriptHash, pt.commitContent())
 
 	// Advance the key schedule
 	next.Epoch += 1
-	next.updateEpochSecrets(commitSecret)
+	if err := next.updateEpochSecrets(commitSecret); err != nil {
+		return nil, err
+	}
 
 	// Verify confirmation MAC
 	if !next.verifyConfirmation(commitData.Confirmation.Data) {
@@ -711,10 +717,7 @@ func (s *State) Handle(pt *MLSPlaintext) (*State, error) {
 	}
 
 	// Update the interim transcript hash
-	digest = next.CipherSuite.newDigest()
-	digest.Write(next.ConfirmedTranscriptHash)
-	digest.Write(authData)
-	next.InterimTranscriptHash = digest.Sum(nil)
+	next.InterimTranscriptHash = TranscriptHash(next.CipherSuite, next.ConfirmedTranscriptHash, authData)
 
 	return next, nil
 }
@@ -731,41 +734,63 @@ func (s State) verifyConfirmation(confirmation []byte) bool {
 	return true
 }
 
-func applyGuard(nonceIn []byte, reuseGuard [4]byte) []byte {
+func applyGuard(suite CipherSuite, nonceIn []byte, reuseGuard []byte) ([]byte, error) {
+	if len(reuseGuard) != suite.ReuseGuardSize() {
+		return nil, fmt.Errorf("mls.state: incorrect reuse guard length %d != %d", len(reuseGuard), suite.ReuseGuardSize())
+	}
+
+	if len(nonceIn) < len(reuseGuard) {
+		return nil, fmt.Errorf("mls.state: nonce too short for reuse guard %d < %d", len(nonceIn), len(reuseGuard))
+	}
+
 	nonceOut := dup(nonceIn)
 	for i := range reuseGuard {
 		nonceOut[i] ^= reuseGuard[i]
 	}
-	return nonceOut
+	return nonceOut, nil
 }
 
 func (s *State) encrypt(pt *MLSPlaintext) (*MLSCiphertext, error) {
 	var generation uint32
 	var keys keyAndNonce
+	var err error
 	switch pt.Content.Type() {
 	case ContentTypeApplication:
-		generation, keys = s.Keys.ApplicationKeys.Next(s.Index)
+		generation, keys, err = s.Keys.NextApplicationKey(s.Index)
 	case ContentTypeProposal, ContentTypeCommit:
-		generation, keys = s.Keys.HandshakeKeys.Next(s.Index)
+		generation, keys, err = s.Keys.NextHandshakeKey(s.Index)
 	default:
 		return nil, fmt.Errorf("mls.state: encrypt unknown content type")
 	}
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: key derivation failed %v", err)
+	}
 
-	var reuseGuard [4]byte
-	rand.Read(reuseGuard[:])
+	reuseGuard := make([]byte, s.CipherSuite.ReuseGuardSize())
+	rand.Read(reuseGuard)
 
+	// The reuse guard is a fixed-length field, so it follows the sender and
+	// generation on the wire with no length prefix
 	stream := syntax.NewWriteStream()
-	err := stream.WriteAll(s.Index, generation, reuseGuard)
+	err = stream.WriteAll(s.Index, generation)
 	if err != nil {
 		return nil, fmt.Errorf("mls.state: sender data marshal failure %v", err)
 	}
 
-	senderData := stream.Data()
-	senderDataNonce := make([]byte, s.CipherSuite.Constants().NonceSize)
+	senderData := append(stream.Data(), reuseGuard...)
+	sdSuite := s.Keys.senderDataSuite()
+	senderDataNonce := make([]byte, sdSuite.Constants().NonceSize)
 	rand.Read(senderDataNonce)
 	senderDataAADVal := senderDataAAD(s.GroupID, s.Epoch, pt.Content.Type(), senderDataNonce)
-	sdAead, _ := s.CipherSuite.NewAEAD(s.Keys.SenderDataKey)
-	sdCt := sdAead.Seal(nil, senderDataNonce, senderData, senderDataAADVal)
+	sdKey, err := s.Keys.SenderDataKeyFor(s.Index)
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: sender data key failure %v", err)
+	}
+
+	sdCt, err := sdSuite.seal(sdKey, senderDataNonce, senderDataAADVal, senderData)
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: sender data encryption failure %v", err)
+	}
 
 	// content data
 	stream = syntax.NewWriteStream()
@@ -780,8 +805,15 @@ func (s *State) encrypt(pt *MLSPlaintext) (*MLSCiphertext, error) {
 
 	aad := contentAAD(s.GroupID, s.Epoch, pt.Content.Type(),
 		pt.AuthenticatedData, senderDataNonce, sdCt)
-	aead, _ := s.CipherSuite.NewAEAD(keys.Key)
-	contentCt := aead.Seal(nil, applyGuard(keys.Nonce, reuseGuard), content, aad)
+	nonce, err := applyGuard(s.CipherSuite, keys.Nonce, reuseGuard)
+	if err != nil {
+		return nil, err
+	}
+
+	contentCt, err := s.CipherSuite.seal(keys.Key, nonce, aad, content)
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: content encryption failure %v", err)
+	}
 
 	// set up MLSCipherText
 	ct := &MLSCiphertext{
@@ -797,6 +829,30 @@ func (s *State) encrypt(pt *MLSPlaintext) (*MLSCiphertext, error) {
 	return ct, nil
 }
 
+// Decrypt the sender data.  With per-sender sender data keys, each member's
+// key is tried in turn, and the sender whose key worked is returned as well.
+func (s *State) openSenderData(sdAAD []byte, ct *MLSCiphertext) ([]byte, *LeafIndex, error) {
+	sdSuite := s.Keys.senderDataSuite()
+	if s.Keys.Options&KeyScheduleSenderDataPerSender == 0 {
+		sd, err := sdSuite.open(s.Keys.SenderDataKey, ct.SenderDataNonce, sdAAD, ct.EncryptedSenderData)
+		return sd, nil, err
+	}
+
+	for i := LeafIndex(0); i < LeafIndex(s.Tree.Size()); i += 1 {
+		sdKey, err := s.Keys.SenderDataKeyFor(i)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sd, err := sdSuite.open(sdKey, ct.SenderDataNonce, sdAAD, ct.EncryptedSenderData)
+		if err == nil {
+			return sd, &i, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("no sender data key matched")
+}
+
 func (s *State) decrypt(ct *MLSCiphertext) (*MLSPlaintext, error) {
 	if !bytes.Equal(ct.GroupID, s.GroupID) {
 		return nil, fmt.Errorf("mls.state: ciphertext not from this group")
@@ -808,21 +864,35 @@ func (s *State) decrypt(ct *MLSCiphertext) (*MLSPlaintext, error) {
 
 	// handle sender data
 	sdAAD := senderDataAAD(ct.GroupID, ct.Epoch, ContentType(ct.ContentType), ct.SenderDataNonce)
-	sdAead, _ := s.CipherSuite.NewAEAD(s.Keys.SenderDataKey)
-	sd, err := sdAead.Open(nil, ct.SenderDataNonce, ct.EncryptedSenderData, sdAAD)
+	sd, keySender, err := s.openSenderData(sdAAD, ct)
 	if err != nil {
 		return nil, fmt.Errorf("mls.state: senderData decryption failure %v", err)
 	}
 
 	// parse the senderData
-	var sender LeafIndex
+	var senderWire uint32
 	var generation uint32
-	var reuseGuard [4]byte
 	stream := syntax.NewReadStream(sd)
-	_, err = stream.ReadAll(&sender, &generation, &reuseGuard)
+	read, err := stream.ReadAll(&senderWire, &generation)
 	if err != nil {
 		return nil, fmt.Errorf("mls.state: senderData unmarshal failure %v", err)
 	}
+	reuseGuard := sd[read:]
+	if len(reuseGuard) != s.CipherSuite.ReuseGuardSize() {
+		return nil, fmt.Errorf("mls.state: senderData incorrect reuse guard length %d", len(reuseGuard))
+	}
+
+	sender, err := LeafIndexFromUint32(senderWire)
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: senderData invalid sender %v", err)
+	}
+	if LeafCount(sender) >= s.Tree.Size() {
+		return nil, fmt.Errorf("mls.state: senderData sender %d out of range", sender)
+	}
+
+	if keySender != nil && *keySender != sender {
+		return nil, fmt.Errorf("mls.state: senderData sender mismatch")
+	}
 
 	var keys keyAndNonce
 	contentType := ContentType(ct.ContentType)
@@ -832,21 +902,28 @@ func (s *State) decrypt(ct *MLSCiphertext) (*MLSPlaintext, error) {
 		if err != nil {
 			return nil, fmt.Errorf("mls.state: application keys extraction failed %v", err)
 		}
-		s.Keys.ApplicationKeys.Erase(sender, generation)
+		err = s.Keys.ApplicationKeys.Erase(sender, generation)
 	case ContentTypeProposal, ContentTypeCommit:
 		keys, err = s.Keys.HandshakeKeys.Get(sender, generation)
 		if err != nil {
 			return nil, fmt.Errorf("mls.state: handshake keys extraction failed %v", err)
 		}
-		s.Keys.HandshakeKeys.Erase(sender, generation)
+		err = s.Keys.HandshakeKeys.Erase(sender, generation)
 	default:
 		return nil, fmt.Errorf("mls.state: unsupported content type")
 	}
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: key erasure failed %v", err)
+	}
 
 	aad := contentAAD(ct.GroupID, ct.Epoch, ContentType(ct.ContentType),
 		ct.AuthenticatedData, ct.SenderDataNonce, ct.EncryptedSenderData)
-	aead, _ := s.CipherSuite.NewAEAD(keys.Key)
-	content, err := aead.Open(nil, applyGuard(keys.Nonce, reuseGuard), ct.Ciphertext, aad)
+	nonce, err := applyGuard(s.CipherSuite, keys.Nonce, reuseGuard)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := s.CipherSuite.open(keys.Key, nonce, aad, ct.Ciphertext)
 	if err != nil {
 		return nil, fmt.Errorf("mls.state: content decryption failure %v", err)
 	}
@@ -124,6 +124,33 @@ func TestStateTwoPerson(t *testing.T) {
 	require.Equal(t, pt, testMessage)
 }
 
+func TestStateWelcomeBoundToRecipients(t *testing.T) {
+	stateTest := setup(t)
+	first0, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0])
+	require.Nil(t, err)
+
+	for i := 1; i < 3; i++ {
+		add, err := first0.Add(stateTest.keyPackages[i])
+		require.Nil(t, err)
+		_, err = first0.Handle(add)
+		require.Nil(t, err)
+	}
+
+	_, welcome, _, err := first0.Commit(randomBytes(32))
+	require.Nil(t, err)
+	require.Equal(t, len(welcome.Secrets), 2)
+
+	// The GroupInfo can't be opened once the list of recipients is changed
+	tampered := *welcome
+	tampered.Secrets = welcome.Secrets[:1]
+	_, err = NewJoinedState(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], stateTest.keyPackages[1:2], tampered)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to decrypt groupInfo")
+
+	_, err = NewJoinedState(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], stateTest.keyPackages[1:2], *welcome)
+	require.Nil(t, err)
+}
+
 const ExtensionTypeGroupTest ExtensionType = 0xFFFF
 
 type GroupTestExtension struct{}
@@ -171,6 +198,28 @@ func TestStateExtensions(t *testing.T) {
 	// TODO(RLB) Test extension verification in NewJoinedState
 }
 
+func TestStateExtensionsBoundToEpoch(t *testing.T) {
+	stateTest := setup(t)
+	groupExtensions := NewExtensionList()
+	groupExtensions.Add(GroupTestExtension{})
+
+	alice0, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0])
+	require.Nil(t, err)
+
+	commitSecret := alice0.CipherSuite.zero()
+	plain := *alice0
+	require.Nil(t, plain.updateEpochSecrets(commitSecret))
+
+	same := *alice0
+	require.Nil(t, same.updateEpochSecrets(commitSecret))
+	require.Nil(t, plain.Keys.ConvergesWith(same.Keys))
+
+	extended := *alice0
+	extended.Extensions = groupExtensions
+	require.Nil(t, extended.updateEpochSecrets(commitSecret))
+	require.Error(t, plain.Keys.ConvergesWith(extended.Keys))
+}
+
 func TestStateMarshalUnmarshal(t *testing.T) {
 	// Create Alice and have her add Bob to a group
 	stateTest := setup(t)
@@ -348,3 +397,48 @@ func TestStateRemove(t *testing.T) {
 		}
 	}
 }
+
+func TestStateSenderDataPerSender(t *testing.T) {
+	stateTest := setupGroup(t)
+	for i := range stateTest.states {
+		stateTest.states[i].Keys.Options |= KeyScheduleSenderDataPerSender
+	}
+
+	sender := &stateTest.states[2]
+	ct, err := sender.Protect(testMessage)
+	require.Nil(t, err)
+
+	// A receiver that doesn't use per-sender keys can't read the sender data
+	_, err = sender.Keys.Suite.open(sender.Keys.SenderDataKey, ct.SenderDataNonce,
+		senderDataAAD(ct.GroupID, ct.Epoch, ContentType(ct.ContentType), ct.SenderDataNonce), ct.EncryptedSenderData)
+	require.Error(t, err)
+
+	for i, receiver := range stateTest.states {
+		if i == 2 {
+			continue
+		}
+
+		pt, err := receiver.Unprotect(ct)
+		require.Nil(t, err)
+		require.Equal(t, pt, testMessage)
+	}
+}
+
+func TestApplyGuard(t *testing.T) {
+	require.Equal(t, suite.ReuseGuardSize(), 4)
+
+	nonce := unhex("000102030405060708090a0b")
+	guarded, err := applyGuard(suite, nonce, []byte{0xff, 0xff, 0xff, 0xff})
+	require.Nil(t, err)
+	require.Equal(t, guarded, unhex("fffefdfc0405060708090a0b"))
+	require.Equal(t, nonce, unhex("000102030405060708090a0b"))
+
+	_, err = applyGuard(suite, nonce, []byte{0xff, 0xff})
+	require.Error(t, err)
+
+	_, err = applyGuard(suite, nonce, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	require.Error(t, err)
+
+	_, err = applyGuard(suite, nonce[:2], []byte{0xff, 0xff, 0xff, 0xff})
+	require.Error(t, err)
+}
@@ -1,5 +1,9 @@
 package mls
 
+import (
+	"fmt"
+)
+
 // The below functions provide the index calculus for the tree structures used in MLS.
 // They are premised on a "flat" representation of a balanced binary tree.  Leaf nodes
 // are even-numbered nodes, with the n-th leaf at 2*n.  Intermediate nodes are held in
@@ -25,7 +29,49 @@ type LeafCount uint32
 type NodeIndex uint32
 type nodeCount uint32
 
+// The largest number of leaves for which the index calculus below is valid.  A
+// tree with more leaves would have more than 2^32 - 1 nodes, so nodeWidth and
+// root would overflow.
+const maxLeafCount LeafCount = 1 << 31
+
+// LeafIndexFromUint32 converts a leaf index from its wire encoding, checking
+// that it can be a leaf of a tree of at most maxLeafCount leaves
+func LeafIndexFromUint32(v uint32) (LeafIndex, error) {
+	if LeafCount(v) >= maxLeafCount {
+		return 0, fmt.Errorf("Leaf index %d out of range", v)
+	}
+
+	return LeafIndex(v), nil
+}
+
+// Uint32 converts a leaf index to its wire encoding
+func (l LeafIndex) Uint32() uint32 {
+	return uint32(l)
+}
+
+// LeafCountFromUint32 converts a leaf count from its wire encoding, checking
+// that it is at most maxLeafCount
+func LeafCountFromUint32(v uint32) (LeafCount, error) {
+	if LeafCount(v) > maxLeafCount {
+		return 0, fmt.Errorf("Leaf count %d out of range", v)
+	}
+
+	return LeafCount(v), nil
+}
+
+// Uint32 converts a leaf count to its wire encoding
+func (n LeafCount) Uint32() uint32 {
+	return uint32(n)
+}
+
+// toNodeIndex panics on a leaf beyond any tree, whose node index would not
+// fit.  Leaf indices read from the wire must be checked first, e.g., with
+// LeafIndexFromUint32, and against the size of the tree where they are used.
 func toNodeIndex(leaf LeafIndex) NodeIndex {
+	if LeafCount(leaf) >= maxLeafCount {
+		panic("toNodeIndex on out-of-range leaf index")
+	}
+
 	return NodeIndex(2 * leaf)
 }
 
@@ -63,7 +109,7 @@ func level(x NodeIndex) uint {
 	return k
 }
 
-// Number of nodes for a tree of size N
+// Number of nodes for a tree of size N, for 0 < N <= maxLeafCount
 func nodeWidth(n LeafCount) nodeCount {
 	return nodeCount(2*n - 1)
 }
@@ -155,6 +201,24 @@ func dirpath(x NodeIndex, n LeafCount) []NodeIndex {
 	return d
 }
 
+// DirpathIncludesRoot checks the invariant that a leaf's direct path climbs to
+// the root of the tree; a leaf that is itself the root (in a one-leaf tree)
+// trivially satisfies it.  It returns false for a leaf outside the tree.
+func DirpathIncludesRoot(leaf LeafIndex, size LeafCount) bool {
+	if size == 0 || size > maxLeafCount || LeafCount(leaf) >= size {
+		return false
+	}
+
+	x := toNodeIndex(leaf)
+	r := root(size)
+	if x == r {
+		return true
+	}
+
+	d := dirpath(x, size)
+	return len(d) > 0 && d[len(d)-1] == r
+}
+
 // Copath for x
 // Ordered from leaf to root
 func copath(x NodeIndex, n LeafCount) []NodeIndex {
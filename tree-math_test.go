@@ -1,6 +1,7 @@
 package mls
 
 import (
+	"math"
 	"reflect"
 	"testing"
 
@@ -330,4 +331,44 @@ func verifyTreeMathVectors(t *testing.T, data []byte) {
 
 func TestTreeMathErrorCases(t *testing.T) {
 	require.Panics(t, func() { toLeafIndex(0x03) })
+	require.Panics(t, func() { toNodeIndex(LeafIndex(maxLeafCount)) })
+	require.Panics(t, func() { toNodeIndex(math.MaxUint32) })
+	require.Equal(t, toNodeIndex(LeafIndex(maxLeafCount-1)), NodeIndex(math.MaxUint32-1))
+}
+
+func TestWireConversions(t *testing.T) {
+	for _, v := range []uint32{0, 1, 1000, uint32(maxLeafCount) - 1} {
+		leaf, err := LeafIndexFromUint32(v)
+		require.Nil(t, err)
+		require.Equal(t, leaf.Uint32(), v)
+		require.Equal(t, toLeafIndex(toNodeIndex(leaf)), leaf)
+	}
+
+	for _, v := range []uint32{0, 1, 1000, uint32(maxLeafCount)} {
+		count, err := LeafCountFromUint32(v)
+		require.Nil(t, err)
+		require.Equal(t, count.Uint32(), v)
+	}
+
+	for _, v := range []uint32{uint32(maxLeafCount), uint32(maxLeafCount) + 1, math.MaxUint32} {
+		_, err := LeafIndexFromUint32(v)
+		require.Error(t, err)
+	}
+
+	for _, v := range []uint32{uint32(maxLeafCount) + 1, math.MaxUint32} {
+		_, err := LeafCountFromUint32(v)
+		require.Error(t, err)
+	}
+}
+
+func TestDirpathIncludesRoot(t *testing.T) {
+	for size := LeafCount(1); size <= 64; size += 1 {
+		for leaf := LeafIndex(0); LeafCount(leaf) < size; leaf += 1 {
+			require.True(t, DirpathIncludesRoot(leaf, size), "leaf %d size %d", leaf, size)
+		}
+
+		require.False(t, DirpathIncludesRoot(LeafIndex(size), size))
+	}
+
+	require.False(t, DirpathIncludesRoot(0, 0))
 }